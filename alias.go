@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// KeyAlias is a unique, human readable name of a key, e.g. treasury-hot-1.
+// A key can have several aliases, an alias points to one key.
+type KeyAlias struct {
+	gorm.Model
+	Alias   string `json:"alias" gorm:"uniqueIndex"`
+	KeyUuid string `json:"key_uuid" gorm:"index"`
+}
+
+// AliasBody creates or updates an alias, key_id is the uuid or another alias of the key
+type AliasBody struct {
+	Alias string `json:"alias"`
+	KeyId string `json:"key_id"`
+}
+
+var (
+	aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+	errAliasExists   = errors.New("alias already exists")
+	errAliasNotFound = errors.New("alias not found")
+)
+
+// validateAlias checks the alias syntax, an alias can not look like a uuid so that ids are never ambiguous
+func validateAlias(alias string) error {
+	if !aliasPattern.MatchString(alias) {
+		return fmt.Errorf("invalid alias %q, use 1 to 64 letters, digits, '.', '_' or '-'", alias)
+	}
+	if _, err := uuid.Parse(alias); err == nil {
+		return fmt.Errorf("invalid alias %q, an alias can not be a uuid", alias)
+	}
+	return nil
+}
+
+// checkNewAlias validates an alias that is about to be created
+func checkNewAlias(db *gorm.DB, alias string) error {
+	if err := validateAlias(alias); err != nil {
+		return err
+	}
+	var count int64
+	if err := db.Model(&KeyAlias{}).Where("alias = ?", alias).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", errAliasExists, alias)
+	}
+	return nil
+}
+
+// checkKeyName validates the optional key_name of a new key, it aborts the request if the name can not be used
+func checkKeyName(ctx *gin.Context, name string) bool {
+	if name == "" {
+		return true
+	}
+	if err := checkNewAlias(getGlobal().db, name); err != nil {
+		abortWithAliasError(ctx, err)
+		return false
+	}
+	return true
+}
+
+// resolveKeyID turns a key uuid or alias into the key uuid, empty if the alias does not exist
+func resolveKeyID(db *gorm.DB, id string) string {
+	if _, err := uuid.Parse(id); err == nil {
+		return id
+	}
+	alias := &KeyAlias{}
+	if err := db.First(alias, "alias = ?", id).Error; err != nil {
+		return ""
+	}
+	return alias.KeyUuid
+}
+
+// getKey finds a key by uuid or alias, nil if there is none
+func getKey(db *gorm.DB, id string) *KeyStore {
+	keyUUID := resolveKeyID(db, id)
+	if keyUUID == "" {
+		log.WithField("key_id", id).Info("alias not found")
+		return nil
+	}
+	return getKeyByUUID(db, keyUUID)
+}
+
+// abortWithAliasError ends an alias request
+func abortWithAliasError(ctx *gin.Context, err error) {
+	log.WithError(err).Error("alias request failed")
+	switch {
+	case errors.Is(err, errAliasNotFound), errors.Is(err, errKeyNotFound):
+		ctx.AbortWithError(404, err)
+	case errors.Is(err, errAliasExists):
+		ctx.AbortWithError(409, err)
+	default:
+		ctx.AbortWithError(400, err)
+	}
+}
+
+// list the aliases, optionally of one key
+func listAliases(ctx *gin.Context) {
+	db := getGlobal().db
+	query := db.Order("alias")
+	if keyId := ctx.Query("key_id"); keyId != "" {
+		query = query.Where("key_uuid = ?", resolveKeyID(db, keyId))
+	}
+	aliases := []KeyAlias{}
+	if err := query.Find(&aliases).Error; err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	result := make([]gin.H, 0, len(aliases))
+	for _, alias := range aliases {
+		result = append(result, gin.H{"alias": alias.Alias, "key_uuid": alias.KeyUuid})
+	}
+	ctx.JSON(http.StatusOK, gin.H{"aliases": result})
+}
+
+// create an alias of a key
+func createAlias(ctx *gin.Context) {
+	requestBody := AliasBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	db := getGlobal().db
+	if err := checkNewAlias(db, requestBody.Alias); err != nil {
+		abortWithAliasError(ctx, err)
+		return
+	}
+	key := getKey(db, requestBody.KeyId)
+	if key == nil {
+		abortWithAliasError(ctx, errKeyNotFound)
+		return
+	}
+	alias := &KeyAlias{Alias: requestBody.Alias, KeyUuid: key.Uuid}
+	if err := db.Create(alias).Error; err != nil {
+		// lost a race with another request creating the same alias
+		abortWithAliasError(ctx, fmt.Errorf("%w: %s", errAliasExists, err))
+		return
+	}
+	log.WithField("alias", alias.Alias).WithField("key_uuid", alias.KeyUuid).Info("alias created")
+	ctx.JSON(http.StatusOK, gin.H{"alias": alias.Alias, "key_uuid": alias.KeyUuid})
+}
+
+// rename an alias and/or point it to another key
+func updateAlias(ctx *gin.Context) {
+	requestBody := AliasBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	db := getGlobal().db
+	alias := &KeyAlias{}
+	if err := db.First(alias, "alias = ?", ctx.Param("alias")).Error; err != nil {
+		abortWithAliasError(ctx, errAliasNotFound)
+		return
+	}
+	old := *alias
+	update := map[string]interface{}{}
+	if requestBody.Alias != "" && requestBody.Alias != alias.Alias {
+		if err := checkNewAlias(db, requestBody.Alias); err != nil {
+			abortWithAliasError(ctx, err)
+			return
+		}
+		update["alias"] = requestBody.Alias
+	}
+	if requestBody.KeyId != "" {
+		key := getKey(db, requestBody.KeyId)
+		if key == nil {
+			abortWithAliasError(ctx, errKeyNotFound)
+			return
+		}
+		update["key_uuid"] = key.Uuid
+	}
+	if len(update) > 0 {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(alias).Updates(update).Error; err != nil {
+				return fmt.Errorf("%w: %s", errAliasExists, err)
+			}
+			updated := old
+			if value, ok := update["alias"]; ok {
+				updated.Alias = value.(string)
+			}
+			if value, ok := update["key_uuid"]; ok {
+				updated.KeyUuid = value.(string)
+			}
+			return followAlias(tx, &old, &updated)
+		})
+		if err != nil {
+			abortWithAliasError(ctx, err)
+			return
+		}
+	}
+	log.WithField("alias", alias.Alias).WithField("key_uuid", alias.KeyUuid).Info("alias updated")
+	ctx.JSON(http.StatusOK, gin.H{"alias": alias.Alias, "key_uuid": alias.KeyUuid})
+}
+
+// delete an alias, the key is not changed
+func deleteAlias(ctx *gin.Context) {
+	err := getGlobal().db.Transaction(func(tx *gorm.DB) error {
+		alias := &KeyAlias{}
+		if err := tx.First(alias, "alias = ?", ctx.Param("alias")).Error; err != nil {
+			return errAliasNotFound
+		}
+		// aliases are deleted for good so that the name can be used again
+		if err := tx.Unscoped().Delete(alias).Error; err != nil {
+			return err
+		}
+		return followAlias(tx, alias, nil)
+	})
+	if errors.Is(err, errAliasNotFound) {
+		abortWithAliasError(ctx, err)
+		return
+	}
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	log.WithField("alias", ctx.Param("alias")).Info("alias deleted")
+	ctx.JSON(http.StatusOK, gin.H{"alias": ctx.Param("alias"), "action": "delete"})
+}
+
+// followAlias keeps the name of a key in step with the alias of the same name: the name follows a renamed
+// alias, and falls back to the uuid when the alias is deleted or points to another key. updated is nil on delete.
+func followAlias(tx *gorm.DB, old, updated *KeyAlias) error {
+	name := old.KeyUuid
+	if updated != nil && updated.KeyUuid == old.KeyUuid {
+		name = updated.Alias
+	}
+	return tx.Model(&KeyStore{}).Where("uuid = ? AND name = ?", old.KeyUuid, old.Alias).Update("name", name).Error
+}
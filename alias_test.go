@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+// the name filter follows the alias of the same name when it is renamed, repointed or deleted
+func TestKeyNameFollowsAlias(t *testing.T) {
+	r := testRouter()
+	generate := func(name string) string {
+		code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/generate_key_pair", map[string]string{"key_name": name})
+		if code != 200 {
+			t.Fatal(code, m)
+		}
+		return m["uuid"].(string)
+	}
+	named := func(name string) []string {
+		code, m := doJSON(t, r, "GET", "/v1/grep11/keys?name="+name, nil)
+		if code != 200 {
+			t.Fatal(code, m)
+		}
+		uuids := []string{}
+		for _, key := range m["keys"].([]interface{}) {
+			uuids = append(uuids, key.(map[string]interface{})["uuid"].(string))
+		}
+		return uuids
+	}
+
+	first := generate("zz-old")
+	second := generate("")
+	if code, m := doJSON(t, r, "PUT", "/v1/grep11/aliases/zz-old", map[string]string{"alias": "zz-new"}); code != 200 {
+		t.Fatal(code, m)
+	}
+	if uuids := named("zz-new"); len(uuids) != 1 || uuids[0] != first {
+		t.Fatal(uuids)
+	}
+	if uuids := named("zz-old"); len(uuids) != 0 {
+		t.Fatal(uuids)
+	}
+	if code, m := doJSON(t, r, "POST", "/v1/grep11/aliases", map[string]string{"alias": "zz-old", "key_id": second}); code != 200 {
+		t.Fatal(code, m)
+	}
+	if uuids := named("zz-old"); len(uuids) != 0 {
+		t.Fatal(uuids)
+	}
+
+	// pointing the alias at another key gives the first key back its uuid as name
+	if code, m := doJSON(t, r, "PUT", "/v1/grep11/aliases/zz-new", map[string]string{"key_id": second}); code != 200 {
+		t.Fatal(code, m)
+	}
+	if uuids := named("zz-new"); len(uuids) != 0 {
+		t.Fatal(uuids)
+	}
+	if key := getKey(getGlobal().db, first); key.Name != first {
+		t.Fatal(key.Name)
+	}
+
+	third := generate("zz-gone")
+	if code, m := doJSON(t, r, "DELETE", "/v1/grep11/aliases/zz-gone", nil); code != 200 {
+		t.Fatal(code, m)
+	}
+	if key := getKey(getGlobal().db, third); key.Name != third {
+		t.Fatal(key.Name)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	log "github.com/sirupsen/logrus"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	// BackendGrep11 sends every crypto operation to HPCS over GREP11
+	BackendGrep11 = "grep11"
+	// BackendEmulator runs crypto operations in-process, for development and CI
+	BackendEmulator = "emulator"
+)
+
+// CryptoBackend is the subset of the GREP11 crypto API used by the signing server.
+// Method signatures mirror pb.CryptoClient so that the GREP11 backend is a thin
+// forwarder, while the emulator implements the same request/response semantics locally.
+type CryptoBackend interface {
+	GetMechanismList(ctx context.Context, in *pb.GetMechanismListRequest, opts ...grpc.CallOption) (*pb.GetMechanismListResponse, error)
+	GetMechanismInfo(ctx context.Context, in *pb.GetMechanismInfoRequest, opts ...grpc.CallOption) (*pb.GetMechanismInfoResponse, error)
+	GenerateRandom(ctx context.Context, in *pb.GenerateRandomRequest, opts ...grpc.CallOption) (*pb.GenerateRandomResponse, error)
+	GenerateKey(ctx context.Context, in *pb.GenerateKeyRequest, opts ...grpc.CallOption) (*pb.GenerateKeyResponse, error)
+	GenerateKeyPair(ctx context.Context, in *pb.GenerateKeyPairRequest, opts ...grpc.CallOption) (*pb.GenerateKeyPairResponse, error)
+	EncryptSingle(ctx context.Context, in *pb.EncryptSingleRequest, opts ...grpc.CallOption) (*pb.EncryptSingleResponse, error)
+	DecryptSingle(ctx context.Context, in *pb.DecryptSingleRequest, opts ...grpc.CallOption) (*pb.DecryptSingleResponse, error)
+	UnwrapKey(ctx context.Context, in *pb.UnwrapKeyRequest, opts ...grpc.CallOption) (*pb.UnwrapKeyResponse, error)
+	DeriveKey(ctx context.Context, in *pb.DeriveKeyRequest, opts ...grpc.CallOption) (*pb.DeriveKeyResponse, error)
+	SignSingle(ctx context.Context, in *pb.SignSingleRequest, opts ...grpc.CallOption) (*pb.SignSingleResponse, error)
+	VerifySingle(ctx context.Context, in *pb.VerifySingleRequest, opts ...grpc.CallOption) (*pb.VerifySingleResponse, error)
+	// Close releases the resources held by the backend, it is called on shutdown
+	Close() error
+}
+
+// errUnsupported fails the operations the configured crypto backend can not run
+var errUnsupported = errors.New("not supported by the crypto backend")
+
+// emulatorOnly fails a feature whose EP11 mechanism parameter grep11 1.2.2 can not carry. The server
+// encodes such parameters in a layout only the emulator reads, HPCS would reject or misread them.
+func emulatorOnly(feature string) error {
+	if getGlobal().cfg.CryptoBackend != BackendEmulator {
+		return fmt.Errorf("%w: %s only runs on the %s backend", errUnsupported, feature, BackendEmulator)
+	}
+	return nil
+}
+
+func newCryptoBackend(config *Config) (CryptoBackend, error) {
+	switch config.CryptoBackend {
+	case "", BackendGrep11:
+		if config.Hpcs.Address == "" || config.Hpcs.Port == "" {
+			return nil, fmt.Errorf("HPCS_ADDRESS and HPCS_PORT are required by the %s backend", BackendGrep11)
+		}
+		log.WithField("backend", BackendGrep11).Info("use HPCS crypto backend")
+		return newGrep11Backend(config)
+	case BackendEmulator:
+		log.WithField("backend", BackendEmulator).Warn("use in-process EP11 emulator, keys are NOT protected by an HSM")
+		return newEmulator(config.SecureEnclavePath)
+	}
+	return nil, fmt.Errorf("unknown crypto backend %q", config.CryptoBackend)
+}
+
+func loadBackend(config *Config) CryptoBackend {
+	b, err := newCryptoBackend(config)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("err: %v", err))
+	}
+	return b
+}
+
+// grep11Backend forwards every call to HPCS over a small pool of long-lived GREP11 connections.
+// Connections are shared by all handlers; gRPC reconnects them in the background, and
+// client() skips or replaces connections whose channel is broken.
+type grep11Backend struct {
+	cfg    *Config
+	lock   sync.Mutex
+	conns  []*grpc.ClientConn
+	next   int
+	closed bool
+}
+
+func newGrep11Backend(config *Config) (*grep11Backend, error) {
+	poolSize := config.Hpcs.PoolSize
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	b := &grep11Backend{cfg: config, conns: make([]*grpc.ClientConn, 0, poolSize)}
+	for i := 0; i < poolSize; i++ {
+		conn, err := grpcCall(b.cfg)
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("could not connect to server: %s", err)
+		}
+		b.conns = append(b.conns, conn)
+	}
+	log.WithField("pool_size", poolSize).Info("GREP11 connection pool ready")
+	return b, nil
+}
+
+// client returns a crypto client on the next usable pooled connection
+func (b *grep11Backend) client() (pb.CryptoClient, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, fmt.Errorf("GREP11 connection pool is closed")
+	}
+
+	start := b.next
+	b.next = (b.next + 1) % len(b.conns)
+	for n := 0; n < len(b.conns); n++ {
+		i := (start + n) % len(b.conns)
+		switch b.conns[i].GetState() {
+		case connectivity.Shutdown:
+			log.WithField("conn", i).Warn("GREP11 connection was shut down, dial again")
+			conn, err := grpcCall(b.cfg)
+			if err != nil {
+				return nil, fmt.Errorf("could not connect to server: %s", err)
+			}
+			b.conns[i] = conn
+			return pb.NewCryptoClient(conn), nil
+		case connectivity.TransientFailure:
+			// try the other connections before failing on this one
+			continue
+		case connectivity.Idle:
+			b.conns[i].Connect()
+		}
+		return pb.NewCryptoClient(b.conns[i]), nil
+	}
+
+	// every connection is failing, retry immediately instead of waiting for the backoff
+	log.Warn("all GREP11 connections are in transient failure")
+	for _, conn := range b.conns {
+		conn.ResetConnectBackoff()
+	}
+	return pb.NewCryptoClient(b.conns[start]), nil
+}
+
+// Close closes every pooled connection
+func (b *grep11Backend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	var firstErr error
+	for _, conn := range b.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (b *grep11Backend) GetMechanismList(ctx context.Context, in *pb.GetMechanismListRequest, opts ...grpc.CallOption) (*pb.GetMechanismListResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetMechanismList(ctx, in, opts...)
+}
+
+func (b *grep11Backend) GetMechanismInfo(ctx context.Context, in *pb.GetMechanismInfoRequest, opts ...grpc.CallOption) (*pb.GetMechanismInfoResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetMechanismInfo(ctx, in, opts...)
+}
+
+func (b *grep11Backend) GenerateRandom(ctx context.Context, in *pb.GenerateRandomRequest, opts ...grpc.CallOption) (*pb.GenerateRandomResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.GenerateRandom(ctx, in, opts...)
+}
+
+func (b *grep11Backend) GenerateKey(ctx context.Context, in *pb.GenerateKeyRequest, opts ...grpc.CallOption) (*pb.GenerateKeyResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.GenerateKey(ctx, in, opts...)
+}
+
+func (b *grep11Backend) GenerateKeyPair(ctx context.Context, in *pb.GenerateKeyPairRequest, opts ...grpc.CallOption) (*pb.GenerateKeyPairResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.GenerateKeyPair(ctx, in, opts...)
+}
+
+func (b *grep11Backend) EncryptSingle(ctx context.Context, in *pb.EncryptSingleRequest, opts ...grpc.CallOption) (*pb.EncryptSingleResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.EncryptSingle(ctx, in, opts...)
+}
+
+func (b *grep11Backend) DecryptSingle(ctx context.Context, in *pb.DecryptSingleRequest, opts ...grpc.CallOption) (*pb.DecryptSingleResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.DecryptSingle(ctx, in, opts...)
+}
+
+func (b *grep11Backend) UnwrapKey(ctx context.Context, in *pb.UnwrapKeyRequest, opts ...grpc.CallOption) (*pb.UnwrapKeyResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.UnwrapKey(ctx, in, opts...)
+}
+
+func (b *grep11Backend) DeriveKey(ctx context.Context, in *pb.DeriveKeyRequest, opts ...grpc.CallOption) (*pb.DeriveKeyResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.DeriveKey(ctx, in, opts...)
+}
+
+func (b *grep11Backend) SignSingle(ctx context.Context, in *pb.SignSingleRequest, opts ...grpc.CallOption) (*pb.SignSingleResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.SignSingle(ctx, in, opts...)
+}
+
+func (b *grep11Backend) VerifySingle(ctx context.Context, in *pb.VerifySingleRequest, opts ...grpc.CallOption) (*pb.VerifySingleResponse, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.VerifySingle(ctx, in, opts...)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchSignItem is one digest to sign, key_id is a key uuid or alias
+type BatchSignItem struct {
+	KeyID  string `json:"key_id"`
+	Digest string `json:"digest"`
+	// sig_format, low_s, chain_id and compressed are the ones of SignBody
+	Format     string `json:"sig_format"`
+	LowS       *bool  `json:"low_s"`
+	ChainID    string `json:"chain_id"`
+	Compressed bool   `json:"compressed"`
+}
+
+// BatchSignBody is the body of the batch sign endpoint
+type BatchSignBody struct {
+	Items []BatchSignItem `json:"items"`
+}
+
+// BatchSignResult is the outcome of one item, in the order of the request.
+// Exactly one of signature and error is set.
+type BatchSignResult struct {
+	Index     int    `json:"index"`
+	KeyID     string `json:"key_id"`
+	Uuid      string `json:"uuid,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// batchKey is a key of a batch, resolved and unwrapped once for all its items
+type batchKey struct {
+	keystore *KeyStore
+	blob     []byte
+	err      error
+}
+
+// sign ECDSA digests with several keys in one call, items failing do not fail the batch
+func signBatch(ctx *gin.Context) {
+	requestBody := BatchSignBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	maxItems := getGlobal().cfg.SignBatchMaxItems
+	if len(requestBody.Items) == 0 || len(requestBody.Items) > maxItems {
+		ctx.AbortWithError(400, fmt.Errorf("a batch must have 1 to %d items, got [%d]", maxItems, len(requestBody.Items)))
+		return
+	}
+	log.WithField("items", len(requestBody.Items)).Info("start batch sign")
+
+	keys := resolveBatchKeys(requestBody.Items)
+	results := make([]BatchSignResult, len(requestBody.Items))
+	concurrency := getGlobal().cfg.SignBatchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i := range requestBody.Items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			item := &requestBody.Items[i]
+			results[i] = BatchSignResult{Index: i, KeyID: item.KeyID}
+			sig, uuid, err := signBatchItem(item, keys[item.KeyID])
+			results[i].Uuid = uuid
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].Signature = toString(sig)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i := range results {
+		if results[i].Error != "" {
+			failed++
+		}
+	}
+	log.WithField("items", len(results)).WithField("failed", failed).Info("batch sign done")
+	ctx.JSON(http.StatusOK, gin.H{
+		"action":    "sign",
+		"total":     len(results),
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+// resolveBatchKeys resolves every distinct key id of the items and unwraps each key once,
+// ids that are aliases of the same key share the unwrapped blob
+func resolveBatchKeys(items []BatchSignItem) map[string]*batchKey {
+	keys := map[string]*batchKey{}
+	byUuid := map[string]*batchKey{}
+	for _, item := range items {
+		if _, ok := keys[item.KeyID]; ok {
+			continue
+		}
+		keystore, err := getUsableKey(item.KeyID, KeyAlgorithmECDSA, KeyUsageSign)
+		if err != nil {
+			keys[item.KeyID] = &batchKey{err: err}
+			continue
+		}
+		if key, ok := byUuid[keystore.Uuid]; ok {
+			keys[item.KeyID] = key
+			continue
+		}
+		key := &batchKey{keystore: keystore}
+		if key.blob, err = unwrapPrivateKey(keystore); err != nil {
+			log.WithError(err).WithField("key_uuid", keystore.Uuid).Error("failed to decrypt private key")
+			key.err = fmt.Errorf("failed to decrypt private key of %s", keystore.Uuid)
+		}
+		keys[item.KeyID], byUuid[keystore.Uuid] = key, key
+	}
+	return keys
+}
+
+func signBatchItem(item *BatchSignItem, key *batchKey) ([]byte, string, error) {
+	if key.err != nil {
+		return nil, "", key.err
+	}
+	mech, data, digest, err := ecSignInput(key.keystore, SignSchemeECDSA, SignModeDigest, "", toByte(item.Digest))
+	if err != nil {
+		return nil, key.keystore.Uuid, err
+	}
+	sig, err := signECMechanism(mech, key.blob, data)
+	if err != nil {
+		return nil, key.keystore.Uuid, fmt.Errorf("failed to sign: %s", err)
+	}
+	sig, err = formatSignature(sig, digest, key.keystore, &SignBody{Format: item.Format, LowS: item.LowS, ChainID: item.ChainID, Compressed: item.Compressed})
+	if err != nil {
+		return nil, key.keystore.Uuid, err
+	}
+	return sig, key.keystore.Uuid, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"signing_server/util"
+)
+
+// A BIP32 master key is a secp256k1 private key kept in HPCS with its chain code. The keys of
+// its paths are derived with CKM_IBM_BTC_DERIVE each time they are used and are never stored,
+// so the clear seed and private keys never leave the HSM.
+// grep11 1.2.2 has no BTCDeriveParm message, BIP32 keys are only supported on the emulator.
+
+// bip32SeedLength is the length in bytes of the seed master keys are generated from, the BIP32 maximum
+const bip32SeedLength = 64
+
+// GenerateBIP32MasterBody is the optional body of BIP32 master key generation
+type GenerateBIP32MasterBody struct {
+	Name string `json:"key_name"`
+}
+
+// bip32Node is a key of a derivation path, blob is its EP11 private key blob
+type bip32Node struct {
+	depth     int
+	index     uint32
+	blob      []byte
+	chainCode []byte
+	// SPKI of the public key, computed on first use
+	spki []byte
+	// nil for the master key
+	parent *bip32Node
+}
+
+// generate a BIP32 master key in HPCS from a random seed, the seed itself is not kept
+func generateBIP32Master(ctx *gin.Context) {
+	log.Info("start generate BIP32 master key")
+	requestBody := GenerateBIP32MasterBody{}
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.BindJSON(&requestBody); err != nil {
+			log.WithError(err).Error("fail to read json body")
+			return
+		}
+	}
+	if !checkKeyName(ctx, requestBody.Name) {
+		return
+	}
+	blob, chainCode, spki, err := generateBIP32MasterInHSM()
+	if errors.Is(err, errUnsupported) {
+		ctx.AbortWithError(501, err)
+		return
+	}
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	key := newBIP32MasterKey(toString(chainCode), toString(spki), KeyOriginGenerated)
+	if err := key.wrapPrivateKey(blob); err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	key.Name = requestBody.Name
+	master := &bip32Node{blob: blob, chainCode: chainCode, spki: spki}
+	xpub, err := master.xpub()
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	keys, err := insertKey(getGlobal().db, key)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":      keys.Uuid,
+		"algorithm": keys.Algorithm,
+		"xpub":      xpub,
+	})
+}
+
+// export the extended public key of a path of a BIP32 master key, the path defaults to m
+func getBIP32XPub(ctx *gin.Context) {
+	path := ctx.DefaultQuery("path", "m")
+	master, err := getUsableKey(ctx.Param("id"), KeyAlgorithmBIP32, KeyUsageDerive)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	node, err := deriveBIP32Path(master, path)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	xpub, err := node.xpub()
+	if err != nil {
+		log.WithError(err).Error("failed to get xpub")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":    master.Uuid,
+		"path":    path,
+		"depth":   node.depth,
+		"xpub":    xpub,
+		"public":  toString(node.spki),
+		"address": ethereumAddress(toString(node.spki)),
+	})
+}
+
+// getKeyAt finds a key by uuid or alias, with a path it is the key derived at the path from a BIP32 master key
+func getKeyAt(keyID, path string) (*KeyStore, error) {
+	keystore := getKey(getGlobal().db, keyID)
+	if keystore == nil {
+		return nil, errKeyNotFound
+	}
+	if path == "" {
+		return keystore, nil
+	}
+	if keystore.Algorithm != KeyAlgorithmBIP32 {
+		return nil, fmt.Errorf("key %s is not a BIP32 master key, it has no derivation path", keystore.Uuid)
+	}
+	if err := keystore.allows(KeyUsageDerive); err != nil {
+		return nil, err
+	}
+	node, err := deriveBIP32Path(keystore, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := node.publicKey(); err != nil {
+		return nil, err
+	}
+	return node.keyStore(keystore, path), nil
+}
+
+// keyStore describes a derived key like a stored secp256k1 key, with the uuid and state of its master.
+// Its blob is kept raw since it only lives for the request.
+func (n *bip32Node) keyStore(master *KeyStore, path string) *KeyStore {
+	key := newBIP32MasterKey("", "", master.Origin)
+	key.Uuid = master.Uuid
+	key.Name = master.Name
+	key.State = master.State
+	key.PrivateKey = toString(n.blob)
+	key.PublicKey = toString(n.spki)
+	key.Address = ethereumAddress(key.PublicKey)
+	key.Algorithm = KeyAlgorithmECDSA
+	key.Usage = KeyUsageSign + "," + KeyUsageVerify
+	key.BlobVersion = KeyBlobRaw
+	key.DerivationPath = path
+	return key
+}
+
+// deriveBIP32Path derives the key of a path like m/44'/60'/0'/0/1 from a master key
+func deriveBIP32Path(master *KeyStore, path string) (*bip32Node, error) {
+	indexes, err := util.ParseBIP32Path(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) > 255 {
+		return nil, fmt.Errorf("derivation path %q is deeper than 255", path)
+	}
+	blob, err := unwrapPrivateKey(master)
+	if err != nil {
+		return nil, err
+	}
+	node := &bip32Node{blob: blob, chainCode: toByte(master.ChainCode), spki: toByte(master.PublicKey)}
+	for _, index := range indexes {
+		child := &bip32Node{depth: node.depth + 1, index: index, parent: node}
+		if child.blob, child.chainCode, child.spki, err = deriveBIP32Key(util.BIP32PrivateToPrivate, node, index); err != nil {
+			return nil, err
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// deriveBIP32Key derives the private key blob or the public key SPKI of a child, its chain code, and the SPKI
+// of a private child when HPCS returns it after the chain code in the checksum
+func deriveBIP32Key(deriveType int, parent *bip32Node, index uint32) (key, chainCode, spki []byte, err error) {
+	if err := emulatorOnly("BIP32 derivation"); err != nil {
+		return nil, nil, nil, err
+	}
+	template := ep11.EP11Attributes{
+		ep11.CKA_KEY_TYPE:        ep11.CKK_EC,
+		ep11.CKA_VALUE_LEN:       0,
+		ep11.CKA_SIGN:            true,
+		ep11.CKA_VERIFY:          true,
+		ep11.CKA_DERIVE:          true,
+		ep11.CKA_EXTRACTABLE:     false,
+		ep11.CKA_IBM_USE_AS_DATA: true,
+	}
+	ecParams, err := asn1.Marshal(util.OIDNamedCurveSecp256k1)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	template[ep11.CKA_EC_PARAMS] = ecParams
+	parm := &util.BTCDeriveParm{Type: uint64(deriveType), ChildKeyIndex: uint64(index), ChainCode: parent.chainCode, Version: util.BTCDeriveParmVersion}
+	deriveKeyResponse, err := getGlobal().backend.DeriveKey(context.Background(), &pb.DeriveKeyRequest{
+		Mech:     parm.Mechanism(),
+		Template: util.AttributeMap(template),
+		BaseKey:  parent.blob,
+	})
+	if err != nil {
+		log.WithError(err).WithField("index", index).Error("BIP32 derive error")
+		return nil, nil, nil, err
+	}
+	checkSum := deriveKeyResponse.GetCheckSum()
+	if len(checkSum) < util.BIP32ChainCodeLength {
+		return nil, nil, nil, fmt.Errorf("HPCS did not return a BIP32 chain code")
+	}
+	key, chainCode = deriveKeyResponse.GetNewKeyBytes(), checkSum[:util.BIP32ChainCodeLength]
+	if deriveType == util.BIP32PrivateToPublic {
+		return key, chainCode, key, nil
+	}
+	if len(checkSum) > util.BIP32ChainCodeLength {
+		spki = checkSum[util.BIP32ChainCodeLength:]
+	}
+	return key, chainCode, spki, nil
+}
+
+// generateBIP32MasterInHSM returns the private key blob, the chain code and the SPKI of a master key derived from a new seed
+func generateBIP32MasterInHSM() (blob, chainCode, spki []byte, err error) {
+	// fail before a seed is generated for nothing
+	if err := emulatorOnly("BIP32 derivation"); err != nil {
+		return nil, nil, nil, err
+	}
+	seedTemplate := ep11.EP11Attributes{
+		ep11.CKA_KEY_TYPE:        ep11.CKK_GENERIC_SECRET,
+		ep11.CKA_CLASS:           ep11.CKO_SECRET_KEY,
+		ep11.CKA_VALUE_LEN:       bip32SeedLength,
+		ep11.CKA_DERIVE:          true,
+		ep11.CKA_IBM_USE_AS_DATA: true,
+		ep11.CKA_EXTRACTABLE:     false,
+	}
+	generateKeyResponse, err := getGlobal().backend.GenerateKey(context.Background(), &pb.GenerateKeyRequest{
+		Mech:     &pb.Mechanism{Mechanism: ep11.CKM_GENERIC_SECRET_KEY_GEN},
+		Template: util.AttributeMap(seedTemplate),
+	})
+	if err != nil {
+		log.WithError(err).Error("generate BIP32 seed error")
+		return nil, nil, nil, err
+	}
+	seed := &bip32Node{blob: generateKeyResponse.GetKeyBytes()}
+	if blob, chainCode, spki, err = deriveBIP32Key(util.BIP32MasterKey, seed, 0); err != nil {
+		return nil, nil, nil, err
+	}
+	if spki == nil {
+		return nil, nil, nil, fmt.Errorf("HPCS did not return the BIP32 master public key")
+	}
+	return blob, chainCode, spki, nil
+}
+
+// publicKey returns the public key of the node. It comes with the derivation of the node, children
+// whose derivation did not return it get it from their parent with a public derivation.
+func (n *bip32Node) publicKey() (*ecdsa.PublicKey, error) {
+	if len(n.spki) == 0 {
+		if n.parent == nil {
+			return nil, fmt.Errorf("BIP32 master key has no public key")
+		}
+		var err error
+		if _, _, n.spki, err = deriveBIP32Key(util.BIP32PrivateToPublic, n.parent, n.index); err != nil {
+			return nil, err
+		}
+	}
+	_, publicKey, err := Convert(n.spki, util.OIDNamedCurveSecp256k1)
+	return publicKey, err
+}
+
+// xpub returns the extended public key of the node
+func (n *bip32Node) xpub() (string, error) {
+	publicKey, err := n.publicKey()
+	if err != nil {
+		return "", err
+	}
+	fingerprint := make([]byte, 4)
+	if n.parent != nil {
+		parentKey, err := n.parent.publicKey()
+		if err != nil {
+			return "", err
+		}
+		fingerprint = util.BIP32Fingerprint(crypto.CompressPubkey(parentKey))
+	}
+	return util.SerializeXPub(n.depth, fingerprint, n.index, n.chainCode, crypto.CompressPubkey(publicKey)), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	"signing_server/util"
+)
+
+// test vector 1 of BIP-32
+func TestBIP32Vector1(t *testing.T) {
+	r := testRouter()
+	seed, err := getGlobal().backend.(*emulator).seal(&emulatorKeyObject{
+		Class:   int64(ep11.CKO_SECRET_KEY),
+		KeyType: int64(ep11.CKK_GENERIC_SECRET),
+		Value:   mustHex(t, "000102030405060708090a0b0c0d0e0f"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, chainCode, spki, err := deriveBIP32Key(util.BIP32MasterKey, &bip32Node{blob: seed}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := newBIP32MasterKey(toString(chainCode), toString(spki), KeyOriginImported)
+	if err := master.wrapPrivateKey(blob); err != nil {
+		t.Fatal(err)
+	}
+	master.Name = "bip32-vector-1"
+	if _, err := insertKey(getGlobal().db, master); err != nil {
+		t.Fatal(err)
+	}
+	for path, xpub := range map[string]string{
+		"m":                      "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8",
+		"m/0'":                   "xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw",
+		"m/0h/1":                 "xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ",
+		"m/0'/1/2'":              "xpub6D4BDPcP2GT577Vvch3R8wDkScZWzQzMMUm3PWbmWvVJrZwQY4VUNgqFJPMM3No2dFDFGTsxxpG5uJh7n7epu4trkrX7x7DogT5Uv6fcLW5",
+		"m/0'/1/2'/2":            "xpub6FHa3pjLCk84BayeJxFW2SP4XRrFd1JYnxeLeU8EqN3vDfZmbqBqaGJAyiLjTAwm6ZLRQUMv1ZACTj37sR62cfN7fe5JnJ7dh8zL4fiyLHV",
+		"m/0'/1/2'/2/1000000000": "xpub6H1LXWLaKsWFhvm6RVpEL9P4KfRZSW7abD2ttkWP3SSQvnyA8FSVqNTEcYFgJS2UaFcxupHiYkro49S8yGasTvXEYBVPamhGW6cFJodrTHy",
+	} {
+		code, m := doJSON(t, r, "GET", "/v1/grep11/key/bip32/xpub/bip32-vector-1?path="+path, nil)
+		if code != 200 || m["xpub"] != xpub {
+			t.Errorf("%s: %d %v", path, code, m["xpub"])
+		}
+	}
+	code, _ := doJSON(t, r, "GET", "/v1/grep11/key/bip32/xpub/bip32-vector-1?path=44/0", nil)
+	if code != 400 {
+		t.Fatal(code)
+	}
+}
+
+// destroying a master key wipes its chain code with its blob
+func TestBIP32Destroy(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/bip32/generate_master", nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	xpub := m["xpub"]
+	if code, m = doJSON(t, r, "GET", "/v1/grep11/key/bip32/xpub/"+id, nil); code != 200 || m["xpub"] != xpub {
+		t.Fatal(code, m)
+	}
+	for _, action := range []string{"disable", "destroy"} {
+		if code, m = doJSON(t, r, "POST", "/v1/grep11/keys/"+id+"/"+action, nil); code != 200 {
+			t.Fatal(action, code, m)
+		}
+	}
+	key := getKey(getGlobal().db, id)
+	if key.PrivateKey != "" || key.ChainCode != "" {
+		t.Fatal("destroyed master key keeps its secrets")
+	}
+}
+
+// grep11 1.2.2 can not carry the derivation parameter, the grep11 backend refuses BIP32 keys
+func TestBIP32Grep11(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/bip32/generate_master", nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	getGlobal().cfg.CryptoBackend = BackendGrep11
+	defer func() { getGlobal().cfg.CryptoBackend = BackendEmulator }()
+	for _, c := range []struct{ method, url string }{
+		{"POST", "/v1/grep11/key/bip32/generate_master"},
+		{"GET", "/v1/grep11/key/bip32/xpub/" + id + "?path=m/0"},
+		{"GET", "/v1/grep11/key/secp256k1/public/" + id + "?path=m/0"},
+	} {
+		if code, _ := doJSON(t, r, c.method, c.url, nil); code != 501 {
+			t.Fatal(c.url, code)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"signing_server/util"
+)
+
+// input types of a PSBT, by the script of the spent output
+const (
+	PSBTInputP2PKH      = "p2pkh"
+	PSBTInputP2SH       = "p2sh"
+	PSBTInputP2WPKH     = "p2wpkh"
+	PSBTInputP2WSH      = "p2wsh"
+	PSBTInputP2SHP2WPKH = "p2sh-p2wpkh"
+	PSBTInputP2SHP2WSH  = "p2sh-p2wsh"
+	PSBTInputP2TR       = "p2tr"
+)
+
+// SignPSBTBody is a BIP-174 PSBT in base64. sighash_type applies to the inputs without PSBT_IN_SIGHASH_TYPE,
+// it defaults to SIGHASH_ALL.
+type SignPSBTBody struct {
+	PSBT        string  `json:"psbt"`
+	SighashType *uint32 `json:"sighash_type"`
+}
+
+// PSBTInputResult is the outcome of an input spending an output of the key
+type PSBTInputResult struct {
+	Index       int    `json:"index"`
+	Type        string `json:"type"`
+	SighashType uint32 `json:"sighash_type"`
+	// hex of the digest signed, or to sign
+	Sighash string `json:"sighash,omitempty"`
+	Signed  bool   `json:"signed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// psbtInput is how an input of a PSBT spends an output of the key
+type psbtInput struct {
+	kind string
+	// public key as it appears in the script, compressed or not
+	publicKey []byte
+	// scriptCode of the sighash, nil for taproot
+	scriptCode []byte
+	amount     int64
+	segwit     bool
+}
+
+// sign the inputs of a PSBT spending outputs of the secp256k1 key and return the PSBT with the partial signatures
+func signPSBT(ctx *gin.Context) {
+	requestBody := SignPSBTBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(requestBody.PSBT, "="))
+	if err != nil {
+		ctx.AbortWithError(400, fmt.Errorf("psbt must be base64: %s", err))
+		return
+	}
+	psbt, err := util.ParsePSBT(raw)
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
+	}
+	keyUUID := ctx.Param("id")
+	keystore, err := getUsableKeyAt(keyUUID, ctx.Query("path"), KeyAlgorithmECDSA, KeyUsageSign)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	if keystore.Curve != CurveSecp256k1 {
+		ctx.AbortWithError(400, fmt.Errorf("key %s is not a secp256k1 key", keystore.Uuid))
+		return
+	}
+	publicKey, err := ecPublicKey(keystore)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	log.WithField("key_uuid", keyUUID).WithField("inputs", len(psbt.Inputs)).Info("start sign PSBT")
+
+	var privateKey []byte
+	results := []PSBTInputResult{}
+	signed := 0
+	for i := range psbt.Inputs {
+		input, err := matchPSBTInput(psbt, i, publicKey)
+		if input == nil && err == nil {
+			continue
+		}
+		// taproot key path spends need BIP-340 signatures
+		if err == nil && input.kind == PSBTInputP2TR {
+			ctx.AbortWithError(501, fmt.Errorf("input %d spends a taproot output: %w", i, errSchnorrUnsupported))
+			return
+		}
+		result := PSBTInputResult{Index: i}
+		if err == nil {
+			result.Type = input.kind
+			if privateKey == nil {
+				if privateKey, err = unwrapPrivateKey(keystore); err != nil {
+					log.WithError(err).Error("failed to decrypt private key")
+					ctx.AbortWithError(500, err)
+					return
+				}
+			}
+			err = signPSBTInput(psbt, i, input, privateKey, publicKey, requestBody.SighashType, &result)
+		}
+		if err != nil {
+			log.WithError(err).WithField("input", i).Warn("PSBT input not signed")
+			result.Error = err.Error()
+		} else {
+			result.Signed = true
+			signed++
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		ctx.AbortWithError(400, fmt.Errorf("no input of the PSBT spends an output of key %s", keystore.Uuid))
+		return
+	}
+	log.WithField("key_uuid", keyUUID).WithField("signed", signed).Info("PSBT signed")
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":   keystore.Uuid,
+		"action": "sign_psbt",
+		"psbt":   base64.StdEncoding.EncodeToString(psbt.Serialize()),
+		"signed": signed,
+		"inputs": results,
+	})
+}
+
+// matchPSBTInput tells how input i spends an output of the public key, nil if it does not
+func matchPSBTInput(psbt *util.PSBT, i int, publicKey *ecdsa.PublicKey) (*psbtInput, error) {
+	// inputs of other signers may come without UTXO
+	if psbt.Finalized(i) || (psbt.Inputs[i].Get(util.PSBTInWitnessUtxo) == nil && psbt.Inputs[i].Get(util.PSBTInNonWitnessUtxo) == nil) {
+		return nil, nil
+	}
+	utxo, witnessOnly, err := psbt.Utxo(i)
+	if err != nil {
+		return nil, err
+	}
+	compressed := crypto.CompressPubkey(publicKey)
+	uncompressed := crypto.FromECDSAPub(publicKey)
+	script, nested := utxo.Script, false
+	if redeemScript := psbt.Inputs[i].Get(util.PSBTInRedeemScript); redeemScript != nil {
+		if !bytes.Equal(script, util.P2SHScript(util.Hash160(redeemScript))) {
+			return nil, fmt.Errorf("redeem script of input %d does not match its UTXO", i)
+		}
+		script, nested = redeemScript, true
+	}
+	input := &psbtInput{amount: utxo.Value, segwit: true}
+	switch {
+	case len(script) == 22 && script[0] == 0x00 && script[1] == 0x14:
+		if !bytes.Equal(script[2:], util.Hash160(compressed)) {
+			return nil, nil
+		}
+		input.kind, input.publicKey, input.scriptCode = PSBTInputP2WPKH, compressed, util.P2PKHScript(script[2:])
+		if nested {
+			input.kind = PSBTInputP2SHP2WPKH
+		}
+	case len(script) == 34 && script[0] == 0x00 && script[1] == 0x20:
+		witnessScript := psbt.Inputs[i].Get(util.PSBTInWitnessScript)
+		if witnessScript == nil {
+			return nil, nil
+		}
+		if !bytes.Equal(script, util.P2WSHScript(witnessScript)) {
+			return nil, fmt.Errorf("witness script of input %d does not match its UTXO", i)
+		}
+		if !scriptHasKey(witnessScript, compressed) {
+			return nil, nil
+		}
+		input.kind, input.publicKey, input.scriptCode = PSBTInputP2WSH, compressed, witnessScript
+		if nested {
+			input.kind = PSBTInputP2SHP2WSH
+		}
+	case len(script) == 34 && script[0] == 0x51 && script[1] == 0x20 && !nested:
+		if !bytes.Equal(script[2:], compressed[1:]) {
+			return nil, nil
+		}
+		input.kind, input.publicKey = PSBTInputP2TR, compressed[1:]
+	default:
+		input.segwit = false
+		for _, key := range [][]byte{compressed, uncompressed} {
+			if (!nested && bytes.Equal(script, util.P2PKHScript(util.Hash160(key)))) || (nested && scriptHasKey(script, key)) {
+				input.publicKey, input.scriptCode = key, script
+			}
+		}
+		if input.publicKey == nil {
+			return nil, nil
+		}
+		input.kind = PSBTInputP2PKH
+		if nested {
+			input.kind = PSBTInputP2SH
+		}
+		if witnessOnly {
+			return nil, fmt.Errorf("%s input %d needs its previous transaction", input.kind, i)
+		}
+	}
+	return input, nil
+}
+
+// signPSBTInput adds the signature of an input to the PSBT
+func signPSBTInput(psbt *util.PSBT, i int, input *psbtInput, privateKey []byte, publicKey *ecdsa.PublicKey, defaultType *uint32, result *PSBTInputResult) error {
+	hashType, ok, err := psbt.SighashType(i)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		hashType = util.SigHashAll
+		if defaultType != nil {
+			hashType = *defaultType
+		}
+	}
+	result.SighashType = hashType
+
+	base := hashType &^ util.SigHashAnyoneCanPay
+	if base < util.SigHashAll || base > util.SigHashSingle || hashType > 0xff {
+		return fmt.Errorf("invalid sighash type 0x%02x", hashType)
+	}
+	var sighash []byte
+	if input.segwit {
+		sighash, err = util.SegwitV0SigHash(psbt.Tx, i, input.scriptCode, input.amount, hashType)
+	} else {
+		sighash, err = util.LegacySigHash(psbt.Tx, i, input.scriptCode, hashType)
+	}
+	if err != nil {
+		return err
+	}
+	result.Sighash = hex.EncodeToString(sighash)
+	sig, err := signEC(privateKey, sighash)
+	if err != nil {
+		return fmt.Errorf("failed to sign: %s", err)
+	}
+	// BIP-146 requires low S, and bitcoin signatures are DER with the sighash byte
+	der, err := util.FormatSignature(sig, sighash, publicKey, util.SignatureOptions{Format: util.SigFormatDER, LowS: true})
+	if err != nil {
+		return err
+	}
+	psbt.Inputs[i].Set(append([]byte{util.PSBTInPartialSig}, input.publicKey...), append(der, byte(hashType)))
+	return nil
+}
+
+// scriptHasKey tells if a script pushes the public key
+func scriptHasKey(script, publicKey []byte) bool {
+	return bytes.Contains(script, append([]byte{byte(len(publicKey))}, publicKey...))
+}
+
+// bitcoinAddresses returns the P2WPKH and untweaked taproot addresses of a secp256k1 public key on the
+// configured network. HPCS can not add the BIP-86 tweak to the private key, so the taproot output key is
+// the key itself, which descriptor wallets know as rawtr(KEY) and not as the tr(KEY) address.
+func bitcoinAddresses(publicKey *ecdsa.PublicKey) (p2wpkh, rawtr string, err error) {
+	hrp, err := util.BitcoinHRP(getGlobal().cfg.BitcoinNetwork)
+	if err != nil {
+		return "", "", err
+	}
+	compressed := crypto.CompressPubkey(publicKey)
+	if p2wpkh, err = util.SegwitAddress(hrp, 0, util.Hash160(compressed)); err != nil {
+		return "", "", err
+	}
+	if rawtr, err = util.SegwitAddress(hrp, 1, compressed[1:]); err != nil {
+		return "", "", err
+	}
+	return p2wpkh, rawtr, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"signing_server/util"
+)
+
+// testPSBT spends one output of each script with a single output PSBT
+func testPSBT(scripts ...[]byte) string {
+	tx := &util.BTCTx{Version: 2, Outputs: []*util.BTCTxOut{{Value: 1000, Script: []byte{0x6a}}}}
+	psbt := &util.PSBT{Tx: tx, Outputs: []util.PSBTMap{{}}}
+	for i, script := range scripts {
+		tx.Inputs = append(tx.Inputs, &util.BTCTxIn{Index: uint32(i), Sequence: 0xffffffff})
+		utxo := make([]byte, 8)
+		binary.LittleEndian.PutUint64(utxo, 10000)
+		utxo = append(append(utxo, byte(len(script))), script...)
+		psbt.Inputs = append(psbt.Inputs, util.PSBTMap{{Key: []byte{util.PSBTInWitnessUtxo}, Value: utxo}})
+	}
+	psbt.Global = util.PSBTMap{{Key: []byte{util.PSBTGlobalUnsignedTx}, Value: tx.Serialize()}}
+	return base64.StdEncoding.EncodeToString(psbt.Serialize())
+}
+
+// segwit inputs are signed, taproot inputs are refused as a whole since EP11 can not sign BIP-340
+func TestSignPSBTTaproot(t *testing.T) {
+	r := testRouter()
+	privateKey := "0303030303030303030303030303030303030303030303030303030303030303"
+	id := importTestKey(t, privateKey)
+	key, _ := crypto.HexToECDSA(privateKey)
+	compressed := crypto.CompressPubkey(&key.PublicKey)
+	p2wpkh := append([]byte{0x00, 0x14}, util.Hash160(compressed)...)
+	p2tr := append([]byte{0x51, 0x20}, compressed[1:]...)
+
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/sign_psbt/"+id, map[string]string{"psbt": testPSBT(p2wpkh)})
+	if code != 200 || m["signed"] != float64(1) {
+		t.Fatal(code, m)
+	}
+	if code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/sign_psbt/"+id, map[string]string{"psbt": testPSBT(p2wpkh, p2tr)}); code != 501 {
+		t.Fatal(code, m)
+	}
+}
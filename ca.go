@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// A certificate authority is a P-* or RSA key of the KeyStore with its CA certificate. Certificates are
+// issued from CSRs with a profile (caprofile.go) and signed in HPCS through util.EP11PrivateKey; their
+// serials are recorded so that the CA can revoke them and publish their status in CRLs and by OCSP.
+
+// defaultRootValidity is the validity of self-signed roots
+const defaultRootValidity = 10 * 365 * 24 * time.Hour
+
+// CertificateAuthority is a key designated to issue certificates
+type CertificateAuthority struct {
+	gorm.Model
+	Name    string `json:"name" gorm:"uniqueIndex"`
+	KeyUuid string `json:"key_uuid" gorm:"index"`
+	// PEM certificate of the CA, self-signed for a root
+	Certificate string `json:"certificate"`
+	// PEM certificates of the issuers of the CA up to its root, empty for a root
+	Chain string `json:"chain"`
+	// number of the last CRL
+	CRLNumber int64 `json:"crl_number"`
+	// base64 DER of the CRL served until it nears its next update, empty when a revocation made it stale
+	CRL           string    `json:"-"`
+	CRLNextUpdate time.Time `json:"-"`
+}
+
+// IssuedCertificate records a certificate issued by a CA
+type IssuedCertificate struct {
+	gorm.Model
+	CAName string `json:"ca" gorm:"uniqueIndex:idx_issued_serial"`
+	// serial number in lower case hex
+	Serial      string     `json:"serial" gorm:"uniqueIndex:idx_issued_serial"`
+	Profile     string     `json:"profile"`
+	Subject     string     `json:"subject"`
+	NotBefore   time.Time  `json:"not_before"`
+	NotAfter    time.Time  `json:"not_after"`
+	Certificate string     `json:"certificate"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	// RFC 5280 CRLReason of a revoked certificate
+	RevocationReason int `json:"revocation_reason"`
+	// base64 DER of the OCSP response served until it nears its next update, for requests
+	// identifying the issuer with OCSPHash. Empty when a revocation made it stale.
+	OCSPResponse   string    `json:"-"`
+	OCSPHash       uint      `json:"-"`
+	OCSPNextUpdate time.Time `json:"-"`
+}
+
+// CreateCABody designates a key as CA. Without certificate the CA is a root with a self-signed
+// certificate of subject; with the PEM certificate of the key issued by another CA it is an
+// intermediate, chain defaults to the chain of the local CA that issued it.
+type CreateCABody struct {
+	Name        string     `json:"name"`
+	KeyId       string     `json:"key_id"`
+	Subject     CSRSubject `json:"subject"`
+	Validity    string     `json:"validity"`
+	MaxPathLen  *int       `json:"max_path_len"`
+	Certificate string     `json:"certificate"`
+	Chain       string     `json:"chain"`
+}
+
+// IssueCertificateBody asks a CA for a certificate of a PEM CSR, validity may be shorter than the one of the profile
+type IssueCertificateBody struct {
+	CSR      string `json:"csr"`
+	Profile  string `json:"profile"`
+	Validity string `json:"validity"`
+}
+
+var (
+	errCANotFound          = errors.New("certificate authority not found")
+	errCAExists            = errors.New("certificate authority already exists")
+	errCertificateNotFound = errors.New("certificate not found")
+)
+
+// abortWithCAError ends a CA request
+func abortWithCAError(ctx *gin.Context, err error) {
+	log.WithError(err).WithField("ca", ctx.Param("name")).Error("CA request failed")
+	switch {
+	case errors.Is(err, errCANotFound), errors.Is(err, errCertificateNotFound), errors.Is(err, errKeyNotFound):
+		ctx.AbortWithError(404, err)
+	case errors.Is(err, errCAExists), errors.Is(err, errCertificateRevoked):
+		ctx.AbortWithError(409, err)
+	default:
+		ctx.AbortWithError(400, err)
+	}
+}
+
+// designate a key as certificate authority
+func createCA(ctx *gin.Context) {
+	requestBody := CreateCABody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	db := getGlobal().db
+	if !aliasPattern.MatchString(requestBody.Name) {
+		abortWithCAError(ctx, fmt.Errorf("invalid CA name %q, use 1 to 64 letters, digits, '.', '_' or '-'", requestBody.Name))
+		return
+	}
+	var count int64
+	if err := db.Model(&CertificateAuthority{}).Where("name = ?", requestBody.Name).Count(&count).Error; err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	if count > 0 {
+		abortWithCAError(ctx, fmt.Errorf("%w: %s", errCAExists, requestBody.Name))
+		return
+	}
+	keystore, err := getKeyAt(requestBody.KeyId, "")
+	if err == nil {
+		err = checkX509Key(keystore)
+	}
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	signer, err := x509Signer(keystore)
+	if err != nil {
+		log.WithError(err).Error("failed to decrypt private key")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ca := &CertificateAuthority{Name: requestBody.Name, KeyUuid: keystore.Uuid}
+	var cert *x509.Certificate
+	if requestBody.Certificate == "" {
+		cert, err = createRootCertificate(&requestBody, signer)
+	} else {
+		cert, ca.Chain, err = checkCACertificate(db, &requestBody, signer)
+	}
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	ca.Certificate = encodeCertificate(cert)
+	if err := db.Create(ca).Error; err != nil {
+		// lost a race with another request creating the same CA
+		abortWithCAError(ctx, fmt.Errorf("%w: %s", errCAExists, err))
+		return
+	}
+	log.WithField("ca", ca.Name).WithField("key_uuid", ca.KeyUuid).WithField("subject", cert.Subject.String()).Info("certificate authority created")
+	ctx.JSON(http.StatusOK, caInfo(ca, cert))
+}
+
+// createRootCertificate self-signs the certificate of a root CA
+func createRootCertificate(requestBody *CreateCABody, signer crypto.Signer) (*x509.Certificate, error) {
+	subject := requestBody.Subject.name()
+	if subject.CommonName == "" {
+		return nil, fmt.Errorf("subject.common_name is required by a root CA")
+	}
+	validity, err := parseValidity(requestBody.Validity, defaultRootValidity)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            -1,
+	}
+	if requestBody.MaxPathLen != nil {
+		template.MaxPathLen = *requestBody.MaxPathLen
+		template.MaxPathLenZero = *requestBody.MaxPathLen == 0
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// checkCACertificate checks that the certificate of an intermediate is a CA certificate of the key and returns its chain
+func checkCACertificate(db *gorm.DB, requestBody *CreateCABody, signer crypto.Signer) (*x509.Certificate, string, error) {
+	certs, err := parseCertificates(requestBody.Certificate)
+	if err != nil || len(certs) != 1 {
+		return nil, "", fmt.Errorf("certificate must be one PEM certificate")
+	}
+	cert := certs[0]
+	if !cert.BasicConstraintsValid || !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, "", fmt.Errorf("certificate is not a CA certificate with the cert_sign key usage")
+	}
+	if publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(cert.PublicKey) {
+		return nil, "", fmt.Errorf("certificate is not a certificate of key %s", requestBody.KeyId)
+	}
+	if requestBody.Chain != "" {
+		chain, err := parseCertificates(requestBody.Chain)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid chain: %s", err)
+		}
+		if err := cert.CheckSignatureFrom(chain[0]); err != nil {
+			return nil, "", fmt.Errorf("certificate is not issued by the first certificate of the chain: %s", err)
+		}
+		return cert, requestBody.Chain, nil
+	}
+	// the chain of a certificate issued by a local CA is known
+	cas := []CertificateAuthority{}
+	if err := db.Find(&cas).Error; err != nil {
+		return nil, "", err
+	}
+	for i := range cas {
+		issuer, err := parseCertificates(cas[i].Certificate)
+		if err == nil && bytes.Equal(cert.RawIssuer, issuer[0].RawSubject) && cert.CheckSignatureFrom(issuer[0]) == nil {
+			return cert, cas[i].Certificate + cas[i].Chain, nil
+		}
+	}
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return cert, "", nil
+	}
+	return nil, "", fmt.Errorf("the issuer of the certificate is not a local CA, chain is required")
+}
+
+// issue a certificate from a CSR with a profile
+func issueCertificate(ctx *gin.Context) {
+	requestBody := IssueCertificateBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	profiles, err := caProfiles()
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	profile, ok := profiles[requestBody.Profile]
+	if !ok {
+		abortWithCAError(ctx, fmt.Errorf("unknown profile %q", requestBody.Profile))
+		return
+	}
+	validity, err := parseValidity(requestBody.Validity, profile.Validity)
+	if err == nil && validity > profile.Validity {
+		err = fmt.Errorf("validity is longer than the %s of the %s profile", profile.Validity, requestBody.Profile)
+	}
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	csr, err := parseCSR(requestBody.CSR)
+	if err == nil {
+		err = profile.checkNames(csr)
+	}
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	ca, caCert, err := loadCA(getGlobal().db, ctx.Param("name"))
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	signer, ok := caSigner(ctx, ca)
+	if !ok {
+		return
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      now.Add(-time.Minute),
+		NotAfter:       now.Add(validity),
+	}
+	// certificates do not outlive their CA
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+	profile.apply(template)
+	if profile.IsCA {
+		if caCert.MaxPathLenZero {
+			abortWithCAError(ctx, fmt.Errorf("CA %s can only issue leaf certificates", ca.Name))
+			return
+		}
+		if caCert.MaxPathLen > 0 && (template.MaxPathLen < 0 || template.MaxPathLen >= caCert.MaxPathLen) {
+			template.MaxPathLen = caCert.MaxPathLen - 1
+			template.MaxPathLenZero = template.MaxPathLen == 0
+		}
+	}
+	if base := getGlobal().cfg.CABaseURL; base != "" {
+		caURL := strings.TrimRight(base, "/") + "/v1/grep11/cas/" + ca.Name
+		template.CRLDistributionPoints = []string{caURL + "/crl"}
+		template.OCSPServer = []string{caURL + "/ocsp"}
+		template.IssuingCertificateURL = []string{caURL + "/certificate"}
+	}
+	log.WithField("ca", ca.Name).WithField("profile", requestBody.Profile).WithField("subject", csr.Subject.String()).Info("start issue certificate")
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, signer)
+	if err != nil {
+		log.WithError(err).Error("failed to issue certificate")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	issued := &IssuedCertificate{
+		CAName:      ca.Name,
+		Serial:      serial.Text(16),
+		Profile:     requestBody.Profile,
+		Subject:     cert.Subject.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Certificate: encodeCertificate(cert),
+	}
+	// a certificate is only returned once its serial is recorded
+	if err := getGlobal().db.Create(issued).Error; err != nil {
+		log.WithError(err).Error("failed to record certificate")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	log.WithField("ca", ca.Name).WithField("serial", issued.Serial).Info("certificate issued")
+	ctx.JSON(http.StatusOK, gin.H{
+		"ca":          ca.Name,
+		"serial":      issued.Serial,
+		"profile":     issued.Profile,
+		"not_after":   issued.NotAfter,
+		"certificate": issued.Certificate,
+		"chain":       ca.Certificate + ca.Chain,
+	})
+}
+
+// list the certificate authorities
+func listCAs(ctx *gin.Context) {
+	cas := []CertificateAuthority{}
+	if err := getGlobal().db.Order("name").Find(&cas).Error; err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	result := make([]gin.H, 0, len(cas))
+	for i := range cas {
+		certs, err := parseCertificates(cas[i].Certificate)
+		if err != nil {
+			ctx.AbortWithError(500, err)
+			return
+		}
+		result = append(result, caInfo(&cas[i], certs[0]))
+	}
+	ctx.JSON(http.StatusOK, gin.H{"cas": result})
+}
+
+// get a certificate authority
+func getCA(ctx *gin.Context) {
+	ca, cert, err := loadCA(getGlobal().db, ctx.Param("name"))
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, caInfo(ca, cert))
+}
+
+// download the DER certificate of a CA, the issuing certificate URL of the certificates it issues
+func getCACertificate(ctx *gin.Context) {
+	_, cert, err := loadCA(getGlobal().db, ctx.Param("name"))
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	ctx.Data(http.StatusOK, "application/pkix-cert", cert.Raw)
+}
+
+// list the certificates issued by a CA page by page, revoked=true or false only lists the revoked or not revoked ones
+func listIssuedCertificates(ctx *gin.Context) {
+	query := getGlobal().db.Where("ca_name = ?", ctx.Param("name")).Order("id")
+	switch ctx.Query("revoked") {
+	case "true":
+		query = query.Where("revoked_at IS NOT NULL")
+	case "false":
+		query = query.Where("revoked_at IS NULL")
+	}
+	limit := defaultKeyPageSize
+	if value := ctx.Query("limit"); value != "" {
+		if _, err := fmt.Sscanf(value, "%d", &limit); err != nil || limit <= 0 || limit > maxKeyPageSize {
+			ctx.AbortWithError(400, fmt.Errorf("limit must be between 1 and %d", maxKeyPageSize))
+			return
+		}
+	}
+	if cursor := ctx.Query("cursor"); cursor != "" {
+		id, err := decodeKeyCursor(cursor)
+		if err != nil {
+			ctx.AbortWithError(400, err)
+			return
+		}
+		query = query.Where("id > ?", id)
+	}
+	certs := []IssuedCertificate{}
+	// fetch one more certificate to know if there is a next page
+	if err := query.Limit(limit + 1).Find(&certs).Error; err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	nextCursor := ""
+	if len(certs) > limit {
+		certs = certs[:limit]
+		nextCursor = encodeKeyCursor(certs[len(certs)-1].ID)
+	}
+	result := make([]gin.H, 0, len(certs))
+	for i := range certs {
+		result = append(result, issuedInfo(&certs[i], false))
+	}
+	ctx.JSON(http.StatusOK, gin.H{"certificates": result, "next_cursor": nextCursor})
+}
+
+// get a certificate issued by a CA by serial
+func getIssuedCertificate(ctx *gin.Context) {
+	issued, err := findIssuedCertificate(getGlobal().db, ctx.Param("name"), ctx.Param("serial"))
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, issuedInfo(issued, true))
+}
+
+// loadCA finds a CA by name with its certificate
+func loadCA(db *gorm.DB, name string) (*CertificateAuthority, *x509.Certificate, error) {
+	ca := &CertificateAuthority{}
+	if err := db.First(ca, "name = ?", name).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, fmt.Errorf("%w: %s", errCANotFound, name)
+		}
+		return nil, nil, err
+	}
+	certs, err := parseCertificates(ca.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, certs[0], nil
+}
+
+// caSigner returns the signer of the key of a CA, it aborts the request if the key can not sign
+func caSigner(ctx *gin.Context, ca *CertificateAuthority) (crypto.Signer, bool) {
+	keystore, err := caKey(ca)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return nil, false
+	}
+	signer, err := x509Signer(keystore)
+	if err != nil {
+		log.WithError(err).Error("failed to decrypt private key")
+		ctx.AbortWithError(500, err)
+		return nil, false
+	}
+	return signer, true
+}
+
+// caKey returns the key of a CA if it can sign certificates
+func caKey(ca *CertificateAuthority) (*KeyStore, error) {
+	keystore, err := getKeyAt(ca.KeyUuid, "")
+	if err != nil {
+		return nil, err
+	}
+	return keystore, checkX509Key(keystore)
+}
+
+// findIssuedCertificate finds a certificate of a CA by serial, in hex with or without colons
+func findIssuedCertificate(db *gorm.DB, caName, serial string) (*IssuedCertificate, error) {
+	number, ok := new(big.Int).SetString(strings.ReplaceAll(serial, ":", ""), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial %q, expect hex", serial)
+	}
+	issued := &IssuedCertificate{}
+	if err := db.First(issued, "ca_name = ? AND serial = ?", caName, number.Text(16)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: %s", errCertificateNotFound, serial)
+		}
+		return nil, err
+	}
+	return issued, nil
+}
+
+func caInfo(ca *CertificateAuthority, cert *x509.Certificate) gin.H {
+	return gin.H{
+		"name":         ca.Name,
+		"key_uuid":     ca.KeyUuid,
+		"subject":      cert.Subject.String(),
+		"root":         ca.Chain == "",
+		"max_path_len": cert.MaxPathLen,
+		"not_before":   cert.NotBefore,
+		"not_after":    cert.NotAfter,
+		"crl_number":   ca.CRLNumber,
+		"certificate":  ca.Certificate,
+		"chain":        ca.Chain,
+	}
+}
+
+func issuedInfo(issued *IssuedCertificate, withPEM bool) gin.H {
+	info := gin.H{
+		"ca":         issued.CAName,
+		"serial":     issued.Serial,
+		"profile":    issued.Profile,
+		"subject":    issued.Subject,
+		"not_before": issued.NotBefore,
+		"not_after":  issued.NotAfter,
+		"revoked":    issued.RevokedAt != nil,
+	}
+	if issued.RevokedAt != nil {
+		info["revoked_at"] = issued.RevokedAt
+		info["revocation_reason"] = issued.RevocationReason
+	}
+	if withPEM {
+		info["certificate"] = issued.Certificate
+	}
+	return info
+}
+
+// newSerialNumber returns a random positive serial of 127 bits, RFC 5280 allows at most 20 bytes
+func newSerialNumber() (*big.Int, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	b[0] &= 0x7f
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parseValidity parses a duration like 720h, empty is the default
+func parseValidity(value string, defaultValidity time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValidity, nil
+	}
+	validity, err := time.ParseDuration(value)
+	if err != nil || validity <= 0 {
+		return 0, fmt.Errorf("invalid validity %q, expect a positive duration like 720h", value)
+	}
+	return validity, nil
+}
+
+// parseCSR decodes a PEM CSR and checks its signature
+func parseCSR(data string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("csr must be a PEM CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid csr: %s", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid csr signature: %s", err)
+	}
+	return csr, nil
+}
+
+// parseCertificates decodes PEM certificates
+func parseCertificates(data string) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return certs, nil
+}
+
+func encodeCertificate(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func pemCert(t *testing.T, s string) *x509.Certificate {
+	t.Helper()
+	certs, err := parseCertificates(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs[0]
+}
+
+// localCSR returns a PEM CSR of a local key
+func localCSR(t *testing.T, tmpl *x509.CertificateRequest) string {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+// a root and an intermediate CA issue certificates, revoke one and publish the CRLs and OCSP responses
+func TestCA(t *testing.T) {
+	r := testRouter()
+
+	all, err := caProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restricted := &CertificateProfile{Validity: time.Hour, KeyUsage: []string{"digital_signature"}, ExtKeyUsage: []string{"server_auth"},
+		NameConstraints: NameConstraints{PermittedDNSDomains: []string{"svc.internal"}, ExcludedDNSDomains: []string{"bad.svc.internal"}, PermittedIPRanges: []string{"10.0.0.0/8"}}}
+	if err := restricted.compile(); err != nil {
+		t.Fatal(err)
+	}
+	all["restricted"] = restricted
+	if c, m := doJSON(t, r, "GET", "/v1/grep11/ca/profiles", nil); c != 200 || len(m["profiles"].([]interface{})) != 5 {
+		t.Fatal(c, m)
+	}
+
+	// root
+	c, m := doJSON(t, r, "POST", "/v1/grep11/key/ec/generate_key_pair", `{"curve":"P-256"}`)
+	if c != 200 {
+		t.Fatal(c, m)
+	}
+	rootKey := m["uuid"].(string)
+	if c, m := doJSON(t, r, "POST", "/v1/grep11/cas", `{"name":"root","key_id":"`+rootKey+`"}`); c != 400 {
+		t.Fatal(c, m)
+	}
+	c, m = doJSON(t, r, "POST", "/v1/grep11/cas", `{"name":"root","key_id":"`+rootKey+`","subject":{"common_name":"Test Root"},"max_path_len":1}`)
+	if c != 200 || m["root"] != true {
+		t.Fatal(c, m)
+	}
+	root := pemCert(t, m["certificate"].(string))
+	if root.Subject.CommonName != "Test Root" || !root.IsCA || root.CheckSignatureFrom(root) != nil || root.MaxPathLen != 1 {
+		t.Fatal(root.Subject, root.MaxPathLen)
+	}
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas", `{"name":"root","key_id":"`+rootKey+`","subject":{"common_name":"x"}}`); c != 409 {
+		t.Fatal(c)
+	}
+	_, m = doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/generate_key_pair", "")
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas", `{"name":"k1","key_id":"`+m["uuid"].(string)+`","subject":{"common_name":"x"}}`); c != 400 {
+		t.Fatal(c)
+	}
+
+	// intermediate from a CSR of an RSA key
+	_, m = doJSON(t, r, "POST", "/v1/grep11/key/rsa/generate_key_pair", "")
+	interKey := m["uuid"].(string)
+	c, m = doJSON(t, r, "POST", "/v1/grep11/keys/"+interKey+"/csr", `{"subject":{"common_name":"Test Intermediate"}}`)
+	if c != 200 {
+		t.Fatal(c, m)
+	}
+	c, m = doJSON(t, r, "POST", "/v1/grep11/cas/root/issue", map[string]string{"csr": m["csr"].(string), "profile": "intermediate"})
+	if c != 200 {
+		t.Fatal(c, m)
+	}
+	interPEM := m["certificate"].(string)
+	inter := pemCert(t, interPEM)
+	if !inter.IsCA || inter.MaxPathLen != 0 || !inter.MaxPathLenZero || inter.KeyUsage&x509.KeyUsageCertSign == 0 || inter.CheckSignatureFrom(root) != nil {
+		t.Fatal(inter.MaxPathLen, inter.KeyUsage)
+	}
+	// certificate of another key
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas", map[string]string{"name": "inter", "key_id": rootKey, "certificate": interPEM}); c != 400 {
+		t.Fatal(c)
+	}
+	c, m = doJSON(t, r, "POST", "/v1/grep11/cas", map[string]string{"name": "inter", "key_id": interKey, "certificate": interPEM})
+	if c != 200 || m["chain"] != encodeCertificate(root) || m["root"] != false {
+		t.Fatal(c, m)
+	}
+	// inter can only issue leaves
+	_, m = doJSON(t, r, "POST", "/v1/grep11/key/ec/generate_key_pair", `{"curve":"P-384"}`)
+	_, m = doJSON(t, r, "POST", "/v1/grep11/keys/"+m["uuid"].(string)+"/csr", `{"subject":{"common_name":"sub"}}`)
+	if c, mm := doJSON(t, r, "POST", "/v1/grep11/cas/inter/issue", map[string]string{"csr": m["csr"].(string), "profile": "intermediate"}); c != 400 {
+		t.Fatal(c, mm)
+	}
+
+	// leaf
+	leafCSR := localCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "api.svc.internal"}, DNSNames: []string{"api.svc.internal"}})
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas/inter/issue", map[string]string{"csr": leafCSR, "profile": "server", "validity": "100000h"}); c != 400 {
+		t.Fatal(c)
+	}
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas/inter/issue", map[string]string{"csr": leafCSR, "profile": "nope"}); c != 400 {
+		t.Fatal(c)
+	}
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas/nope/issue", map[string]string{"csr": leafCSR, "profile": "server"}); c != 404 {
+		t.Fatal(c)
+	}
+	c, m = doJSON(t, r, "POST", "/v1/grep11/cas/inter/issue", map[string]string{"csr": leafCSR, "profile": "restricted", "validity": "30m"})
+	if c != 200 {
+		t.Fatal(c, m)
+	}
+	leaf := pemCert(t, m["certificate"].(string))
+	if m["chain"] != interPEM+encodeCertificate(root) {
+		t.Fatal(m["chain"])
+	}
+	roots, inters := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(root)
+	inters.AddCert(inter)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: inters, DNSName: "api.svc.internal"}); err != nil {
+		t.Fatal(err)
+	}
+	if leaf.NotAfter.Sub(leaf.NotBefore) > 32*time.Minute || leaf.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Fatal(leaf.NotAfter)
+	}
+	for _, tmpl := range []*x509.CertificateRequest{
+		{DNSNames: []string{"api.other"}},
+		{DNSNames: []string{"x.bad.svc.internal"}},
+		{DNSNames: []string{"ok.svc.internal"}, IPAddresses: []net.IP{{192, 168, 0, 1}}},
+		{Subject: pkix.Name{CommonName: "api.other"}, DNSNames: []string{"ok.svc.internal"}},
+		{Subject: pkix.Name{CommonName: "x.bad.svc.internal"}},
+	} {
+		if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas/inter/issue", map[string]string{"csr": localCSR(t, tmpl), "profile": "restricted"}); c != 400 {
+			t.Fatal(tmpl, c)
+		}
+	}
+	c, m = doJSON(t, r, "POST", "/v1/grep11/cas/inter/issue", map[string]string{"csr": localCSR(t, &x509.CertificateRequest{DNSNames: []string{"good.svc.internal"}}), "profile": "mtls"})
+	if c != 200 {
+		t.Fatal(c, m)
+	}
+	good := pemCert(t, m["certificate"].(string))
+	if len(good.ExtKeyUsage) != 2 {
+		t.Fatal(good.ExtKeyUsage)
+	}
+
+	// revoke
+	serial := leaf.SerialNumber.Text(16)
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas/inter/certificates/"+serial+"/revoke", `{"reason":7}`); c != 400 {
+		t.Fatal(c)
+	}
+	if c, m := doJSON(t, r, "POST", "/v1/grep11/cas/inter/certificates/"+serial+"/revoke", `{"reason":1}`); c != 200 || m["revoked"] != true {
+		t.Fatal(c, m)
+	}
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas/inter/certificates/"+serial+"/revoke", `{"reason":1}`); c != 409 {
+		t.Fatal(c)
+	}
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas/root/certificates/"+serial+"/revoke", `{}`); c != 404 {
+		t.Fatal(c)
+	}
+	if c, m := doJSON(t, r, "GET", "/v1/grep11/cas/inter/certificates?revoked=true", nil); c != 200 || len(m["certificates"].([]interface{})) != 1 {
+		t.Fatal(c, m)
+	}
+	if c, m := doJSON(t, r, "GET", "/v1/grep11/cas/inter/certificates?limit=1", nil); c != 200 || len(m["certificates"].([]interface{})) != 1 || m["next_cursor"] == "" {
+		t.Fatal(c, m)
+	} else if c, m := doJSON(t, r, "GET", "/v1/grep11/cas/inter/certificates?limit=1&cursor="+m["next_cursor"].(string), nil); c != 200 || m["certificates"].([]interface{})[0].(map[string]interface{})["serial"] != good.SerialNumber.Text(16) {
+		t.Fatal(c, m)
+	}
+	if c, m := doJSON(t, r, "GET", "/v1/grep11/cas/inter/certificates/"+serial, nil); c != 200 || m["revocation_reason"] != float64(1) || m["certificate"] == nil {
+		t.Fatal(c, m)
+	}
+	if c, m := doJSON(t, r, "GET", "/v1/grep11/cas", nil); c != 200 || len(m["cas"].([]interface{})) != 2 {
+		t.Fatal(c, m)
+	}
+	if c, b := doRaw(r, "GET", "/v1/grep11/cas/inter/certificate", nil); c != 200 || !bytes.Equal(b, inter.Raw) {
+		t.Fatal(c)
+	}
+
+	// CRL, signed by the revocation and served as stored
+	getCRL := func() *x509.RevocationList {
+		c, b := doRaw(r, "GET", "/v1/grep11/cas/inter/crl", nil)
+		if c != 200 {
+			t.Fatal(c, string(b))
+		}
+		crl, err := x509.ParseRevocationList(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crl.CheckSignatureFrom(inter); err != nil {
+			t.Fatal(err)
+		}
+		return crl
+	}
+	for i := 0; i < 2; i++ {
+		crl := getCRL()
+		if crl.Number.Int64() != 1 || len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 || crl.RevokedCertificateEntries[0].ReasonCode != 1 {
+			t.Fatal(crl.Number, crl.RevokedCertificateEntries)
+		}
+	}
+	c, b := doRaw(r, "GET", "/v1/grep11/cas/root/crl?format=pem", nil)
+	if block, _ := pem.Decode(b); c != 200 || block == nil || block.Type != "X509 CRL" {
+		t.Fatal(c, string(b))
+	} else if crl, err := x509.ParseRevocationList(block.Bytes); err != nil || crl.CheckSignatureFrom(root) != nil || len(crl.RevokedCertificateEntries) != 0 {
+		t.Fatal(err)
+	}
+
+	// OCSP
+	check := func(cert *x509.Certificate, issuer *x509.Certificate, get bool) *ocsp.Response {
+		req, err := ocsp.CreateRequest(cert, issuer, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c int
+		var b []byte
+		if get {
+			c, b = doRaw(r, "GET", "/v1/grep11/cas/inter/ocsp/"+base64.StdEncoding.EncodeToString(req), nil)
+		} else {
+			c, b = doRaw(r, "POST", "/v1/grep11/cas/inter/ocsp", req)
+		}
+		if c != 200 {
+			t.Fatal(c)
+		}
+		resp, err := ocsp.ParseResponseForCert(b, cert, inter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := check(leaf, inter, false); resp.Status != ocsp.Revoked || resp.RevocationReason != 1 {
+		t.Fatal(resp.Status)
+	}
+	if resp := check(good, inter, true); resp.Status != ocsp.Good {
+		t.Fatal(resp.Status)
+	}
+	// responses are stored until they near their next update, a revocation replaces them
+	first := check(good, inter, false)
+	if again := check(good, inter, true); !bytes.Equal(again.Signature, first.Signature) {
+		t.Fatal("OCSP response signed again")
+	}
+	if c, _ := doJSON(t, r, "POST", "/v1/grep11/cas/inter/certificates/"+good.SerialNumber.Text(16)+"/revoke", `{"reason":4}`); c != 200 {
+		t.Fatal(c)
+	}
+	if resp := check(good, inter, false); resp.Status != ocsp.Revoked || resp.RevocationReason != 4 {
+		t.Fatal(resp.Status)
+	}
+	if crl := getCRL(); crl.Number.Int64() != 2 || len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatal(crl.Number, crl.RevokedCertificateEntries)
+	}
+	// serials the CA never issued are not signed for
+	stranger := *good
+	stranger.SerialNumber = new(big.Int).Add(leaf.SerialNumber, good.SerialNumber)
+	req, _ := ocsp.CreateRequest(&stranger, inter, nil)
+	_, b = doRaw(r, "POST", "/v1/grep11/cas/inter/ocsp", req)
+	if _, err := ocsp.ParseResponse(b, nil); err == nil || err.(ocsp.ResponseError).Status != ocsp.Unauthorized {
+		t.Fatal(err)
+	}
+	req, _ = ocsp.CreateRequest(good, root, nil)
+	_, b = doRaw(r, "POST", "/v1/grep11/cas/inter/ocsp", req)
+	if _, err := ocsp.ParseResponse(b, nil); err == nil || err.(ocsp.ResponseError).Status != ocsp.Unauthorized {
+		t.Fatal(err)
+	}
+	_, b = doRaw(r, "POST", "/v1/grep11/cas/inter/ocsp", []byte("junk"))
+	if _, err := ocsp.ParseResponse(b, nil); err == nil || err.(ocsp.ResponseError).Status != ocsp.Malformed {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+	"signing_server/util"
+)
+
+// CertificateProfile is what the certificates issued with a profile contain and the names they may have
+type CertificateProfile struct {
+	// maximum validity, an issue request may ask for less
+	Validity    time.Duration `yaml:"validity"`
+	KeyUsage    []string      `yaml:"key_usage"`
+	ExtKeyUsage []string      `yaml:"ext_key_usage"`
+	// CA profiles issue intermediate CAs, a max_path_len of -1 leaves their path length unlimited
+	IsCA            bool            `yaml:"is_ca"`
+	MaxPathLen      int             `yaml:"max_path_len"`
+	NameConstraints NameConstraints `yaml:"name_constraints"`
+
+	keyUsage    x509.KeyUsage
+	extKeyUsage []x509.ExtKeyUsage
+	permittedIP []*net.IPNet
+	excludedIP  []*net.IPNet
+}
+
+// NameConstraints limit the names certificates are issued for, CA profiles also write them in the certificate.
+// Domains match themselves and their subdomains, or only the subdomains when they start with a dot.
+// Email constraints are an address or a domain, IP ranges are CIDRs.
+type NameConstraints struct {
+	PermittedDNSDomains     []string `yaml:"permitted_dns_domains" json:"permitted_dns_domains,omitempty"`
+	ExcludedDNSDomains      []string `yaml:"excluded_dns_domains" json:"excluded_dns_domains,omitempty"`
+	PermittedIPRanges       []string `yaml:"permitted_ip_ranges" json:"permitted_ip_ranges,omitempty"`
+	ExcludedIPRanges        []string `yaml:"excluded_ip_ranges" json:"excluded_ip_ranges,omitempty"`
+	PermittedEmailAddresses []string `yaml:"permitted_email_addresses" json:"permitted_email_addresses,omitempty"`
+	ExcludedEmailAddresses  []string `yaml:"excluded_email_addresses" json:"excluded_email_addresses,omitempty"`
+	PermittedURIDomains     []string `yaml:"permitted_uri_domains" json:"permitted_uri_domains,omitempty"`
+	ExcludedURIDomains      []string `yaml:"excluded_uri_domains" json:"excluded_uri_domains,omitempty"`
+}
+
+// defaultCAProfiles are the profiles available without a profile file
+func defaultCAProfiles() map[string]*CertificateProfile {
+	return map[string]*CertificateProfile{
+		"server": {Validity: 90 * 24 * time.Hour, KeyUsage: []string{"digital_signature"}, ExtKeyUsage: []string{"server_auth"}},
+		"client": {Validity: 90 * 24 * time.Hour, KeyUsage: []string{"digital_signature"}, ExtKeyUsage: []string{"client_auth"}},
+		"mtls":   {Validity: 90 * 24 * time.Hour, KeyUsage: []string{"digital_signature"}, ExtKeyUsage: []string{"server_auth", "client_auth"}},
+		"intermediate": {
+			Validity: 5 * 365 * 24 * time.Hour,
+			KeyUsage: []string{"digital_signature", "cert_sign", "crl_sign"},
+			IsCA:     true,
+		},
+	}
+}
+
+var (
+	profilesOnce sync.Once
+	profiles     map[string]*CertificateProfile
+	profilesErr  error
+)
+
+// caProfiles returns the issuance profiles, the profiles of the CA_PROFILES file replace the default ones of the same name
+func caProfiles() (map[string]*CertificateProfile, error) {
+	profilesOnce.Do(func() {
+		profiles, profilesErr = loadCAProfiles(getGlobal().cfg.CAProfiles)
+	})
+	return profiles, profilesErr
+}
+
+func loadCAProfiles(path string) (map[string]*CertificateProfile, error) {
+	result := defaultCAProfiles()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		custom := map[string]*CertificateProfile{}
+		if err := yaml.UnmarshalStrict(data, &custom); err != nil {
+			return nil, fmt.Errorf("invalid CA profiles %s: %s", path, err)
+		}
+		for name, profile := range custom {
+			result[name] = profile
+		}
+	}
+	for name, profile := range result {
+		if err := profile.compile(); err != nil {
+			return nil, fmt.Errorf("invalid CA profile %s: %s", name, err)
+		}
+	}
+	return result, nil
+}
+
+// compile checks the profile and parses its usages and IP ranges
+func (p *CertificateProfile) compile() error {
+	if p.Validity <= 0 {
+		return fmt.Errorf("validity must be positive")
+	}
+	if p.MaxPathLen < -1 || (p.MaxPathLen != 0 && !p.IsCA) {
+		return fmt.Errorf("max_path_len must be -1 or more, and only applies to CA profiles")
+	}
+	var err error
+	if p.keyUsage, err = util.ParseKeyUsages(p.KeyUsage); err != nil {
+		return err
+	}
+	if p.IsCA && p.keyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("CA profiles need the cert_sign key usage")
+	}
+	if p.extKeyUsage, err = util.ParseExtKeyUsages(p.ExtKeyUsage); err != nil {
+		return err
+	}
+	for _, ranges := range []struct {
+		cidrs []string
+		nets  *[]*net.IPNet
+	}{{p.NameConstraints.PermittedIPRanges, &p.permittedIP}, {p.NameConstraints.ExcludedIPRanges, &p.excludedIP}} {
+		for _, cidr := range ranges.cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid IP range %q", cidr)
+			}
+			*ranges.nets = append(*ranges.nets, ipNet)
+		}
+	}
+	return nil
+}
+
+// checkNames checks the names of a certificate request against the name constraints of the profile
+func (p *CertificateProfile) checkNames(csr *x509.CertificateRequest) error {
+	c := &p.NameConstraints
+	// clients still match host names with the common name, it must meet the DNS constraints like the DNS names
+	if cn := csr.Subject.CommonName; cn != "" && (len(c.PermittedDNSDomains) > 0 || len(c.ExcludedDNSDomains) > 0) {
+		if err := checkName("common name", cn, c.PermittedDNSDomains, c.ExcludedDNSDomains, matchDomain); err != nil {
+			return err
+		}
+	}
+	for _, name := range csr.DNSNames {
+		if err := checkName("DNS name", name, c.PermittedDNSDomains, c.ExcludedDNSDomains, matchDomain); err != nil {
+			return err
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		if err := checkName("email address", email, c.PermittedEmailAddresses, c.ExcludedEmailAddresses, matchEmail); err != nil {
+			return err
+		}
+	}
+	for _, uri := range csr.URIs {
+		if err := checkName("URI", uri.String(), c.PermittedURIDomains, c.ExcludedURIDomains, matchURIDomain); err != nil {
+			return err
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if len(p.permittedIP) > 0 && !ipInRanges(ip, p.permittedIP) {
+			return fmt.Errorf("IP address %s is not permitted by the profile", ip)
+		}
+		if ipInRanges(ip, p.excludedIP) {
+			return fmt.Errorf("IP address %s is excluded by the profile", ip)
+		}
+	}
+	return nil
+}
+
+func checkName(kind, name string, permitted, excluded []string, match func(name, constraint string) bool) error {
+	if len(permitted) > 0 {
+		ok := false
+		for _, constraint := range permitted {
+			ok = ok || match(name, constraint)
+		}
+		if !ok {
+			return fmt.Errorf("%s %s is not permitted by the profile", kind, name)
+		}
+	}
+	for _, constraint := range excluded {
+		if match(name, constraint) {
+			return fmt.Errorf("%s %s is excluded by the profile", kind, name)
+		}
+	}
+	return nil
+}
+
+// matchDomain tells if a name is the domain or one of its subdomains, only the subdomains if the domain starts with a dot
+func matchDomain(name, domain string) bool {
+	name, domain = strings.ToLower(strings.TrimSuffix(name, ".")), strings.ToLower(domain)
+	if strings.HasPrefix(domain, ".") {
+		return strings.HasSuffix(name, domain)
+	}
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// matchEmail matches an address with an address constraint, or its domain with a domain constraint
+func matchEmail(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return strings.EqualFold(email, constraint)
+	}
+	at := strings.LastIndex(email, "@")
+	return at >= 0 && matchDomain(email[at+1:], constraint)
+}
+
+func matchURIDomain(uri, domain string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.Hostname() != "" && matchDomain(u.Hostname(), domain)
+}
+
+func ipInRanges(ip net.IP, ranges []*net.IPNet) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the usages, basic constraints and name constraints of the profile in a certificate template
+func (p *CertificateProfile) apply(template *x509.Certificate) {
+	template.KeyUsage = p.keyUsage
+	template.ExtKeyUsage = p.extKeyUsage
+	template.BasicConstraintsValid = true
+	template.IsCA = p.IsCA
+	if !p.IsCA {
+		return
+	}
+	template.MaxPathLen = p.MaxPathLen
+	template.MaxPathLenZero = p.MaxPathLen == 0
+	c := &p.NameConstraints
+	template.PermittedDNSDomains = c.PermittedDNSDomains
+	template.ExcludedDNSDomains = c.ExcludedDNSDomains
+	template.PermittedIPRanges = p.permittedIP
+	template.ExcludedIPRanges = p.excludedIP
+	template.PermittedEmailAddresses = c.PermittedEmailAddresses
+	template.ExcludedEmailAddresses = c.ExcludedEmailAddresses
+	template.PermittedURIDomains = c.PermittedURIDomains
+	template.ExcludedURIDomains = c.ExcludedURIDomains
+}
+
+// list the issuance profiles
+func listCAProfiles(ctx *gin.Context) {
+	all, err := caProfiles()
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		p := all[name]
+		result = append(result, gin.H{
+			"name":             name,
+			"validity":         p.Validity.String(),
+			"key_usage":        p.KeyUsage,
+			"ext_key_usage":    p.ExtKeyUsage,
+			"is_ca":            p.IsCA,
+			"max_path_len":     p.MaxPathLen,
+			"name_constraints": p.NameConstraints,
+		})
+	}
+	ctx.JSON(http.StatusOK, gin.H{"profiles": result})
+}
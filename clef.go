@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	log "github.com/sirupsen/logrus"
+)
+
+// ClefExternalAPIVersion is the version of the clef external API implemented by clefAPI,
+// geth checks it through account_version when started with --signer
+const ClefExternalAPIVersion = "6.1.0"
+
+// clefAPI implements the "account" namespace of the go-ethereum Clef external signer API,
+// accounts are the secp256k1 keys in KeyStore, addressed by their ethereum address
+type clefAPI struct{}
+
+// clefSignTransactionResult mirrors ethapi.SignTransactionResult, the account_signTransaction result
+type clefSignTransactionResult struct {
+	Raw hexutil.Bytes      `json:"raw"`
+	Tx  *types.Transaction `json:"tx"`
+}
+
+// newClefServer returns the JSON-RPC server of the clef external API
+func newClefServer() *rpc.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("account", &clefAPI{}); err != nil {
+		log.Fatal(fmt.Sprintf("err: %v", err))
+	}
+	return server
+}
+
+// clefKey finds the key of an account
+func clefKey(address common.MixedcaseAddress) (*KeyStore, error) {
+	keystore := getKeyByAddress(getGlobal().db, address.Address())
+	if keystore == nil {
+		return nil, fmt.Errorf("unknown account %s", address.Address().Hex())
+	}
+	if err := keystore.allows(KeyUsageSign); err != nil {
+		return nil, err
+	}
+	return keystore, nil
+}
+
+// Version returns the external API version
+func (api *clefAPI) Version(ctx context.Context) (string, error) {
+	return ClefExternalAPIVersion, nil
+}
+
+// List returns the addresses of all secp256k1 keys
+func (api *clefAPI) List(ctx context.Context) ([]common.Address, error) {
+	return listEthereumAddresses(getGlobal().db)
+}
+
+// SignTransaction signs a transaction of one of the accounts, the chain id is required
+func (api *clefAPI) SignTransaction(ctx context.Context, args apitypes.SendTxArgs, methodSelector *string) (*clefSignTransactionResult, error) {
+	if args.ChainID == nil {
+		return nil, fmt.Errorf("chainId is required")
+	}
+	if args.Data != nil && args.Input != nil && !bytes.Equal(*args.Data, *args.Input) {
+		return nil, fmt.Errorf("data and input are not equal")
+	}
+	if args.MaxFeePerGas == nil && args.GasPrice == nil {
+		return nil, fmt.Errorf("gasPrice or maxFeePerGas is required")
+	}
+	if args.MaxFeePerGas != nil && args.MaxPriorityFeePerGas == nil {
+		return nil, fmt.Errorf("maxPriorityFeePerGas is required with maxFeePerGas")
+	}
+	keystore, err := clefKey(args.From)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("key_uuid", keystore.Uuid).WithField("tx", args.String()).Info("clef sign transaction")
+
+	signedTx, _, err := signEthereumTransaction(keystore, args.ToTransaction(), args.ChainID.ToInt())
+	if err != nil {
+		log.WithError(err).Error("failed to sign transaction")
+		return nil, err
+	}
+	rawTx, err := signedTx.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &clefSignTransactionResult{Raw: rawTx, Tx: signedTx}, nil
+}
+
+// SignData signs EIP-191 data, text/plain (personal_sign) and data/typed (EIP-712) are supported
+func (api *clefAPI) SignData(ctx context.Context, contentType string, addr common.MixedcaseAddress, data interface{}) (hexutil.Bytes, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	var hash []byte
+	switch mediaType {
+	case apitypes.TextPlain.Mime:
+		text, ok := data.(string)
+		if !ok {
+			return nil, fmt.Errorf("input for %s must be an hex-encoded string", apitypes.TextPlain.Mime)
+		}
+		message, err := hexutil.Decode(text)
+		if err != nil {
+			return nil, err
+		}
+		hash = accounts.TextHash(message)
+	case apitypes.DataTyped.Mime:
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		typedData := apitypes.TypedData{}
+		if err := json.Unmarshal(raw, &typedData); err != nil {
+			return nil, fmt.Errorf("invalid typed data: %s", err)
+		}
+		if hash, _, err = apitypes.TypedDataAndHash(typedData); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("content type %s is not supported", mediaType)
+	}
+	return api.signHash(addr, mediaType, hash)
+}
+
+// SignTypedData signs EIP-712 typed data
+func (api *clefAPI) SignTypedData(ctx context.Context, addr common.MixedcaseAddress, typedData apitypes.TypedData) (hexutil.Bytes, error) {
+	hash, _, err := apitypes.TypedDataAndHash(typedData)
+	if err != nil {
+		return nil, err
+	}
+	return api.signHash(addr, apitypes.DataTyped.Mime, hash)
+}
+
+// signHash signs a message hash, v of the signature is 27 or 28
+func (api *clefAPI) signHash(addr common.MixedcaseAddress, contentType string, hash []byte) (hexutil.Bytes, error) {
+	keystore, err := clefKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("key_uuid", keystore.Uuid).WithField("content_type", contentType).WithField("hash", hexutil.Encode(hash)).Info("clef sign data")
+
+	sig, _, err := signEthereumHash(keystore, hash)
+	if err != nil {
+		log.WithError(err).Error("failed to sign data")
+		return nil, err
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return sig, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// accounts are the active keys of an address, a destroyed key does not hide the same key imported again
+func TestClefKey(t *testing.T) {
+	r := testRouter()
+	privateKey := "0101010101010101010101010101010101010101010101010101010101010101"
+	first := importTestKey(t, privateKey)
+	address := common.NewMixedcaseAddress(common.HexToAddress(getKey(getGlobal().db, first).Address))
+	for _, action := range []string{"disable", "destroy"} {
+		if code, m := doJSON(t, r, "POST", "/v1/grep11/keys/"+first+"/"+action, nil); code != 200 {
+			t.Fatal(action, code, m)
+		}
+	}
+	if _, err := clefKey(address); err == nil {
+		t.Fatal("destroyed key found")
+	}
+	second := importTestKey(t, privateKey)
+	if key, err := clefKey(address); err != nil || key.Uuid != second {
+		t.Fatal(key, err)
+	}
+}
+
+// a BIP32 master key does not sign, it has no address and is not an account
+func TestClefBIP32Master(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/bip32/generate_master", nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	master := getKey(getGlobal().db, m["uuid"].(string))
+	if master.Address != "" {
+		t.Fatalf("master key has address %s", master.Address)
+	}
+	// the address its public key would have
+	address := common.HexToAddress(ethereumAddress(master.PublicKey))
+	accounts, err := (&clefAPI{}).List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, account := range accounts {
+		if account == address {
+			t.Fatal("master key listed as an account")
+		}
+	}
+	if _, err := clefKey(common.NewMixedcaseAddress(address)); err == nil {
+		t.Fatal("master key found by address")
+	}
+}
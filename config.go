@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/vrischmann/envconfig"
 	"gopkg.in/yaml.v2"
@@ -24,8 +25,44 @@ type Config struct {
 		InstanceId  string `yaml:"instance_id"`
 		IAMKey      string `yaml:"iam_key"`
 		IAMEndpoint string `yaml:"iam_endpoint"`
-	}
-	SecureEnclavePath string `yaml:"secure_enclave_path"` 
+		// number of long-lived GREP11 connections shared by all requests
+		PoolSize int `yaml:"pool_size" envconfig:"default=4"`
+		// interval of gRPC keepalive pings, gRPC servers reject pings more frequent than 5m by default
+		KeepaliveTime time.Duration `yaml:"keepalive_time" envconfig:"default=5m"`
+	} `envconfig:"optional"`
+	SecureEnclavePath string `yaml:"secure_enclave_path"`
+	// grep11 (default) talks to HPCS, emulator runs an in-process EP11 emulator for offline use
+	CryptoBackend string `yaml:"crypto_backend" envconfig:"default=grep11"`
+	// falls back to :$PORT, then :8080
+	ListenAddress string `yaml:"listen_address" envconfig:"optional"`
+	// default waiting period before a key scheduled for deletion is destroyed
+	KeyDeletionWaitingPeriod time.Duration `yaml:"key_deletion_waiting_period" envconfig:"default=720h"`
+	// interval of the sweeper destroying keys whose waiting period is over, 0 disables the sweeper
+	KeyDeletionSweepInterval time.Duration `yaml:"key_deletion_sweep_interval" envconfig:"default=1h"`
+	// maximum number of items of a batch sign request
+	SignBatchMaxItems int `yaml:"sign_batch_max_items" envconfig:"default=10000"`
+	// number of items of a batch signed at the same time
+	SignBatchConcurrency int `yaml:"sign_batch_concurrency" envconfig:"default=16"`
+	// network of the bitcoin addresses of keys: mainnet, testnet, signet or regtest
+	BitcoinNetwork string `yaml:"bitcoin_network" envconfig:"default=mainnet"`
+	// YAML file of certificate profiles replacing or adding to the default ones, see caprofile.go
+	CAProfiles string `yaml:"ca_profiles" envconfig:"optional"`
+	// external URL of the server, when set issued certificates point to the CRL, OCSP responder and certificate of their CA
+	CABaseURL string `yaml:"ca_base_url" envconfig:"optional"`
+	// time until the next update of CRLs
+	CACRLValidity time.Duration `yaml:"ca_crl_validity" envconfig:"default=24h"`
+	// key of the KeyStore (uuid or alias) serving HTTPS, the server listens on plain HTTP when it is not set
+	TLSKeyId string `yaml:"tls_key_id" envconfig:"optional"`
+	// PEM certificate of the TLS key, optionally followed by its chain
+	TLSCertFile string `yaml:"tls_cert_file" envconfig:"optional"`
+	// PEM intermediate certificates sent after the certificate
+	TLSChainFile string `yaml:"tls_chain_file" envconfig:"optional"`
+	// none, optional (verify client certificates when sent) or require
+	TLSClientAuth string `yaml:"tls_client_auth" envconfig:"default=none"`
+	// PEM CA certificates client certificates are verified with
+	TLSClientCAFile string `yaml:"tls_client_ca_file" envconfig:"optional"`
+	// interval of the checks for modified TLS files, 0 only reloads them on SIGHUP
+	TLSReloadInterval time.Duration `yaml:"tls_reload_interval" envconfig:"default=1m"`
 }
 
 // NewConfig returns a new decoded Config struct
@@ -69,5 +106,16 @@ func loadConfigFromEnv() (*Config, error) {
 	if err := envconfig.Init(&config); err != nil {
 		return nil, err
 	}
+	if config.ListenAddress == "" {
+		config.ListenAddress = defaultListenAddress()
+	}
 	return config, nil
 }
+
+// defaultListenAddress keeps the PORT variable gin.Run listened on before LISTEN_ADDRESS existed
+func defaultListenAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"signing_server/util"
+)
+
+// CSRSubject is the distinguished name of a certificate signing request
+type CSRSubject struct {
+	CommonName         string   `json:"common_name"`
+	Organization       []string `json:"organization"`
+	OrganizationalUnit []string `json:"organizational_unit"`
+	Country            []string `json:"country"`
+	Province           []string `json:"province"`
+	Locality           []string `json:"locality"`
+	SerialNumber       string   `json:"serial_number"`
+}
+
+func (s *CSRSubject) name() pkix.Name {
+	return pkix.Name{
+		CommonName:         s.CommonName,
+		Organization:       s.Organization,
+		OrganizationalUnit: s.OrganizationalUnit,
+		Country:            s.Country,
+		Province:           s.Province,
+		Locality:           s.Locality,
+		SerialNumber:       s.SerialNumber,
+	}
+}
+
+// CSRBody describes the certificate requested for a key. key_usage takes digital_signature, content_commitment,
+// key_encipherment, data_encipherment, key_agreement, cert_sign or crl_sign; ext_key_usage takes server_auth,
+// client_auth, code_signing, email_protection, time_stamping or ocsp_signing.
+type CSRBody struct {
+	Subject        CSRSubject `json:"subject"`
+	DNSNames       []string   `json:"dns_names"`
+	IPAddresses    []string   `json:"ip_addresses"`
+	EmailAddresses []string   `json:"email_addresses"`
+	URIs           []string   `json:"uris"`
+	KeyUsage       []string   `json:"key_usage"`
+	ExtKeyUsage    []string   `json:"ext_key_usage"`
+}
+
+// create a PKCS#10 certificate signing request of a key, signed in HPCS
+func createCSR(ctx *gin.Context) {
+	requestBody := CSRBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	template, err := requestBody.template()
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
+	}
+	keyUUID := ctx.Param("id")
+	keystore, err := getKeyAt(keyUUID, "")
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	if err := checkX509Key(keystore); err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	log.WithField("key_uuid", keyUUID).WithField("subject", template.Subject.String()).Info("start create CSR")
+	signer, err := x509Signer(keystore)
+	if err != nil {
+		log.WithError(err).Error("failed to decrypt private key")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		log.WithError(err).Error("failed to create CSR")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":   keystore.Uuid,
+		"action": "csr",
+		"csr":    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+	})
+}
+
+// template checks the body and returns the CSR template
+func (b *CSRBody) template() (*x509.CertificateRequest, error) {
+	template := &x509.CertificateRequest{
+		Subject:        b.Subject.name(),
+		DNSNames:       b.DNSNames,
+		EmailAddresses: b.EmailAddresses,
+	}
+	for _, address := range b.IPAddresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", address)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	for _, uri := range b.URIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" {
+			return nil, fmt.Errorf("invalid URI %q", uri)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	if len(template.Subject.ToRDNSequence()) == 0 && len(b.DNSNames)+len(b.IPAddresses)+len(b.EmailAddresses)+len(b.URIs) == 0 {
+		return nil, fmt.Errorf("a subject or a subject alternative name is required")
+	}
+	if len(b.KeyUsage) > 0 {
+		usage, err := util.ParseKeyUsages(b.KeyUsage)
+		if err != nil {
+			return nil, err
+		}
+		extension, err := util.KeyUsageExtension(usage)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, extension)
+	}
+	if len(b.ExtKeyUsage) > 0 {
+		usages, err := util.ParseExtKeyUsages(b.ExtKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+		extension, err := util.ExtKeyUsageExtension(usages)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, extension)
+	}
+	return template, nil
+}
+
+// checkX509Key checks that a key can sign X.509 structures. crypto/x509 only knows the NIST curves,
+// and util.EP11PrivateKey signs with ECDSA or RSA, so secp256k1 and Ed25519 keys can not.
+func checkX509Key(keystore *KeyStore) error {
+	switch keystore.Algorithm {
+	case KeyAlgorithmRSA:
+	case KeyAlgorithmECDSA:
+		if keystore.Curve == CurveSecp256k1 {
+			return fmt.Errorf("key %s is a secp256k1 key, X.509 requires a P-224, P-256, P-384, P-521 or RSA key", keystore.Uuid)
+		}
+	default:
+		return fmt.Errorf("key %s is an %s key, X.509 requires an ECDSA or RSA key", keystore.Uuid, keystore.Algorithm)
+	}
+	return keystore.allows(KeyUsageSign)
+}
+
+// x509Signer returns the crypto.Signer of a key checked by checkX509Key, its blob is only used in HPCS
+func x509Signer(keystore *KeyStore) (*util.EP11PrivateKey, error) {
+	blob, err := unwrapPrivateKey(keystore)
+	if err != nil {
+		return nil, err
+	}
+	return util.NewEP11Signer(getGlobal().backend, blob, toByte(keystore.PublicKey))
+}
@@ -7,6 +7,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -43,8 +44,7 @@ func getDB(config *Config) *gorm.DB {
 	}
 
 	log.Println("Successfully connected to database!", db)
-	err = db.AutoMigrate(&KeyStore{})
-	if err != nil {
+	if err := migrateDB(db); err != nil {
 		log.Println("Unable to migrate table. Err:", err)
 		log.Fatal(fmt.Sprintf("err: %v", err))
 		return nil
@@ -52,15 +52,67 @@ func getDB(config *Config) *gorm.DB {
 	return db
 }
 
-func insertKey(db *gorm.DB, privateKey, publicKey string) (*KeyStore, error) {
-	keyId := uuid.New().String()
-	key := &KeyStore{
-		Uuid:       keyId,
-		Name:       keyId,
-		PrivateKey: privateKey,
-		PublicKey:  publicKey,
+// migrateDB creates or updates the tables and backfills the columns added since
+func migrateDB(db *gorm.DB) error {
+	err := db.AutoMigrate(&KeyStore{}, &KeyAudit{}, &KeyAlias{}, &KeyEncryptionKey{}, &KekRotation{}, &CertificateAuthority{}, &IssuedCertificate{})
+	if err != nil {
+		return err
+	}
+	if err := backfillKeyMetadata(db); err != nil {
+		return err
+	}
+	if err := backfillKeyAddress(db); err != nil {
+		return err
+	}
+	return backfillKekVersion(db)
+}
+
+// backfillKeyAddress fills the ethereum address of secp256k1 keys stored before the address column existed
+func backfillKeyAddress(db *gorm.DB) error {
+	keys := []KeyStore{}
+	if err := db.Where("(address IS NULL OR address = '') AND algorithm = ?", KeyAlgorithmECDSA).Find(&keys).Error; err != nil {
+		return err
+	}
+	for i := range keys {
+		address := ethereumAddress(keys[i].PublicKey)
+		if address == "" {
+			continue
+		}
+		if err := db.Model(&keys[i]).Update("address", address).Error; err != nil {
+			return err
+		}
+		log.WithField("key_uuid", keys[i].Uuid).WithField("address", address).Info("backfill key address")
+	}
+	return nil
+}
+
+// insertKey stores a new active key, the metadata is set by the caller.
+// A key with a name gets an alias of the same name, the name must pass checkNewAlias;
+// the name of a key without one is its uuid.
+func insertKey(db *gorm.DB, key *KeyStore) (*KeyStore, error) {
+	// wrapPrivateKey already picked the uuid of keys protected by the KEK
+	if key.Uuid == "" {
+		key.Uuid = uuid.New().String()
+	}
+	keyId := key.Uuid
+	if key.Name == "" {
+		key.Name = keyId
 	}
-	if err := db.Create(key).Error; err != nil {
+	key.State = KeyStateActive
+	// BIP32 master keys do not sign, only their derived keys have an address
+	if key.Algorithm == KeyAlgorithmECDSA {
+		key.Address = ethereumAddress(key.PublicKey)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		if key.Name == keyId {
+			return nil
+		}
+		return tx.Create(&KeyAlias{Alias: key.Name, KeyUuid: keyId}).Error
+	})
+	if err != nil {
 		log.WithField("key", key).WithError(err).Error("fail to insert to DB")
 		log.Println("", err)
 		return nil, err
@@ -72,6 +124,62 @@ func insertKey(db *gorm.DB, privateKey, publicKey string) (*KeyStore, error) {
 func getKeyByUUID(db *gorm.DB, keyUuid string) *KeyStore {
 	log.WithField("key_uuid", keyUuid).Info("start search key")
 	key := &KeyStore{}
-	db.First(key, "uuid=?", keyUuid)
+	if err := db.First(key, "uuid=?", keyUuid).Error; err != nil {
+		return nil
+	}
 	return key
 }
+
+// getKeyByAddress finds the active secp256k1 key of an ethereum address, nil if there is none. A destroyed
+// key keeps its address, the same key imported again is found instead of it.
+func getKeyByAddress(db *gorm.DB, address common.Address) *KeyStore {
+	log.WithField("address", address.Hex()).Info("start search key")
+	key := &KeyStore{}
+	if err := db.First(key, "address = ? AND state = ? AND algorithm = ?", address.Hex(), KeyStateActive, KeyAlgorithmECDSA).Error; err != nil {
+		return nil
+	}
+	return key
+}
+
+// listEthereumAddresses returns the addresses of all active secp256k1 keys
+func listEthereumAddresses(db *gorm.DB) ([]common.Address, error) {
+	addresses := []string{}
+	err := db.Model(&KeyStore{}).
+		Where("address <> '' AND state = ? AND algorithm = ?", KeyStateActive, KeyAlgorithmECDSA).
+		Order("id").Pluck("address", &addresses).Error
+	if err != nil {
+		return nil, err
+	}
+	result := make([]common.Address, 0, len(addresses))
+	for _, address := range addresses {
+		result = append(result, common.HexToAddress(address))
+	}
+	return result, nil
+}
+
+// searchKeys returns at most limit keys matching the filter, ordered by id
+func searchKeys(db *gorm.DB, filter *KeyFilter, limit int) ([]KeyStore, error) {
+	query := db.Model(&KeyStore{}).Where("id > ?", filter.AfterID)
+	for column, value := range map[string]string{
+		"name":     filter.Name,
+		"key_type": filter.KeyType,
+		"curve":    filter.Curve,
+		"state":    filter.State,
+		"address":  filter.Address,
+	} {
+		if value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	if filter.CreatedAfter != nil {
+		query = query.Where("created_at >= ?", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *filter.CreatedBefore)
+	}
+	keys := []KeyStore{}
+	if err := query.Order("id").Limit(limit).Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
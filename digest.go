@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"golang.org/x/crypto/sha3"
+	"signing_server/util"
+)
+
+// what the data of an ECDSA sign or verify request is
+const (
+	// SignModeDigest signs data as an already computed digest
+	SignModeDigest = "digest"
+	// SignModeMessage hashes data with the hash of the request before signing it
+	SignModeMessage = "message"
+)
+
+// signature schemes of EC keys
+const (
+	// SignSchemeECDSA is the default scheme of all curves
+	SignSchemeECDSA = "ecdsa"
+	// SignSchemeSchnorr verifies BIP-340 Schnorr signatures of secp256k1 keys, signing is not supported
+	SignSchemeSchnorr = "schnorr"
+)
+
+// digestSizes are the output sizes of the hashes a digest may come from
+var digestSizes = []int{28, 32, 48, 64}
+
+// messageHash is a hash messages can be signed with
+type messageHash struct {
+	name string
+	new  func() hash.Hash
+	// EP11 mechanism hashing and signing in one call, 0 when the HSM has none and the
+	// message is hashed by the server then signed with CKM_ECDSA
+	mech ep11.Mechanism
+}
+
+var messageHashes = []messageHash{
+	{"SHA-256", sha256.New, ep11.CKM_ECDSA_SHA256},
+	{"SHA-384", sha512.New384, ep11.CKM_ECDSA_SHA384},
+	{"SHA-512", sha512.New, ep11.CKM_ECDSA_SHA512},
+	{"Keccak-256", sha3.NewLegacyKeccak256, 0},
+	{"SHA3-256", sha3.New256, 0},
+}
+
+func (h *messageHash) digest(data []byte) []byte {
+	hh := h.new()
+	hh.Write(data)
+	return hh.Sum(nil)
+}
+
+// parseMessageHash finds a hash by name, case, '-' and '_' are ignored so sha256 and keccak256 also match
+func parseMessageHash(name string) (*messageHash, error) {
+	normalize := func(s string) string {
+		return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(s))
+	}
+	for i := range messageHashes {
+		if normalize(messageHashes[i].name) == normalize(name) {
+			return &messageHashes[i], nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("hash is required by the %s mode", SignModeMessage)
+	}
+	return nil, fmt.Errorf("unsupported hash %q, use SHA-256, SHA-384, SHA-512, Keccak-256 or SHA3-256", name)
+}
+
+// errSchnorrUnsupported fails BIP-340 signing. No CKM_IBM_ECDSA_OTHER variant of EP11 signs BIP-340,
+// its Schnorr variant ECSG_IBM_ECSDSA_S256 is EC-SDSA, a different algorithm.
+var errSchnorrUnsupported = fmt.Errorf("%w: EP11 has no mechanism signing BIP-340 Schnorr signatures", errUnsupported)
+
+// ecSignInput resolves the scheme, mode and hash of a request on an EC key. It returns the mechanism
+// to sign or verify with, the data to pass to it, and the digest the signature is computed over.
+// The schnorr scheme has no mechanism, its signatures are verified by the server over the 32 bytes digest.
+func ecSignInput(keystore *KeyStore, scheme, mode, hash string, data []byte) (*pb.Mechanism, []byte, []byte, error) {
+	mech, data, digest, err := ecdsaSignInput(keystore, mode, hash, data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch scheme {
+	case "", SignSchemeECDSA:
+		return &pb.Mechanism{Mechanism: mech}, data, digest, nil
+	case SignSchemeSchnorr:
+		if keystore.Curve != CurveSecp256k1 {
+			return nil, nil, nil, fmt.Errorf("%s signatures require a secp256k1 key, key %s is %s", scheme, keystore.Uuid, keystore.Curve)
+		}
+		if len(digest) != util.SchnorrMessageLength {
+			return nil, nil, nil, fmt.Errorf("%s signs %d bytes digests, got [%d]", scheme, util.SchnorrMessageLength, len(digest))
+		}
+		return nil, digest, digest, nil
+	}
+	return nil, nil, nil, fmt.Errorf("unsupported scheme %q, use %s or %s", scheme, SignSchemeECDSA, SignSchemeSchnorr)
+}
+
+// checkSchnorrSignature checks sig is the BIP-340 signature of the digest by the key
+func checkSchnorrSignature(keystore *KeyStore, digest, sig []byte) error {
+	publicKey, err := ecPublicKey(keystore)
+	if err != nil {
+		return err
+	}
+	return util.VerifySchnorr(publicKey, digest, sig)
+}
+
+// ecdsaSignInput resolves the mode and hash of an ECDSA request, see ecSignInput
+func ecdsaSignInput(keystore *KeyStore, mode, hash string, data []byte) (ep11.Mechanism, []byte, []byte, error) {
+	switch mode {
+	case SignModeDigest:
+		if hash != "" {
+			return 0, nil, nil, fmt.Errorf("hash only applies to the %s mode", SignModeMessage)
+		}
+		if err := checkDigestSize(keystore, data); err != nil {
+			return 0, nil, nil, err
+		}
+		return ep11.CKM_ECDSA, data, data, nil
+	case SignModeMessage:
+		h, err := parseMessageHash(hash)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		digest := h.digest(data)
+		if h.mech != 0 {
+			return h.mech, data, digest, nil
+		}
+		return ep11.CKM_ECDSA, digest, digest, nil
+	case "":
+		return 0, nil, nil, fmt.Errorf("mode is required, use %s or %s", SignModeDigest, SignModeMessage)
+	}
+	return 0, nil, nil, fmt.Errorf("unsupported mode %q, use %s or %s", mode, SignModeDigest, SignModeMessage)
+}
+
+// checkDigestSize accepts the digest sizes of the supported hashes that fit in the curve order,
+// CKM_ECDSA would otherwise silently truncate a message passed as digest
+func checkDigestSize(keystore *KeyStore, digest []byte) error {
+	max := (keystore.KeySize + 7) / 8
+	for _, size := range digestSizes {
+		if len(digest) == size && size <= max {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s digest must be %v bytes and at most %d bytes, got [%d]", keystore.Curve, digestSizes, max, len(digest))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"signing_server/util"
+)
+
+// Ed25519SignBody is the message to sign in base64, Ed25519 signs the whole message and not a digest
+type Ed25519SignBody struct {
+	Data string `json:"data"`
+}
+
+// ed25519PublicKey extracts the 32 bytes public key of the EP11 SPKI of an Ed25519 key
+func ed25519PublicKey(spki []byte) (ed25519.PublicKey, error) {
+	publicKey, oid, err := util.GetPubKey(spki)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := publicKey.(ed25519.PublicKey)
+	if !ok || !oid.Equal(util.OIDNamedCurveED25519) || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is not an Ed25519 key")
+	}
+	return key, nil
+}
+
+// generate an Ed25519 key pair in HPCS, the body is the optional GenerateKeyBody without curve
+func generateEd25519KeyPair(ctx *gin.Context) {
+	log.Info("start generate Ed25519 key")
+	requestBody := GenerateKeyBody{}
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.BindJSON(&requestBody); err != nil {
+			log.WithError(err).Error("fail to read json body")
+			return
+		}
+	}
+	if requestBody.Curve != "" && requestBody.Curve != CurveEd25519 {
+		ctx.AbortWithError(400, fmt.Errorf("curve of Ed25519 keys can only be %s", CurveEd25519))
+		return
+	}
+	if !checkKeyName(ctx, requestBody.Name) {
+		return
+	}
+	publicKey, privateKey, err := generateECKeyPair(util.OIDNamedCurveED25519)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	rawPublicKey, err := ed25519PublicKey(publicKey)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	key := newEd25519Key(toString(publicKey), KeyOriginGenerated)
+	if err := key.wrapPrivateKey(privateKey); err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	key.Name = requestBody.Name
+	keys, err := insertKey(getGlobal().db, key)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":       keys.Uuid,
+		"curve":      keys.Curve,
+		"public":     keys.PublicKey,
+		"public_raw": hexutil.Encode(rawPublicKey),
+		"private":    keys.PrivateKey,
+	})
+}
+
+// export the public key of an Ed25519 key as raw 32 bytes (hex and base64) and as SPKI (RFC 8410 and EP11)
+func getEd25519PublicKey(ctx *gin.Context) {
+	key := getKey(getGlobal().db, ctx.Param("id"))
+	if key == nil {
+		ctx.AbortWithError(404, errKeyNotFound)
+		return
+	}
+	if key.Algorithm != KeyAlgorithmEdDSA {
+		ctx.AbortWithError(400, fmt.Errorf("key %s is not an Ed25519 key", key.Uuid))
+		return
+	}
+	rawPublicKey, err := ed25519PublicKey(toByte(key.PublicKey))
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	spki, err := x509.MarshalPKIXPublicKey(rawPublicKey)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":       key.Uuid,
+		"curve":      key.Curve,
+		"raw":        hexutil.Encode(rawPublicKey),
+		"raw_base64": toString(rawPublicKey),
+		"spki":       toString(spki),
+		"ep11_spki":  key.PublicKey,
+	})
+}
+
+// sign a message with an Ed25519 key, the signature is the 64 bytes R||S
+func signEd25519(ctx *gin.Context) {
+	requestBody := Ed25519SignBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	keystore, err := getUsableKey(ctx.Param("id"), KeyAlgorithmEdDSA, KeyUsageSign)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	log.WithField("key_uuid", keystore.Uuid).WithField("data", requestBody.Data).Info("start sign Ed25519")
+	privateKey, err := unwrapPrivateKey(keystore)
+	if err != nil {
+		log.WithError(err).Error("failed to decrypt private key")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	sig, err := signEdDSA(privateKey, toByte(requestBody.Data))
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":      keystore.Uuid,
+		"action":    "sign",
+		"signature": toString(sig),
+	})
+}
+
+// verify an Ed25519 signature in HPCS
+func verifyEd25519(ctx *gin.Context) {
+	requestBody := VerifyBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	keystore, err := getUsableKey(ctx.Param("id"), KeyAlgorithmEdDSA, KeyUsageVerify)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	result, err := verifyEdDSA(toByte(requestBody.Signature), toByte(keystore.PublicKey), toByte(requestBody.Data))
+	if err != nil {
+		log.WithError(err).Error("failed to verify signature")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"result": result})
+}
+
+func signEdDSA(privateKey, data []byte) ([]byte, error) {
+	signRequest := &pb.SignSingleRequest{
+		Mech:    &pb.Mechanism{Mechanism: ep11.CKM_IBM_ED25519_SHA512},
+		PrivKey: privateKey,
+		Data:    data,
+	}
+	signSingleResponse, err := getGlobal().backend.SignSingle(context.Background(), signRequest)
+	if err != nil {
+		log.WithError(err).Error("fail to sign data with Ed25519")
+		return nil, err
+	}
+	return signSingleResponse.GetSignature(), nil
+}
+
+func verifyEdDSA(signature, pubKey, data []byte) (bool, error) {
+	verifySingleRequest := &pb.VerifySingleRequest{
+		Mech:      &pb.Mechanism{Mechanism: ep11.CKM_IBM_ED25519_SHA512},
+		PubKey:    pubKey,
+		Data:      data,
+		Signature: signature,
+	}
+	_, err := getGlobal().backend.VerifySingle(context.Background(), verifySingleRequest)
+	if ok, ep11Status := util.Convert(err); !ok {
+		if ep11Status.Code == ep11.CKR_SIGNATURE_INVALID {
+			log.WithError(err).Info("invalid signature")
+			return false, nil
+		}
+		return false, fmt.Errorf("verify error: [%d]: %s", ep11Status.Code, ep11Status.Detail)
+	}
+	return true, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"signing_server/util"
+)
+
+// importEd25519Key stores an Ed25519 key of the given seed sealed by the emulator and returns its uuid
+func importEd25519Key(t *testing.T, seed []byte) string {
+	t.Helper()
+	params, _ := asn1.Marshal(util.OIDNamedCurveED25519)
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	spki, err := asn1.Marshal(emulatorPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  util.OIDECPublicKey,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		PublicKey: asn1.BitString{Bytes: publicKey, BitLength: 8 * len(publicKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := getGlobal().backend.(*emulator).seal(&emulatorKeyObject{
+		Class:   int64(ep11.CKO_PRIVATE_KEY),
+		KeyType: int64(ep11.CKK_EC),
+		Params:  params,
+		Value:   seed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystore := newEd25519Key(toString(spki), KeyOriginImported)
+	if err := keystore.wrapPrivateKey(blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertKey(getGlobal().db, keystore); err != nil {
+		t.Fatal(err)
+	}
+	return keystore.Uuid
+}
+
+// a generated key signs, its signatures verify with crypto/ed25519 and its public key exports as raw and SPKI
+func TestEd25519(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/ed25519/generate_key_pair", nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	if m["curve"] != CurveEd25519 {
+		t.Fatal(m["curve"])
+	}
+	publicKey := ed25519.PublicKey(hexutil.MustDecode(m["public_raw"].(string)))
+	if len(publicKey) != ed25519.PublicKeySize {
+		t.Fatal(len(publicKey))
+	}
+
+	code, m = doJSON(t, r, "GET", "/v1/grep11/key/ed25519/public/"+id, nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	if !bytes.Equal(hexutil.MustDecode(m["raw"].(string)), publicKey) || !bytes.Equal(toByte(m["raw_base64"].(string)), publicKey) {
+		t.Fatal(m)
+	}
+	spki, err := x509.ParsePKIXPublicKey(toByte(m["spki"].(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKey.Equal(spki) {
+		t.Fatal("SPKI holds another public key")
+	}
+	if ep11Key, err := ed25519PublicKey(toByte(m["ep11_spki"].(string))); err != nil || !publicKey.Equal(ep11Key) {
+		t.Fatal(err)
+	}
+
+	message := []byte("the whole message is signed, not a digest")
+	code, m = doJSON(t, r, "POST", "/v1/grep11/key/ed25519/sign/"+id, map[string]string{"data": toString(message)})
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	signature := toByte(m["signature"].(string))
+	if !ed25519.Verify(publicKey, message, signature) {
+		t.Fatal("signature does not verify")
+	}
+	verify := map[string]string{"data": toString(message), "signature": toString(signature)}
+	if code, m = doJSON(t, r, "POST", "/v1/grep11/key/ed25519/verify/"+id, verify); code != 200 || m["result"] != true {
+		t.Fatal(code, m)
+	}
+	verify["data"] = toString([]byte("another message"))
+	if code, m = doJSON(t, r, "POST", "/v1/grep11/key/ed25519/verify/"+id, verify); code != 200 || m["result"] != false {
+		t.Fatal(code, m)
+	}
+
+	// the Ed25519 routes refuse secp256k1 keys
+	other := importTestKey(t, "0404040404040404040404040404040404040404040404040404040404040404")
+	if code, m = doJSON(t, r, "GET", "/v1/grep11/key/ed25519/public/"+other, nil); code != 400 {
+		t.Fatal(code, m)
+	}
+}
+
+// test 2 of RFC 8032 section 7.1
+func TestEd25519RFC8032(t *testing.T) {
+	r := testRouter()
+	seed := mustHex(t, "4ccd089b28ff96da9db6c346ec114e0f5b8a319f35aba624da8cf6ed4fb8a6fb")
+	publicKey := mustHex(t, "3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c")
+	message := mustHex(t, "72")
+	signature := mustHex(t, "92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da"+
+		"085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00")
+	id := importEd25519Key(t, seed)
+
+	code, m := doJSON(t, r, "GET", "/v1/grep11/key/ed25519/public/"+id, nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	if !bytes.Equal(hexutil.MustDecode(m["raw"].(string)), publicKey) {
+		t.Fatal(m["raw"])
+	}
+	verify := map[string]string{"data": toString(message), "signature": toString(signature)}
+	if code, m = doJSON(t, r, "POST", "/v1/grep11/key/ed25519/verify/"+id, verify); code != 200 || m["result"] != true {
+		t.Fatal(code, m)
+	}
+	// Ed25519 is deterministic, the HSM gives the signature of the RFC
+	code, m = doJSON(t, r, "POST", "/v1/grep11/key/ed25519/sign/"+id, map[string]string{"data": toString(message)})
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	if !bytes.Equal(toByte(m["signature"].(string)), signature) {
+		t.Fatal(m["signature"])
+	}
+}
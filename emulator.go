@@ -0,0 +1,899 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"github.com/btcsuite/btcd/btcec/v2"
+	log "github.com/sirupsen/logrus"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"signing_server/util"
+)
+
+const (
+	// EmulatorMasterKeyName is the file in the secure enclave holding the emulator master key
+	EmulatorMasterKeyName = "emulator_master.key"
+
+	emulatorBlobMagic = "EP11EMU1"
+)
+
+// emulatorUsageAttributes are the usage attributes an emulated key blob remembers.
+// The bit position of an attribute in emulatorKeyObject.Denied is its index here.
+var emulatorUsageAttributes = []ep11.Attribute{
+	ep11.CKA_ENCRYPT,
+	ep11.CKA_DECRYPT,
+	ep11.CKA_SIGN,
+	ep11.CKA_VERIFY,
+	ep11.CKA_WRAP,
+	ep11.CKA_UNWRAP,
+	ep11.CKA_DERIVE,
+}
+
+// emulatorMechanisms lists the mechanisms implemented by the emulator
+var emulatorMechanisms = map[ep11.Mechanism]*pb.MechanismInfo{
+	ep11.CKM_AES_KEY_GEN:            {MinKeySize: 16, MaxKeySize: 32, Flags: uint64(ep11.CKF_GENERATE)},
+	ep11.CKM_GENERIC_SECRET_KEY_GEN: {MinKeySize: 16, MaxKeySize: 64, Flags: uint64(ep11.CKF_GENERATE)},
+	util.CKM_IBM_BTC_DERIVE:         {MinKeySize: 256, MaxKeySize: 256, Flags: uint64(ep11.CKF_DERIVE)},
+	ep11.CKM_AES_ECB:                {MinKeySize: 16, MaxKeySize: 32, Flags: uint64(ep11.CKF_ENCRYPT | ep11.CKF_DECRYPT)},
+	ep11.CKM_AES_CBC_PAD:            {MinKeySize: 16, MaxKeySize: 32, Flags: uint64(ep11.CKF_ENCRYPT | ep11.CKF_DECRYPT | ep11.CKF_UNWRAP)},
+	ep11.CKM_AES_KEY_WRAP_PAD:       {MinKeySize: 16, MaxKeySize: 32, Flags: uint64(ep11.CKF_ENCRYPT | ep11.CKF_DECRYPT)},
+	ep11.CKM_EC_KEY_PAIR_GEN:        {MinKeySize: 224, MaxKeySize: 521, Flags: uint64(ep11.CKF_GENERATE_KEY_PAIR | ep11.CKF_EC_NAMEDCURVE)},
+	ep11.CKM_ECDSA:                  {MinKeySize: 224, MaxKeySize: 521, Flags: uint64(ep11.CKF_SIGN | ep11.CKF_VERIFY | ep11.CKF_EC_NAMEDCURVE)},
+	ep11.CKM_ECDSA_SHA256:           {MinKeySize: 224, MaxKeySize: 521, Flags: uint64(ep11.CKF_SIGN | ep11.CKF_VERIFY | ep11.CKF_EC_NAMEDCURVE)},
+	ep11.CKM_ECDSA_SHA384:           {MinKeySize: 224, MaxKeySize: 521, Flags: uint64(ep11.CKF_SIGN | ep11.CKF_VERIFY | ep11.CKF_EC_NAMEDCURVE)},
+	ep11.CKM_ECDSA_SHA512:           {MinKeySize: 224, MaxKeySize: 521, Flags: uint64(ep11.CKF_SIGN | ep11.CKF_VERIFY | ep11.CKF_EC_NAMEDCURVE)},
+	ep11.CKM_IBM_ED25519_SHA512:     {MinKeySize: 256, MaxKeySize: 256, Flags: uint64(ep11.CKF_SIGN | ep11.CKF_VERIFY | ep11.CKF_EC_NAMEDCURVE)},
+	ep11.CKM_RSA_PKCS_KEY_PAIR_GEN:  {MinKeySize: 2048, MaxKeySize: 4096, Flags: uint64(ep11.CKF_GENERATE_KEY_PAIR)},
+	ep11.CKM_RSA_PKCS:               {MinKeySize: 2048, MaxKeySize: 4096, Flags: uint64(ep11.CKF_SIGN | ep11.CKF_VERIFY)},
+	ep11.CKM_RSA_PKCS_PSS:           {MinKeySize: 2048, MaxKeySize: 4096, Flags: uint64(ep11.CKF_SIGN | ep11.CKF_VERIFY)},
+}
+
+// emulator is a pure-Go, in-process implementation of CryptoBackend.
+// Like EP11, it never hands out clear key material: private and secret keys are returned as
+// opaque blobs sealed under an emulator master key kept in the secure enclave path, and
+// failures carry a CKR_* code in a Grep11Error detail so util.Convert decodes them as usual.
+// It is meant for development and CI only.
+type emulator struct {
+	aead cipher.AEAD
+}
+
+// emulatorKeyObject is the content sealed inside an emulated key blob
+type emulatorKeyObject struct {
+	Class   int64
+	KeyType int64
+	Params  []byte // DER encoded curve OID (CKA_EC_PARAMS) for EC keys
+	Value   []byte // clear secret key, private scalar for EC keys, or PKCS#1 DER for RSA keys
+	Denied  int64  // bit set of emulatorUsageAttributes explicitly disabled by the template
+}
+
+func newEmulator(secureEnclavePath string) (*emulator, error) {
+	keyPath := path.Join(secureEnclavePath, EmulatorMasterKeyName)
+	masterKey, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		log.WithField("key_path", keyPath).Info("generate a new emulator master key")
+		masterKey = make([]byte, 32)
+		if _, err = rand.Read(masterKey); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(keyPath, masterKey, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load emulator master key: %s", err)
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid emulator master key: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &emulator{aead: aead}, nil
+}
+
+// emulatorError builds a gRPC status error carrying a Grep11Error, the way HPCS reports failures
+func emulatorError(code ep11.Return, format string, args ...interface{}) error {
+	detail := fmt.Sprintf(format, args...)
+	st, err := status.New(codes.Unknown, detail).WithDetails(&pb.Grep11Error{Code: code, Detail: detail})
+	if err != nil {
+		return status.Error(codes.Unknown, detail)
+	}
+	return st.Err()
+}
+
+// seal turns a key object into an opaque blob.
+// Blobs are padded to the AES block size because callers protect them with CKM_AES_ECB.
+func (e *emulator) seal(obj *emulatorKeyObject) ([]byte, error) {
+	payload, err := asn1.Marshal(*obj)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to encode key object: %s", err)
+	}
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to generate nonce: %s", err)
+	}
+	sealed := e.aead.Seal(nil, nonce, payload, []byte(emulatorBlobMagic))
+
+	blob := bytes.NewBufferString(emulatorBlobMagic)
+	binary.Write(blob, binary.BigEndian, uint32(len(sealed)))
+	blob.Write(nonce)
+	blob.Write(sealed)
+	if pad := blob.Len() % aes.BlockSize; pad != 0 {
+		blob.Write(make([]byte, aes.BlockSize-pad))
+	}
+	return blob.Bytes(), nil
+}
+
+// open authenticates a blob produced by seal and returns the key object inside it
+func (e *emulator) open(blob []byte) (*emulatorKeyObject, error) {
+	header := len(emulatorBlobMagic) + 4 + e.aead.NonceSize()
+	if len(blob) < header || string(blob[:len(emulatorBlobMagic)]) != emulatorBlobMagic {
+		return nil, emulatorError(ep11.CKR_KEY_HANDLE_INVALID, "not an emulator key blob")
+	}
+	sealedLen := int(binary.BigEndian.Uint32(blob[len(emulatorBlobMagic):]))
+	if sealedLen > len(blob)-header {
+		return nil, emulatorError(ep11.CKR_KEY_HANDLE_INVALID, "truncated key blob")
+	}
+	nonce := blob[len(emulatorBlobMagic)+4 : header]
+	payload, err := e.aead.Open(nil, nonce, blob[header:header+sealedLen], []byte(emulatorBlobMagic))
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_KEY_HANDLE_INVALID, "key blob integrity check failed")
+	}
+	obj := &emulatorKeyObject{}
+	if _, err := asn1.Unmarshal(payload, obj); err != nil {
+		return nil, emulatorError(ep11.CKR_KEY_HANDLE_INVALID, "failed to decode key object: %s", err)
+	}
+	return obj, nil
+}
+
+// openFor opens a blob and checks that the key is of the expected type and allowed for the operation
+func (e *emulator) openFor(blob []byte, keyType ep11.KeyType, usage ep11.Attribute) (*emulatorKeyObject, error) {
+	obj, err := e.open(blob)
+	if err != nil {
+		return nil, err
+	}
+	if ep11.KeyType(obj.KeyType) != keyType {
+		return nil, emulatorError(ep11.CKR_KEY_TYPE_INCONSISTENT, "key type %s can not be used here", ep11.KeyType(obj.KeyType))
+	}
+	for i, attr := range emulatorUsageAttributes {
+		if attr == usage && obj.Denied&(1<<uint(i)) != 0 {
+			return nil, emulatorError(ep11.CKR_KEY_FUNCTION_NOT_PERMITTED, "%s is not permitted for this key", usage)
+		}
+	}
+	return obj, nil
+}
+
+// deniedUsage collects the usage attributes a template explicitly sets to false
+func deniedUsage(template map[ep11.Attribute]*pb.AttributeValue) int64 {
+	var denied int64
+	for i, attr := range emulatorUsageAttributes {
+		if v, ok := template[attr]; ok {
+			if _, isBool := v.GetOneAttr().(*pb.AttributeValue_AttributeTF); isBool && !v.GetAttributeTF() {
+				denied |= 1 << uint(i)
+			}
+		}
+	}
+	return denied
+}
+
+func (e *emulator) GetMechanismList(ctx context.Context, in *pb.GetMechanismListRequest, opts ...grpc.CallOption) (*pb.GetMechanismListResponse, error) {
+	mechs := make([]ep11.Mechanism, 0, len(emulatorMechanisms))
+	for mech := range emulatorMechanisms {
+		mechs = append(mechs, mech)
+	}
+	return &pb.GetMechanismListResponse{Mechs: mechs}, nil
+}
+
+func (e *emulator) GetMechanismInfo(ctx context.Context, in *pb.GetMechanismInfoRequest, opts ...grpc.CallOption) (*pb.GetMechanismInfoResponse, error) {
+	info, ok := emulatorMechanisms[in.Mech]
+	if !ok {
+		return nil, emulatorError(ep11.CKR_MECHANISM_INVALID, "mechanism %s is not supported by the emulator", in.Mech)
+	}
+	return &pb.GetMechanismInfoResponse{MechInfo: info}, nil
+}
+
+func (e *emulator) GenerateRandom(ctx context.Context, in *pb.GenerateRandomRequest, opts ...grpc.CallOption) (*pb.GenerateRandomResponse, error) {
+	rnd := make([]byte, in.Len)
+	if _, err := rand.Read(rnd); err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to generate random: %s", err)
+	}
+	return &pb.GenerateRandomResponse{Rnd: rnd}, nil
+}
+
+func (e *emulator) GenerateKey(ctx context.Context, in *pb.GenerateKeyRequest, opts ...grpc.CallOption) (*pb.GenerateKeyResponse, error) {
+	keyType := ep11.CKK_AES
+	switch in.Mech.GetMechanism() {
+	case ep11.CKM_AES_KEY_GEN:
+	case ep11.CKM_GENERIC_SECRET_KEY_GEN:
+		keyType = ep11.CKK_GENERIC_SECRET
+	default:
+		return nil, emulatorError(ep11.CKR_MECHANISM_INVALID, "mechanism %s is not supported by GenerateKey", in.Mech.GetMechanism())
+	}
+	valueLen, ok := in.Template[ep11.CKA_VALUE_LEN]
+	if !ok {
+		return nil, emulatorError(ep11.CKR_TEMPLATE_INCOMPLETE, "CKA_VALUE_LEN is required")
+	}
+	keyLen := valueLen.GetAttributeI()
+	if keyType == ep11.CKK_AES && keyLen != 16 && keyLen != 24 && keyLen != 32 {
+		return nil, emulatorError(ep11.CKR_KEY_SIZE_RANGE, "invalid AES key length %d", keyLen)
+	}
+	if keyType == ep11.CKK_GENERIC_SECRET && (keyLen < 16 || keyLen > 64) {
+		return nil, emulatorError(ep11.CKR_KEY_SIZE_RANGE, "invalid generic secret length %d", keyLen)
+	}
+	key := make([]byte, keyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to generate key: %s", err)
+	}
+	blob, err := e.seal(&emulatorKeyObject{
+		Class:   int64(ep11.CKO_SECRET_KEY),
+		KeyType: int64(keyType),
+		Value:   key,
+		Denied:  deniedUsage(in.Template),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GenerateKeyResponse{KeyBytes: blob}, nil
+}
+
+func (e *emulator) GenerateKeyPair(ctx context.Context, in *pb.GenerateKeyPairRequest, opts ...grpc.CallOption) (*pb.GenerateKeyPairResponse, error) {
+	if in.Mech.GetMechanism() == ep11.CKM_RSA_PKCS_KEY_PAIR_GEN {
+		return e.generateRSAKeyPair(in.PubKeyTemplate, in.PrivKeyTemplate)
+	}
+	if in.Mech.GetMechanism() != ep11.CKM_EC_KEY_PAIR_GEN {
+		return nil, emulatorError(ep11.CKR_MECHANISM_INVALID, "mechanism %s is not supported by GenerateKeyPair", in.Mech.GetMechanism())
+	}
+	ecParams := in.PubKeyTemplate[ep11.CKA_EC_PARAMS].GetAttributeB()
+	if len(ecParams) == 0 {
+		return nil, emulatorError(ep11.CKR_TEMPLATE_INCOMPLETE, "CKA_EC_PARAMS is required")
+	}
+	if isEmulatorEd25519(ecParams) {
+		return e.generateEd25519KeyPair(ecParams, in.PrivKeyTemplate)
+	}
+	curve, err := emulatorCurve(ecParams)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to generate EC key: %s", err)
+	}
+	spki, err := marshalEmulatorECPublicKey(ecParams, &privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := e.seal(&emulatorKeyObject{
+		Class:   int64(ep11.CKO_PRIVATE_KEY),
+		KeyType: int64(ep11.CKK_EC),
+		Params:  ecParams,
+		Value:   privateKey.D.FillBytes(make([]byte, (curve.Params().N.BitLen()+7)/8)),
+		Denied:  deniedUsage(in.PrivKeyTemplate),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GenerateKeyPairResponse{PubKeyBytes: spki, PrivKeyBytes: blob}, nil
+}
+
+func (e *emulator) EncryptSingle(ctx context.Context, in *pb.EncryptSingleRequest, opts ...grpc.CallOption) (*pb.EncryptSingleResponse, error) {
+	key, err := e.openFor(in.Key, ep11.CKK_AES, ep11.CKA_ENCRYPT)
+	if err != nil {
+		return nil, err
+	}
+	ciphered, err := emulatorAESCrypt(in.Mech, key.Value, in.Plain, true)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.EncryptSingleResponse{Ciphered: ciphered}, nil
+}
+
+func (e *emulator) DecryptSingle(ctx context.Context, in *pb.DecryptSingleRequest, opts ...grpc.CallOption) (*pb.DecryptSingleResponse, error) {
+	key, err := e.openFor(in.Key, ep11.CKK_AES, ep11.CKA_DECRYPT)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := emulatorAESCrypt(in.Mech, key.Value, in.Ciphered, false)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DecryptSingleResponse{Plain: plain}, nil
+}
+
+func (e *emulator) UnwrapKey(ctx context.Context, in *pb.UnwrapKeyRequest, opts ...grpc.CallOption) (*pb.UnwrapKeyResponse, error) {
+	kek, err := e.openFor(in.KeK, ep11.CKK_AES, ep11.CKA_UNWRAP)
+	if err != nil {
+		return nil, err
+	}
+	if in.Mech.GetMechanism() != ep11.CKM_AES_CBC_PAD {
+		return nil, emulatorError(ep11.CKR_MECHANISM_INVALID, "mechanism %s is not supported by UnwrapKey", in.Mech.GetMechanism())
+	}
+	clear, err := emulatorAESCrypt(in.Mech, kek.Value, in.Wrapped, false)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_WRAPPED_KEY_INVALID, "failed to decrypt wrapped key")
+	}
+
+	obj := &emulatorKeyObject{Denied: deniedUsage(in.Template)}
+	switch keyType := ep11.KeyType(in.Template[ep11.CKA_KEY_TYPE].GetAttributeI()); keyType {
+	case ep11.CKK_AES:
+		if valueLen, ok := in.Template[ep11.CKA_VALUE_LEN]; ok && int(valueLen.GetAttributeI()) != len(clear) {
+			return nil, emulatorError(ep11.CKR_WRAPPED_KEY_INVALID, "unwrapped key is %d bytes, template expects %d", len(clear), valueLen.GetAttributeI())
+		}
+		if len(clear) != 16 && len(clear) != 24 && len(clear) != 32 {
+			return nil, emulatorError(ep11.CKR_WRAPPED_KEY_INVALID, "invalid AES key length %d", len(clear))
+		}
+		obj.Class, obj.KeyType, obj.Value = int64(ep11.CKO_SECRET_KEY), int64(ep11.CKK_AES), clear
+	case ep11.CKK_EC:
+		ecParams, d, err := parseEmulatorPKCS8ECKey(clear)
+		if err != nil {
+			return nil, err
+		}
+		obj.Class, obj.KeyType, obj.Params, obj.Value = int64(ep11.CKO_PRIVATE_KEY), int64(ep11.CKK_EC), ecParams, d
+	default:
+		return nil, emulatorError(ep11.CKR_TEMPLATE_INCONSISTENT, "unwrapping key type %s is not supported", keyType)
+	}
+
+	blob, err := e.seal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UnwrapKeyResponse{UnwrappedBytes: blob}, nil
+}
+
+// DeriveKey implements CKM_IBM_BTC_DERIVE for the BIP32 master key and the private and public children of private keys.
+// The checksum is the chain code, followed by the SPKI of the public key when a private key is derived.
+func (e *emulator) DeriveKey(ctx context.Context, in *pb.DeriveKeyRequest, opts ...grpc.CallOption) (*pb.DeriveKeyResponse, error) {
+	if in.Mech.GetMechanism() != util.CKM_IBM_BTC_DERIVE {
+		return nil, emulatorError(ep11.CKR_MECHANISM_INVALID, "mechanism %s is not supported by DeriveKey", in.Mech.GetMechanism())
+	}
+	parm, err := util.ParseBTCDeriveParm(in.Mech)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "%s", err)
+	}
+	if parm.ChildKeyIndex > math.MaxUint32 {
+		return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "child index %d is out of range", parm.ChildKeyIndex)
+	}
+	deriveType, index, chainCode := parm.Type, uint32(parm.ChildKeyIndex), parm.ChainCode
+	curve := btcec.S256()
+	var key, childChainCode []byte
+	switch deriveType {
+	case util.BIP32MasterKey:
+		seed, err := e.openFor(in.BaseKey, ep11.CKK_GENERIC_SECRET, ep11.CKA_DERIVE)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+		mac.Write(seed.Value)
+		sum := mac.Sum(nil)
+		key, childChainCode = sum[:32], sum[32:]
+		if k := new(big.Int).SetBytes(key); k.Sign() == 0 || k.Cmp(curve.Params().N) >= 0 {
+			return nil, emulatorError(ep11.CKR_FUNCTION_FAILED, "seed gives an invalid master key")
+		}
+	case util.BIP32PrivateToPrivate, util.BIP32PrivateToPublic:
+		parent, err := e.openFor(in.BaseKey, ep11.CKK_EC, ep11.CKA_DERIVE)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(parent.Params, emulatorSecp256k1Params()) {
+			return nil, emulatorError(ep11.CKR_KEY_TYPE_INCONSISTENT, "BIP32 requires a secp256k1 key")
+		}
+		if len(chainCode) != util.BIP32ChainCodeLength {
+			return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "chain code must be %d bytes", util.BIP32ChainCodeLength)
+		}
+		mac := hmac.New(sha512.New, chainCode)
+		if index >= util.BIP32Hardened {
+			mac.Write(append([]byte{0}, parent.Value...))
+		} else {
+			x, y := curve.ScalarBaseMult(parent.Value)
+			mac.Write(elliptic.MarshalCompressed(curve, x, y))
+		}
+		binary.Write(mac, binary.BigEndian, index)
+		sum := mac.Sum(nil)
+		tweak := new(big.Int).SetBytes(sum[:32])
+		child := new(big.Int).Add(tweak, new(big.Int).SetBytes(parent.Value))
+		child.Mod(child, curve.Params().N)
+		if tweak.Cmp(curve.Params().N) >= 0 || child.Sign() == 0 {
+			return nil, emulatorError(ep11.CKR_FUNCTION_FAILED, "child %d is invalid, use the next index", index)
+		}
+		key, childChainCode = child.FillBytes(make([]byte, 32)), sum[32:]
+	default:
+		return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "BIP32 derivation type %d is not supported", deriveType)
+	}
+
+	x, y := curve.ScalarBaseMult(key)
+	spki, err := marshalEmulatorECPublicKey(emulatorSecp256k1Params(), &ecdsa.PublicKey{Curve: curve, X: x, Y: y})
+	if err != nil {
+		return nil, err
+	}
+	if deriveType == util.BIP32PrivateToPublic {
+		return &pb.DeriveKeyResponse{NewKeyBytes: spki, CheckSum: childChainCode}, nil
+	}
+	blob, err := e.seal(&emulatorKeyObject{
+		Class:   int64(ep11.CKO_PRIVATE_KEY),
+		KeyType: int64(ep11.CKK_EC),
+		Params:  emulatorSecp256k1Params(),
+		Value:   key,
+		Denied:  deniedUsage(in.Template),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the checksum of a private key is followed by the SPKI of its public key
+	return &pb.DeriveKeyResponse{NewKeyBytes: blob, CheckSum: append(childChainCode, spki...)}, nil
+}
+
+func (e *emulator) SignSingle(ctx context.Context, in *pb.SignSingleRequest, opts ...grpc.CallOption) (*pb.SignSingleResponse, error) {
+	if in.Mech.GetMechanism() == ep11.CKM_IBM_ED25519_SHA512 {
+		key, err := e.openFor(in.PrivKey, ep11.CKK_EC, ep11.CKA_SIGN)
+		if err != nil {
+			return nil, err
+		}
+		if !isEmulatorEd25519(key.Params) || len(key.Value) != ed25519.SeedSize {
+			return nil, emulatorError(ep11.CKR_KEY_TYPE_INCONSISTENT, "CKM_IBM_ED25519_SHA512 requires an Ed25519 key")
+		}
+		return &pb.SignSingleResponse{Signature: ed25519.Sign(ed25519.NewKeyFromSeed(key.Value), in.Data)}, nil
+	}
+	if mech := in.Mech.GetMechanism(); mech == ep11.CKM_RSA_PKCS || mech == ep11.CKM_RSA_PKCS_PSS {
+		return e.signRSA(in.Mech, in.PrivKey, in.Data)
+	}
+	data, err := emulatorECDSAData(in.Mech.GetMechanism(), in.Data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.openFor(in.PrivKey, ep11.CKK_EC, ep11.CKA_SIGN)
+	if err != nil {
+		return nil, err
+	}
+	curve, err := emulatorCurve(key.Params)
+	if err != nil {
+		return nil, err
+	}
+	privateKey := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(key.Value)}
+	privateKey.Curve = curve
+	privateKey.X, privateKey.Y = curve.ScalarBaseMult(key.Value)
+
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, data)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to sign: %s", err)
+	}
+	// EP11 returns the raw r||s concatenation, each half padded to the order size
+	size := (curve.Params().N.BitLen() + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return &pb.SignSingleResponse{Signature: signature}, nil
+}
+
+func (e *emulator) VerifySingle(ctx context.Context, in *pb.VerifySingleRequest, opts ...grpc.CallOption) (*pb.VerifySingleResponse, error) {
+	if in.Mech.GetMechanism() == ep11.CKM_IBM_ED25519_SHA512 {
+		info := emulatorPublicKeyInfo{}
+		if _, err := asn1.Unmarshal(in.PubKey, &info); err != nil || !isEmulatorEd25519(info.Algorithm.Parameters.FullBytes) ||
+			len(info.PublicKey.Bytes) != ed25519.PublicKeySize {
+			return nil, emulatorError(ep11.CKR_KEY_TYPE_INCONSISTENT, "CKM_IBM_ED25519_SHA512 requires an Ed25519 public key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(info.PublicKey.Bytes), in.Data, in.Signature) {
+			return nil, emulatorError(ep11.CKR_SIGNATURE_INVALID, "signature is invalid")
+		}
+		return &pb.VerifySingleResponse{}, nil
+	}
+	if mech := in.Mech.GetMechanism(); mech == ep11.CKM_RSA_PKCS || mech == ep11.CKM_RSA_PKCS_PSS {
+		return verifyEmulatorRSA(in.Mech, in.PubKey, in.Data, in.Signature)
+	}
+	data, err := emulatorECDSAData(in.Mech.GetMechanism(), in.Data)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := parseEmulatorECPublicKey(in.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	size := (publicKey.Curve.Params().N.BitLen() + 7) / 8
+	if len(in.Signature) != 2*size {
+		return nil, emulatorError(ep11.CKR_SIGNATURE_LEN_RANGE, "signature must be %d bytes", 2*size)
+	}
+	r := new(big.Int).SetBytes(in.Signature[:size])
+	s := new(big.Int).SetBytes(in.Signature[size:])
+	if !ecdsa.Verify(publicKey, data, r, s) {
+		return nil, emulatorError(ep11.CKR_SIGNATURE_INVALID, "signature is invalid")
+	}
+	return &pb.VerifySingleResponse{}, nil
+}
+
+// Close is a no-op, the emulator holds no connections
+func (e *emulator) Close() error {
+	return nil
+}
+
+// emulatorAESCrypt runs CKM_AES_ECB, CKM_AES_CBC_PAD or CKM_AES_KEY_WRAP_PAD with a clear AES key
+func emulatorAESCrypt(mech *pb.Mechanism, key, data []byte, encrypt bool) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_KEY_SIZE_RANGE, "invalid AES key: %s", err)
+	}
+	switch mech.GetMechanism() {
+	case ep11.CKM_AES_ECB:
+		if len(data)%aes.BlockSize != 0 {
+			return nil, emulatorError(ep11.CKR_DATA_LEN_RANGE, "data length %d is not a multiple of the block size", len(data))
+		}
+		out := make([]byte, len(data))
+		for i := 0; i < len(data); i += aes.BlockSize {
+			if encrypt {
+				block.Encrypt(out[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+			} else {
+				block.Decrypt(out[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+			}
+		}
+		return out, nil
+	case ep11.CKM_AES_CBC_PAD:
+		iv := mech.GetParameterB()
+		if len(iv) != aes.BlockSize {
+			return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "CKM_AES_CBC_PAD requires a %d byte IV", aes.BlockSize)
+		}
+		if encrypt {
+			plain := pkcs7Padding(append([]byte{}, data...), aes.BlockSize)
+			out := make([]byte, len(plain))
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, plain)
+			return out, nil
+		}
+		if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+			return nil, emulatorError(ep11.CKR_ENCRYPTED_DATA_LEN_RANGE, "ciphertext length %d is not a multiple of the block size", len(data))
+		}
+		out := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+		padding := int(out[len(out)-1])
+		if padding == 0 || padding > aes.BlockSize || !bytes.Equal(out[len(out)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+			return nil, emulatorError(ep11.CKR_ENCRYPTED_DATA_INVALID, "invalid padding")
+		}
+		return out[:len(out)-padding], nil
+	case ep11.CKM_AES_KEY_WRAP_PAD:
+		// only the default alternative IV of RFC 5649 is supported
+		if len(mech.GetParameterB()) != 0 {
+			return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "CKM_AES_KEY_WRAP_PAD takes no parameter")
+		}
+		if encrypt {
+			return emulatorKeyWrapPad(block, data)
+		}
+		return emulatorKeyUnwrapPad(block, data)
+	}
+	return nil, emulatorError(ep11.CKR_MECHANISM_INVALID, "mechanism %s is not supported", mech.GetMechanism())
+}
+
+// emulatorKWPIV is the alternative initial value of RFC 5649, followed by the length of the data
+var emulatorKWPIV = []byte{0xa6, 0x59, 0x59, 0xa6}
+
+// emulatorKeyWrapPad wraps data as RFC 5649 specifies
+func emulatorKeyWrapPad(block cipher.Block, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, emulatorError(ep11.CKR_DATA_LEN_RANGE, "no data to wrap")
+	}
+	n := (len(data) + 7) / 8
+	out := make([]byte, 8*(n+1))
+	copy(out, emulatorKWPIV)
+	binary.BigEndian.PutUint32(out[4:8], uint32(len(data)))
+	copy(out[8:], data)
+	if n == 1 {
+		block.Encrypt(out, out)
+		return out, nil
+	}
+	// wrapping process of RFC 3394 with the alternative initial value
+	b := make([]byte, aes.BlockSize)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, out[:8])
+			copy(b[8:], out[8*i:8*i+8])
+			block.Encrypt(b, b)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(b[:8])^uint64(n*j+i))
+			copy(out[8*i:], b[8:])
+		}
+	}
+	return out, nil
+}
+
+// emulatorKeyUnwrapPad unwraps data wrapped by emulatorKeyWrapPad, checking its integrity
+func emulatorKeyUnwrapPad(block cipher.Block, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, emulatorError(ep11.CKR_ENCRYPTED_DATA_LEN_RANGE, "wrapped data length %d is invalid", len(wrapped))
+	}
+	n := len(wrapped)/8 - 1
+	out := append([]byte{}, wrapped...)
+	if n == 1 {
+		block.Decrypt(out, out)
+	} else {
+		b := make([]byte, aes.BlockSize)
+		for j := 5; j >= 0; j-- {
+			for i := n; i >= 1; i-- {
+				binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(out[:8])^uint64(n*j+i))
+				copy(b[8:], out[8*i:8*i+8])
+				block.Decrypt(b, b)
+				copy(out[:8], b[:8])
+				copy(out[8*i:], b[8:])
+			}
+		}
+	}
+	length := int(binary.BigEndian.Uint32(out[4:8]))
+	if !bytes.Equal(out[:4], emulatorKWPIV) || length <= 8*(n-1) || length > 8*n ||
+		!bytes.Equal(out[8+length:], make([]byte, 8*n-length)) {
+		return nil, emulatorError(ep11.CKR_ENCRYPTED_DATA_INVALID, "integrity check of wrapped data failed")
+	}
+	return out[8 : 8+length], nil
+}
+
+// emulatorCurve maps DER encoded EC parameters to a curve implementation
+func emulatorCurve(ecParams []byte) (elliptic.Curve, error) {
+	oid := asn1.ObjectIdentifier{}
+	if _, err := asn1.Unmarshal(ecParams, &oid); err != nil {
+		return nil, emulatorError(ep11.CKR_DOMAIN_PARAMS_INVALID, "invalid EC parameters: %s", err)
+	}
+	if oid.Equal(util.OIDNamedCurveSecp256k1) {
+		return btcec.S256(), nil
+	}
+	if curve := util.GetNamedCurveFromOID(oid); curve != nil {
+		return curve, nil
+	}
+	return nil, emulatorError(ep11.CKR_CURVE_NOT_SUPPORTED, "curve %s is not supported", oid)
+}
+
+// emulatorECDSAData returns what ECDSA signs for CKM_ECDSA, the data itself, or for the CKM_ECDSA_SHA* mechanisms its hash
+func emulatorECDSAData(mech ep11.Mechanism, data []byte) ([]byte, error) {
+	var digest []byte
+	switch mech {
+	case ep11.CKM_ECDSA:
+		return data, nil
+	case ep11.CKM_ECDSA_SHA256:
+		d := sha256.Sum256(data)
+		digest = d[:]
+	case ep11.CKM_ECDSA_SHA384:
+		d := sha512.Sum384(data)
+		digest = d[:]
+	case ep11.CKM_ECDSA_SHA512:
+		d := sha512.Sum512(data)
+		digest = d[:]
+	default:
+		return nil, emulatorError(ep11.CKR_MECHANISM_INVALID, "mechanism %s is not supported", mech)
+	}
+	return digest, nil
+}
+
+// emulatorSecp256k1Params are the DER encoded EC parameters of secp256k1
+func emulatorSecp256k1Params() []byte {
+	ecParams, _ := asn1.Marshal(util.OIDNamedCurveSecp256k1)
+	return ecParams
+}
+
+// isEmulatorEd25519 tells if DER encoded EC parameters name Ed25519
+func isEmulatorEd25519(ecParams []byte) bool {
+	oid := asn1.ObjectIdentifier{}
+	_, err := asn1.Unmarshal(ecParams, &oid)
+	return err == nil && oid.Equal(util.OIDNamedCurveED25519)
+}
+
+// generateEd25519KeyPair seals the seed of a new Ed25519 key, the public key is an EC SPKI
+// with the Ed25519 OID as curve and the 32 bytes key as point, like EP11 returns it
+func (e *emulator) generateEd25519KeyPair(ecParams []byte, privateKeyTemplate map[ep11.Attribute]*pb.AttributeValue) (*pb.GenerateKeyPairResponse, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to generate Ed25519 key: %s", err)
+	}
+	spki, err := asn1.Marshal(emulatorPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  util.OIDECPublicKey,
+			Parameters: asn1.RawValue{FullBytes: ecParams},
+		},
+		PublicKey: asn1.BitString{Bytes: publicKey, BitLength: 8 * len(publicKey)},
+	})
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to encode public key: %s", err)
+	}
+	blob, err := e.seal(&emulatorKeyObject{
+		Class:   int64(ep11.CKO_PRIVATE_KEY),
+		KeyType: int64(ep11.CKK_EC),
+		Params:  ecParams,
+		Value:   privateKey.Seed(),
+		Denied:  deniedUsage(privateKeyTemplate),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GenerateKeyPairResponse{PubKeyBytes: spki, PrivKeyBytes: blob}, nil
+}
+
+// emulatorPublicKeyInfo is the SubjectPublicKeyInfo structure EP11 returns for public keys
+type emulatorPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+func marshalEmulatorECPublicKey(ecParams []byte, publicKey *ecdsa.PublicKey) ([]byte, error) {
+	point := elliptic.Marshal(publicKey.Curve, publicKey.X, publicKey.Y)
+	spki, err := asn1.Marshal(emulatorPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  util.OIDECPublicKey,
+			Parameters: asn1.RawValue{FullBytes: ecParams},
+		},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to encode public key: %s", err)
+	}
+	return spki, nil
+}
+
+func parseEmulatorECPublicKey(spki []byte) (*ecdsa.PublicKey, error) {
+	info := emulatorPublicKeyInfo{}
+	if _, err := asn1.Unmarshal(spki, &info); err != nil {
+		return nil, emulatorError(ep11.CKR_KEY_HANDLE_INVALID, "invalid public key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(util.OIDECPublicKey) {
+		return nil, emulatorError(ep11.CKR_KEY_TYPE_INCONSISTENT, "public key algorithm %s is not EC", info.Algorithm.Algorithm)
+	}
+	curve, err := emulatorCurve(info.Algorithm.Parameters.FullBytes)
+	if err != nil {
+		return nil, err
+	}
+	x, y := elliptic.Unmarshal(curve, info.PublicKey.Bytes)
+	if x == nil {
+		return nil, emulatorError(ep11.CKR_KEY_HANDLE_INVALID, "public key point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// parseEmulatorPKCS8ECKey extracts the curve parameters and private scalar from a PKCS#8 EC key.
+// x509.ParsePKCS8PrivateKey is not used since it rejects secp256k1.
+func parseEmulatorPKCS8ECKey(der []byte) (ecParams, d []byte, err error) {
+	var pkcs8 struct {
+		Version    int
+		Algorithm  pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}
+	var ecKey struct {
+		Version    int
+		PrivateKey []byte
+		Curve      asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+		PublicKey  asn1.BitString        `asn1:"optional,explicit,tag:1"`
+	}
+	if _, err := asn1.Unmarshal(der, &pkcs8); err != nil {
+		return nil, nil, emulatorError(ep11.CKR_WRAPPED_KEY_INVALID, "invalid PKCS#8 key: %s", err)
+	}
+	if !pkcs8.Algorithm.Algorithm.Equal(util.OIDECPublicKey) {
+		return nil, nil, emulatorError(ep11.CKR_WRAPPED_KEY_INVALID, "PKCS#8 key algorithm %s is not EC", pkcs8.Algorithm.Algorithm)
+	}
+	if _, err := asn1.Unmarshal(pkcs8.PrivateKey, &ecKey); err != nil {
+		return nil, nil, emulatorError(ep11.CKR_WRAPPED_KEY_INVALID, "invalid EC private key: %s", err)
+	}
+	ecParams = pkcs8.Algorithm.Parameters.FullBytes
+	curve, err := emulatorCurve(ecParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := (curve.Params().N.BitLen() + 7) / 8
+	if len(ecKey.PrivateKey) > size {
+		return nil, nil, emulatorError(ep11.CKR_WRAPPED_KEY_INVALID, "EC private key is too long")
+	}
+	return ecParams, new(big.Int).SetBytes(ecKey.PrivateKey).FillBytes(make([]byte, size)), nil
+}
+
+// generateRSAKeyPair seals the PKCS#1 DER of a new RSA key, the public key is a PKIX SPKI
+func (e *emulator) generateRSAKeyPair(publicKeyTemplate, privateKeyTemplate map[ep11.Attribute]*pb.AttributeValue) (*pb.GenerateKeyPairResponse, error) {
+	bits := int(publicKeyTemplate[ep11.CKA_MODULUS_BITS].GetAttributeI())
+	if info := emulatorMechanisms[ep11.CKM_RSA_PKCS_KEY_PAIR_GEN]; bits < int(info.MinKeySize) || bits > int(info.MaxKeySize) {
+		return nil, emulatorError(ep11.CKR_KEY_SIZE_RANGE, "CKA_MODULUS_BITS %d is out of range", bits)
+	}
+	// crypto/rsa always generates keys with the exponent 65537
+	if exponent, ok := publicKeyTemplate[ep11.CKA_PUBLIC_EXPONENT]; ok && exponent.GetAttributeI() != 65537 {
+		return nil, emulatorError(ep11.CKR_TEMPLATE_INCONSISTENT, "only the public exponent 65537 is supported")
+	}
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to generate RSA key: %s", err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_GENERAL_ERROR, "failed to encode public key: %s", err)
+	}
+	blob, err := e.seal(&emulatorKeyObject{
+		Class:   int64(ep11.CKO_PRIVATE_KEY),
+		KeyType: int64(ep11.CKK_RSA),
+		Value:   x509.MarshalPKCS1PrivateKey(privateKey),
+		Denied:  deniedUsage(privateKeyTemplate),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GenerateKeyPairResponse{PubKeyBytes: spki, PrivKeyBytes: blob}, nil
+}
+
+// signRSA runs CKM_RSA_PKCS over a DigestInfo, or CKM_RSA_PKCS_PSS over a digest
+func (e *emulator) signRSA(mech *pb.Mechanism, blob, data []byte) (*pb.SignSingleResponse, error) {
+	key, err := e.openFor(blob, ep11.CKK_RSA, ep11.CKA_SIGN)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(key.Value)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_KEY_HANDLE_INVALID, "invalid RSA key: %s", err)
+	}
+	var signature []byte
+	if mech.GetMechanism() == ep11.CKM_RSA_PKCS {
+		// hash 0 signs the data as is, callers pass the encoded DigestInfo
+		signature, err = rsa.SignPKCS1v15(rand.Reader, privateKey, 0, data)
+	} else {
+		var pssOpts *rsa.PSSOptions
+		if pssOpts, err = emulatorPSSOptions(mech, data); err != nil {
+			return nil, err
+		}
+		signature, err = rsa.SignPSS(rand.Reader, privateKey, pssOpts.Hash, data, pssOpts)
+	}
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_DATA_LEN_RANGE, "failed to sign: %s", err)
+	}
+	return &pb.SignSingleResponse{Signature: signature}, nil
+}
+
+func verifyEmulatorRSA(mech *pb.Mechanism, spki, data, signature []byte) (*pb.VerifySingleResponse, error) {
+	parsed, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_KEY_HANDLE_INVALID, "invalid public key: %s", err)
+	}
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, emulatorError(ep11.CKR_KEY_TYPE_INCONSISTENT, "%s requires an RSA public key", mech.GetMechanism())
+	}
+	if len(signature) != publicKey.Size() {
+		return nil, emulatorError(ep11.CKR_SIGNATURE_LEN_RANGE, "signature must be %d bytes", publicKey.Size())
+	}
+	if mech.GetMechanism() == ep11.CKM_RSA_PKCS {
+		err = rsa.VerifyPKCS1v15(publicKey, 0, data, signature)
+	} else {
+		var pssOpts *rsa.PSSOptions
+		if pssOpts, err = emulatorPSSOptions(mech, data); err != nil {
+			return nil, err
+		}
+		err = rsa.VerifyPSS(publicKey, pssOpts.Hash, data, signature, pssOpts)
+	}
+	if err != nil {
+		return nil, emulatorError(ep11.CKR_SIGNATURE_INVALID, "signature is invalid")
+	}
+	return &pb.VerifySingleResponse{}, nil
+}
+
+// emulatorPSSOptions reads the CKM_RSA_PKCS_PSS parameter, MGF1 has to use the same hash as the digest
+func emulatorPSSOptions(mech *pb.Mechanism, digest []byte) (*rsa.PSSOptions, error) {
+	parm := mech.GetRSAPSSParameter()
+	if parm == nil {
+		return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "CKM_RSA_PKCS_PSS requires an RSA PSS parameter")
+	}
+	hash := util.RSAHashFromMechanism(parm.HashMech)
+	if hash == 0 {
+		return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "hash %s is not supported", parm.HashMech)
+	}
+	if parm.Mgf != util.RSAMGF(hash) {
+		return nil, emulatorError(ep11.CKR_MECHANISM_PARAM_INVALID, "MGF %s does not match hash %s", parm.Mgf, parm.HashMech)
+	}
+	if len(digest) != hash.Size() {
+		return nil, emulatorError(ep11.CKR_DATA_LEN_RANGE, "digest must be %d bytes", hash.Size())
+	}
+	return &rsa.PSSOptions{SaltLength: int(parm.SaltByteCount), Hash: hash}, nil
+}
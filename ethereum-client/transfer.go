@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"math/big"
@@ -10,8 +10,6 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/crypto/secp256k1"
 	"github.com/ethereum/go-ethereum/ethclient"
 	resty "github.com/go-resty/resty/v2"
 	log "github.com/sirupsen/logrus"
@@ -25,8 +23,18 @@ func main() {
 	}
 	log.WithField("config", config).Info("load config success.")
 
-	// Create a rest Client to call signing server
+	// Create a rest Client to call signing server, over HTTPS once it serves TLS
 	restClient := resty.New()
+	if config.SigningServerCaCert != "" {
+		restClient.SetRootCertificate(config.SigningServerCaCert)
+	}
+	if config.SigningServerClientCert != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.SigningServerClientCert, config.SigningServerClientKey)
+		if err != nil {
+			log.WithError(err).Fatal("fail to load client certificate")
+		}
+		restClient.SetCertificates(clientCert)
+	}
 
 	// get public key and address
 	getPublicKeyResponseBody := &struct {
@@ -34,7 +42,7 @@ func main() {
 		Address           string
 	}{}
 
-	getPublicKeyendpoint := fmt.Sprintf("http://%s:%s:/v1/grep11/key/secp256k1/get_ethereum_key/%s", config.SigningServerAddress, config.SigningServerPort, config.KeyUUID)
+	getPublicKeyendpoint := fmt.Sprintf("%s://%s:%s/v1/grep11/key/secp256k1/get_ethereum_key/%s", config.SigningServerScheme, config.SigningServerAddress, config.SigningServerPort, config.KeyUUID)
 	log.WithField("endpoint", getPublicKeyendpoint).Info("start call signing server to get public address")
 
 	_, err = restClient.R().EnableTrace().SetResult(getPublicKeyResponseBody).Get(getPublicKeyendpoint)
@@ -49,19 +57,8 @@ func main() {
 		log.WithField("ethereum endpoint", config.EthClient).WithError(err).Fatal("fail to connect ethereum")
 	}
 
-	pubString := getPublicKeyResponseBody.EthereumPublicKey
-	pubByte, err := hexutil.Decode(pubString)
-	if err != nil {
-		log.WithError(err).Fatal("fail to decode public key")
-	}
-
-	publickey, err := crypto.UnmarshalPubkey(pubByte)
-	if err != nil {
-		log.WithError(err).Fatal("fail to unmarshal public key")
-	}
-
-	fromAddress := crypto.PubkeyToAddress(*publickey)
-	log.WithField("from address", fromAddress).Info("extract from address from public key")
+	fromAddress := common.HexToAddress(getPublicKeyResponseBody.Address)
+	log.WithField("from address", fromAddress).Info("extract from address from signing server")
 
 	nonce, err := client.PendingNonceAt(context.Background(), fromAddress)
 	if err != nil {
@@ -71,52 +68,60 @@ func main() {
 
 	value := big.NewInt(int64(config.Value * 1000000000000000000)) // in wei (0.001 eth)
 	gasLimit := uint64(21000)                                      // in units
-	gasPrice, err := client.SuggestGasPrice(context.Background())
+	// EIP-1559: tip from the node suggestion, fee cap leaves room for the base fee to double
+	gasTipCap, err := client.SuggestGasTipCap(context.Background())
+	if err != nil {
+		log.WithError(err).Fatal("fail to get gas tip cap")
+	}
+	head, err := client.HeaderByNumber(context.Background(), nil)
 	if err != nil {
-		log.WithError(err).Fatal("fail to get gas price")
+		log.WithError(err).Fatal("fail to get latest block header")
 	}
+	gasFeeCap := new(big.Int).Add(gasTipCap, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
 	toAddress := common.HexToAddress(config.ToAddress)
-	var data []byte
-	log.WithField("nonce", nonce).WithField("to_address", toAddress).WithField("value", value).WithField("gas_price", gasPrice).WithField("gas_limit", gasLimit).Info("start a new transaction")
-	tx := types.NewTransaction(nonce, toAddress, value, gasLimit, gasPrice, data)
 
 	chainID, err := client.NetworkID(context.Background())
 	if err != nil {
 		log.WithError(err).Fatal("fail to get chain ID")
 	}
 	log.WithField("chain_id", chainID).Info("chain_id")
-
-	signer := types.NewEIP155Signer(chainID)
-	hs := signer.Hash(tx)
-
-	// sign by signing server
-	sigResponse := &struct {
-		Uuid      string `json:"uuid"`
-		Action    string `json:"action"`
-		Signature string `json:"signature"`
+	log.WithField("nonce", nonce).WithField("to_address", toAddress).WithField("value", value).WithField("max_fee_per_gas", gasFeeCap).WithField("max_priority_fee_per_gas", gasTipCap).WithField("gas_limit", gasLimit).Info("start a new transaction")
+
+	// hash, sign, low-S normalization and recovery id are all done by signing server
+	signTxResponse := &struct {
+		Uuid           string `json:"uuid"`
+		From           string `json:"from"`
+		RawTransaction string `json:"raw_transaction"`
+		TxHash         string `json:"tx_hash"`
 	}{}
 
-	signEndpoint := fmt.Sprintf("http://%s:%s:/v1/grep11/key/secp256k1/sign/%s", config.SigningServerAddress, config.SigningServerPort, config.KeyUUID)
-	log.WithField("endpoint", getPublicKeyendpoint).Info("start call signing server to sign")
-	_, err = restClient.R().EnableTrace().SetResult(sigResponse).SetBody(map[string]interface{}{"data": toString(hs.Bytes())}).Post(signEndpoint)
+	signEndpoint := fmt.Sprintf("%s://%s:%s/v1/grep11/key/secp256k1/sign_transaction/%s", config.SigningServerScheme, config.SigningServerAddress, config.SigningServerPort, config.KeyUUID)
+	log.WithField("endpoint", signEndpoint).Info("start call signing server to sign transaction")
+	resp, err := restClient.R().EnableTrace().SetResult(signTxResponse).SetBody(map[string]interface{}{
+		"type":                 types.DynamicFeeTxType,
+		"nonce":                nonce,
+		"to":                   toAddress.Hex(),
+		"value":                value.String(),
+		"gas":                  gasLimit,
+		"maxFeePerGas":         gasFeeCap.String(),
+		"maxPriorityFeePerGas": gasTipCap.String(),
+		"chainId":              chainID.String(),
+	}).Post(signEndpoint)
 	if err != nil {
-		log.WithError(err).Fatal("fail to call signing server to sign")
+		log.WithError(err).Fatal("fail to call signing server to sign transaction")
 	}
+	if resp.IsError() {
+		log.WithField("status", resp.Status()).WithField("body", resp.String()).Fatal("signing server fail to sign transaction")
+	}
+	log.WithField("tx_hash", signTxResponse.TxHash).WithField("raw_transaction", signTxResponse.RawTransaction).Info("sign by HPCS")
 
-	sig := toByte(sigResponse.Signature)
-	r := new(big.Int).SetBytes(sig[:32])
-	s := new(big.Int).SetBytes(sig[32:64])
-
-	sig2 := LocalChange(r, s)
-	log.WithField("public_key_len", len(pubByte)).WithField("signature_len", len(sig2)).WithField("signature", toString(sig2)).Info("sign by HPCS")
-
-	signatureNoRecoverID := sig2[:len(sig2)-1] // remove recovery id
-	localVerifyResult := crypto.VerifySignature(pubByte, hs.Bytes(), signatureNoRecoverID)
-	log.WithField("result", localVerifyResult).Info("local verify result")
-
-	signedTx, err := tx.WithSignature(signer, sig2)
+	rawTx, err := hexutil.Decode(signTxResponse.RawTransaction)
 	if err != nil {
-		log.WithError(err).Fatal("failed to sign ")
+		log.WithError(err).Fatal("fail to decode raw transaction")
+	}
+	signedTx := new(types.Transaction)
+	if err := signedTx.UnmarshalBinary(rawTx); err != nil {
+		log.WithError(err).Fatal("fail to unmarshal raw transaction")
 	}
 
 	err = client.SendTransaction(context.Background(), signedTx)
@@ -127,46 +132,6 @@ func main() {
 	fmt.Printf("		https://rinkeby.etherscan.io/tx/%s \n", signedTx.Hash().Hex())
 }
 
-func toString(src []byte) string {
-	return base64.RawStdEncoding.EncodeToString(src)
-}
-
-func toByte(src string) []byte {
-	result, _ := base64.RawStdEncoding.DecodeString(src)
-	return result
-}
-
-func LocalChange(R, S *big.Int) []byte {
-	sig := make([]byte, 65)
-
-	denTwo := big.NewInt(2)
-	rightS := big.NewInt(0)
-	curve := secp256k1.S256()
-
-	/*
-		URL: https://github.com/ethereum/EIPs/blob/master/EIPS/eip-2.md
-		All transaction signatures whose s-value is greater than secp256k1n/2 are now considered invalid.
-		The ECDSA recover precompiled contract remains unchanged and will keep accepting high s-values; this is useful
-		e.g. if a contract recovers old Bitcoin signatures.
-	*/
-	rightS = rightS.Div(curve.Params().N, denTwo)
-
-	if rightS.Cmp(S) == -1 {
-		S = S.Sub(curve.Params().N, S)
-		log.Println("S: ", S.String())
-		rbytes, sbytes := R.Bytes(), S.Bytes()
-		copy(sig[32-len(rbytes):32], rbytes)
-		copy(sig[64-len(sbytes):64], sbytes)
-		//	log.Println("Result : ", verifyECRecover(hash.Bytes(), sig, expectedPubKey))
-	} else {
-		rbytes, sbytes := R.Bytes(), S.Bytes()
-		copy(sig[32-len(rbytes):32], rbytes)
-		copy(sig[64-len(sbytes):64], sbytes)
-		//	log.Println("Else Result : ", verifyECRecover(hash.Bytes(), sig, expectedPubKey))
-	}
-	return sig
-}
-
 type Config struct {
 	EthClient              string
 	KeyUUID                string
@@ -175,6 +140,12 @@ type Config struct {
 	SigningServerPort      string
 	SIGNING_SERVER_ADDRESS string
 	Value                  float32
+	// http, or https when the signing server is started with TLS_KEY_ID
+	SigningServerScheme string `envconfig:"default=http"`
+	// PEM CA certificate of the signing server, and the client certificate and key when it requires one
+	SigningServerCaCert     string `envconfig:"optional"`
+	SigningServerClientCert string `envconfig:"optional"`
+	SigningServerClientKey  string `envconfig:"optional"`
 }
 
 func (c *Config) String() string {
@@ -187,5 +158,8 @@ func loadConfigFromEnv() (*Config, error) {
 	if err := envconfig.Init(&config); err != nil {
 		return nil, err
 	}
+	if config.SigningServerScheme != "http" && config.SigningServerScheme != "https" {
+		return nil, fmt.Errorf("SIGNING_SERVER_SCHEME must be http or https, got %q", config.SigningServerScheme)
+	}
 	return config, nil
 }
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"signing_server/util"
+)
+
+// SignTransactionBody is an unsigned ethereum transaction,
+// quantities are decimal or 0x prefixed hex strings, data is 0x prefixed hex.
+// Type is 0 (legacy, default), 1 (EIP-2930 access list) or 2 (EIP-1559 dynamic fee):
+// legacy and access list transactions use gasPrice, dynamic fee transactions use
+// maxFeePerGas and maxPriorityFeePerGas.
+type SignTransactionBody struct {
+	Type                 uint8            `json:"type"`
+	Nonce                uint64           `json:"nonce"`
+	To                   string           `json:"to"`
+	Value                string           `json:"value"`
+	Gas                  uint64           `json:"gas"`
+	GasPrice             string           `json:"gasPrice"`
+	MaxFeePerGas         string           `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas string           `json:"maxPriorityFeePerGas"`
+	AccessList           types.AccessList `json:"accessList"`
+	Data                 string           `json:"data"`
+	ChainID              string           `json:"chainId"`
+}
+
+// toTransaction builds the transaction described by the request body
+func (b *SignTransactionBody) toTransaction() (*types.Transaction, *big.Int, error) {
+	chainID, err := parseBigInt("chainId", b.ChainID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if chainID.Sign() <= 0 {
+		return nil, nil, fmt.Errorf("invalid chainId %q", b.ChainID)
+	}
+	value, err := parseBigInt("value", b.Value, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	var data []byte
+	if b.Data != "" {
+		if data, err = hexutil.Decode(b.Data); err != nil {
+			return nil, nil, fmt.Errorf("invalid data: %s", err)
+		}
+	}
+	// an empty to address creates a contract
+	var to *common.Address
+	if b.To != "" {
+		if !common.IsHexAddress(b.To) {
+			return nil, nil, fmt.Errorf("invalid to address %q", b.To)
+		}
+		address := common.HexToAddress(b.To)
+		to = &address
+	}
+
+	switch b.Type {
+	case types.LegacyTxType, types.AccessListTxType:
+		gasPrice, err := parseBigInt("gasPrice", b.GasPrice, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		if b.Type == types.LegacyTxType {
+			if len(b.AccessList) > 0 {
+				return nil, nil, fmt.Errorf("accessList is not allowed in a legacy transaction")
+			}
+			return types.NewTx(&types.LegacyTx{
+				Nonce:    b.Nonce,
+				To:       to,
+				Value:    value,
+				Gas:      b.Gas,
+				GasPrice: gasPrice,
+				Data:     data,
+			}), chainID, nil
+		}
+		return types.NewTx(&types.AccessListTx{
+			ChainID:    chainID,
+			Nonce:      b.Nonce,
+			To:         to,
+			Value:      value,
+			Gas:        b.Gas,
+			GasPrice:   gasPrice,
+			Data:       data,
+			AccessList: b.AccessList,
+		}), chainID, nil
+	case types.DynamicFeeTxType:
+		gasFeeCap, err := parseBigInt("maxFeePerGas", b.MaxFeePerGas, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		gasTipCap, err := parseBigInt("maxPriorityFeePerGas", b.MaxPriorityFeePerGas, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		if gasTipCap.Cmp(gasFeeCap) > 0 {
+			return nil, nil, fmt.Errorf("maxPriorityFeePerGas is higher than maxFeePerGas")
+		}
+		return types.NewTx(&types.DynamicFeeTx{
+			ChainID:    chainID,
+			Nonce:      b.Nonce,
+			To:         to,
+			Value:      value,
+			Gas:        b.Gas,
+			GasFeeCap:  gasFeeCap,
+			GasTipCap:  gasTipCap,
+			Data:       data,
+			AccessList: b.AccessList,
+		}), chainID, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported transaction type %d", b.Type)
+}
+
+// parseBigInt parses a decimal or 0x prefixed hex quantity, an optional empty value is 0
+func parseBigInt(name, value string, required bool) (*big.Int, error) {
+	if value == "" {
+		if required {
+			return nil, fmt.Errorf("%s is required", name)
+		}
+		return new(big.Int), nil
+	}
+	result, ok := math.ParseBig256(value)
+	if !ok {
+		return nil, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return result, nil
+}
+
+// sign an ethereum transaction with the secp256k1 key, return the signed raw transaction,
+// which is the RLP encoding for legacy transactions and the typed envelope otherwise
+func signTransaction(ctx *gin.Context) {
+	requestBody := SignTransactionBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	tx, chainID, err := requestBody.toTransaction()
+	if err != nil {
+		log.WithError(err).Error("invalid transaction")
+		ctx.AbortWithError(400, err)
+		return
+	}
+
+	keyUUID := ctx.Param("id")
+	keystore, err := getUsableKeyAt(keyUUID, ctx.Query("path"), KeyAlgorithmECDSA, KeyUsageSign)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	if keystore.Curve != CurveSecp256k1 {
+		ctx.AbortWithError(400, fmt.Errorf("key %s is not a secp256k1 key", keystore.Uuid))
+		return
+	}
+	log.WithField("key_uuid", keyUUID).WithField("type", tx.Type()).WithField("nonce", tx.Nonce()).WithField("to", tx.To()).WithField("chain_id", chainID).Info("start sign transaction")
+
+	signedTx, from, err := signEthereumTransaction(keystore, tx, chainID)
+	if err != nil {
+		log.WithError(err).Error("failed to sign transaction")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	rawTx, err := signedTx.MarshalBinary()
+	if err != nil {
+		log.WithError(err).Error("failed to encode transaction")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	log.WithField("key_uuid", keyUUID).WithField("tx_hash", signedTx.Hash().Hex()).Info("transaction signed")
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":            keystore.Uuid,
+		"action":          "sign_transaction",
+		"type":            signedTx.Type(),
+		"from":            from.Hex(),
+		"raw_transaction": hexutil.Encode(rawTx),
+		"tx_hash":         signedTx.Hash().Hex(),
+	})
+}
+
+// signEthereumTransaction signs a transaction with the secp256k1 key, returns the signed transaction and the sender
+func signEthereumTransaction(keystore *KeyStore, tx *types.Transaction, chainID *big.Int) (*types.Transaction, common.Address, error) {
+	// the london signer computes the EIP-155 hash for legacy transactions and the
+	// EIP-2718 typed hash for access list and dynamic fee transactions
+	signer := types.NewLondonSigner(chainID)
+	ethSig, from, err := signEthereumHash(keystore, signer.Hash(tx).Bytes())
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	signedTx, err := tx.WithSignature(signer, ethSig)
+	if err != nil {
+		return nil, common.Address{}, fmt.Errorf("failed to attach signature: %s", err)
+	}
+	return signedTx, from, nil
+}
+
+// signEthereumHash signs a 32 bytes hash with the secp256k1 key, returns the r||s||v
+// signature (v is 0 or 1) and the address of the key
+func signEthereumHash(keystore *KeyStore, hash []byte) ([]byte, common.Address, error) {
+	if keystore.Curve != CurveSecp256k1 {
+		return nil, common.Address{}, fmt.Errorf("key %s is not a secp256k1 key", keystore.Uuid)
+	}
+	_, publicKey, err := Convert(toByte(keystore.PublicKey), util.OIDNamedCurveSecp256k1)
+	if err != nil {
+		return nil, common.Address{}, fmt.Errorf("fail to convert public key: %s", err)
+	}
+	privateKey, err := unwrapPrivateKey(keystore)
+	if err != nil {
+		return nil, common.Address{}, fmt.Errorf("failed to decrypt private key: %s", err)
+	}
+	sig, err := signEC(privateKey, hash)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	// EIP-2: s must be in the lower half of the curve order
+	if sig, err = util.NormalizeLowS(sig, publicKey); err != nil {
+		return nil, common.Address{}, err
+	}
+	ethSig, err := util.RecoverableSignature(sig, hash, publicKey)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	return ethSig, crypto.PubkeyToAddress(*publicKey), nil
+}
+
+// ethereumAddress derives the ethereum address of a base64 SPKI public key, empty if it is not a secp256k1 key
+func ethereumAddress(publicKey string) string {
+	spki := toByte(publicKey)
+	if curve, _, err := ecPublicKeyCurve(spki); err != nil || curve != CurveSecp256k1 {
+		return ""
+	}
+	_, ecPublicKey, err := Convert(spki, util.OIDNamedCurveSecp256k1)
+	if err != nil {
+		return ""
+	}
+	return crypto.PubkeyToAddress(*ecPublicKey).Hex()
+}
+
+// PersonalSignBody is an EIP-191 message, either UTF-8 text in message or 0x prefixed hex bytes in data
+type PersonalSignBody struct {
+	Message string `json:"message"`
+	Data    string `json:"data"`
+}
+
+// sign a message with the "\x19Ethereum Signed Message:\n" prefix, like personal_sign / eth_sign
+func personalSign(ctx *gin.Context) {
+	requestBody := PersonalSignBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	message := []byte(requestBody.Message)
+	if requestBody.Data != "" {
+		if requestBody.Message != "" {
+			ctx.AbortWithError(400, fmt.Errorf("only one of message and data can be set"))
+			return
+		}
+		data, err := hexutil.Decode(requestBody.Data)
+		if err != nil {
+			ctx.AbortWithError(400, fmt.Errorf("invalid data: %s", err))
+			return
+		}
+		message = data
+	}
+	signEthereumMessage(ctx, "personal_sign", accounts.TextHash(message))
+}
+
+// sign EIP-712 typed data, the body is the {types, primaryType, domain, message} payload of eth_signTypedData_v4
+func signTypedData(ctx *gin.Context) {
+	typedData := apitypes.TypedData{}
+	if err := ctx.BindJSON(&typedData); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	hash, _, err := apitypes.TypedDataAndHash(typedData)
+	if err != nil {
+		log.WithError(err).Error("invalid typed data")
+		ctx.AbortWithError(400, err)
+		return
+	}
+	signEthereumMessage(ctx, "sign_typed_data", hash)
+}
+
+// signEthereumMessage signs the hash of an off-chain message and responds with the 65 bytes
+// r||s||v signature, v is 27 or 28 as expected by ecrecover and wallets
+func signEthereumMessage(ctx *gin.Context, action string, hash []byte) {
+	keyUUID := ctx.Param("id")
+	keystore, err := getUsableKeyAt(keyUUID, ctx.Query("path"), KeyAlgorithmECDSA, KeyUsageSign)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	if keystore.Curve != CurveSecp256k1 {
+		ctx.AbortWithError(400, fmt.Errorf("key %s is not a secp256k1 key", keystore.Uuid))
+		return
+	}
+	log.WithField("key_uuid", keyUUID).WithField("action", action).WithField("hash", hexutil.Encode(hash)).Info("start sign message")
+
+	sig, address, err := signEthereumHash(keystore, hash)
+	if err != nil {
+		log.WithError(err).Error("failed to sign message")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":      keystore.Uuid,
+		"action":    action,
+		"address":   address.Hex(),
+		"hash":      hexutil.Encode(hash),
+		"signature": hexutil.Encode(sig),
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// example transaction of EIP-155
+func TestSignTransactionEIP155(t *testing.T) {
+	r := testRouter()
+	id := importTestKey(t, "4646464646464646464646464646464646464646464646464646464646464646")
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/sign_transaction/"+id, map[string]interface{}{
+		"type":     0,
+		"nonce":    9,
+		"gasPrice": "20000000000",
+		"gas":      21000,
+		"to":       "0x3535353535353535353535353535353535353535",
+		"value":    "1000000000000000000",
+		"chainId":  "1",
+	})
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	if m["from"] != "0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F" {
+		t.Fatalf("from %s", m["from"])
+	}
+	raw, err := hexutil.Decode(m["raw_transaction"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	signer := types.NewEIP155Signer(tx.ChainId())
+	if hash := signer.Hash(tx).Hex(); hash != "0xdaf5a779ae972f972197303d7b574746c7ef83eadac0f2791ad23db92e4c8e53" {
+		t.Fatalf("signing hash %s", hash)
+	}
+	v, _, s := tx.RawSignatureValues()
+	if v.Uint64() != 37 && v.Uint64() != 38 {
+		t.Fatalf("v %d", v)
+	}
+	if s.Cmp(secp256k1HalfN) > 0 {
+		t.Fatal("high s")
+	}
+	if from, err := types.Sender(signer, tx); err != nil || from.Hex() != m["from"] {
+		t.Fatal(from.Hex(), err)
+	}
+}
+
+// Mail example of EIP-712, signed by the key of cow
+func TestSignTypedDataEIP712(t *testing.T) {
+	r := testRouter()
+	id := importTestKey(t, crypto.Keccak256Hash([]byte("cow")).Hex()[2:])
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/sign_typed_data/"+id, `{
+		"types": {
+			"EIP712Domain": [
+				{"name": "name", "type": "string"},
+				{"name": "version", "type": "string"},
+				{"name": "chainId", "type": "uint256"},
+				{"name": "verifyingContract", "type": "address"}
+			],
+			"Person": [
+				{"name": "name", "type": "string"},
+				{"name": "wallet", "type": "address"}
+			],
+			"Mail": [
+				{"name": "from", "type": "Person"},
+				{"name": "to", "type": "Person"},
+				{"name": "contents", "type": "string"}
+			]
+		},
+		"primaryType": "Mail",
+		"domain": {
+			"name": "Ether Mail",
+			"version": "1",
+			"chainId": "1",
+			"verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+		},
+		"message": {
+			"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+			"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+			"contents": "Hello, Bob!"
+		}
+	}`)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	if m["hash"] != "0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2" {
+		t.Fatalf("hash %s", m["hash"])
+	}
+	if m["address"] != "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826" {
+		t.Fatalf("address %s", m["address"])
+	}
+	sig := hexutil.MustDecode(m["signature"].(string))
+	if sig[64] != 27 && sig[64] != 28 {
+		t.Fatalf("v %d", sig[64])
+	}
+	sig[64] -= 27
+	pub, err := crypto.SigToPub(hexutil.MustDecode(m["hash"].(string)), sig)
+	if err != nil || crypto.PubkeyToAddress(*pub).Hex() != m["address"] {
+		t.Fatal("signature does not recover the address", err)
+	}
+}
+
+// ethereum signatures are low-S and their recovery id gives back the key
+func TestSignRecoverable(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/generate_key_pair", "")
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	code, m = doJSON(t, r, "GET", "/v1/grep11/key/secp256k1/get_ethereum_key/"+id, nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	address := m["address"]
+	// the taproot address is untweaked, it is only named after rawtr(KEY)
+	if _, ok := m["rawtr_address"]; !ok || m["p2tr_address"] != nil {
+		t.Fatal(m)
+	}
+	// about half of the signatures of HPCS are high-S, several rounds check both recovery ids
+	for i := 0; i < 16; i++ {
+		digest := crypto.Keccak256([]byte{byte(i)})
+		code, m = doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/sign/"+id, map[string]string{"mode": "digest", "data": toString(digest), "sig_format": "ethereum"})
+		if code != 200 {
+			t.Fatal(code, m)
+		}
+		sig := toByte(m["signature"].(string))
+		if len(sig) != 65 || !isLowS(sig) || (sig[64] != 27 && sig[64] != 28) {
+			t.Fatalf("signature %x", sig)
+		}
+		sig[64] -= 27
+		pub, err := crypto.SigToPub(digest, sig)
+		if err != nil || crypto.PubkeyToAddress(*pub).Hex() != address {
+			t.Fatalf("recovery id %d does not recover the key: %v", sig[64], err)
+		}
+	}
+}
+
+// an ethereum public key is checked with a signature of the key over data read as the required mode says
+func TestVerifyEthereumPubKey(t *testing.T) {
+	r := testRouter()
+	id := importTestKey(t, "4646464646464646464646464646464646464646464646464646464646464646")
+	key, _ := crypto.HexToECDSA("4646464646464646464646464646464646464646464646464646464646464646")
+	other, _ := crypto.GenerateKey()
+	data := toString([]byte("hello"))
+	for _, c := range []struct {
+		body   map[string]string
+		code   int
+		result bool
+	}{
+		{map[string]string{"data": data}, 400, false},
+		{map[string]string{"data": data, "mode": "digest"}, 400, false},
+		{map[string]string{"data": data, "mode": "message", "hash": "keccak-256"}, 200, true},
+		{map[string]string{"data": toString(crypto.Keccak256([]byte("x"))), "mode": "digest"}, 200, true},
+		{map[string]string{"data": data, "mode": "message", "hash": "sha-256", "ethereum_pub_key": hexutil.Encode(crypto.FromECDSAPub(&other.PublicKey))}, 200, false},
+	} {
+		if c.body["ethereum_pub_key"] == "" {
+			c.body["ethereum_pub_key"] = hexutil.Encode(crypto.FromECDSAPub(&key.PublicKey))
+		}
+		code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/verify_ethereum_pub_key/"+id, c.body)
+		if code != c.code || (code == 200 && m["result"] != c.result) {
+			t.Fatal(c.body, code, m)
+		}
+	}
+}
+
+// the compact format sets the compressed flag in its header when asked, in single and batch signatures
+func TestSignCompactCompressed(t *testing.T) {
+	r := testRouter()
+	id := importTestKey(t, "4646464646464646464646464646464646464646464646464646464646464646")
+	digest := toString(crypto.Keccak256([]byte("compact")))
+	for _, c := range []struct {
+		body   map[string]interface{}
+		header byte
+	}{
+		{map[string]interface{}{"mode": "digest", "data": digest, "sig_format": "compact"}, 27},
+		{map[string]interface{}{"mode": "digest", "data": digest, "sig_format": "compact", "compressed": true}, 31},
+	} {
+		code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/sign/"+id, c.body)
+		if code != 200 {
+			t.Fatal(code, m)
+		}
+		if sig := toByte(m["signature"].(string)); len(sig) != 65 || (sig[0] != c.header && sig[0] != c.header+1) {
+			t.Fatalf("header %d", sig[0])
+		}
+	}
+	if code, _ := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/sign/"+id, map[string]interface{}{"mode": "digest", "data": digest, "sig_format": "ethereum", "compressed": true}); code != 400 {
+		t.Fatal(code)
+	}
+	code, m := doJSON(t, r, "POST", "/v1/grep11/sign/batch", map[string]interface{}{"items": []map[string]interface{}{{"key_id": id, "digest": digest, "sig_format": "compact", "compressed": true}}})
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	result := m["results"].([]interface{})[0].(map[string]interface{})
+	if sig := toByte(result["signature"].(string)); len(sig) != 65 || (sig[0] != 31 && sig[0] != 32) {
+		t.Fatal(result)
+	}
+}
+
+// ethereum signatures need a secp256k1 key, other curves are a bad request
+func TestEthereumSignP256(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/ec/generate_key_pair", map[string]string{"curve": CurveP256})
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	for route, body := range map[string]interface{}{
+		"sign_transaction": map[string]interface{}{"type": 0, "gasPrice": "1", "gas": 21000, "to": "0x3535353535353535353535353535353535353535", "chainId": "1"},
+		"personal_sign":    map[string]string{"message": "hello"},
+		"sign_typed_data": `{
+			"types": {"EIP712Domain": [{"name": "name", "type": "string"}], "Note": [{"name": "text", "type": "string"}]},
+			"primaryType": "Note",
+			"domain": {"name": "p256"},
+			"message": {"text": "hello"}
+		}`,
+	} {
+		if code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/"+route+"/"+id, body); code != 400 {
+			t.Fatal(route, code, m)
+		}
+	}
+}
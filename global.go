@@ -4,35 +4,67 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"time"
 
-	"github.com/IBM-Cloud/hpcs-grep11-go/util"
 	log "github.com/sirupsen/logrus"
 	grpc "google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"gorm.io/gorm"
+	"signing_server/util"
 )
 
-var cfg = loadCfg()
-var db = getDB(cfg)
-var kek = []byte{}
+// the config, database and crypto backend are loaded on first use by getGlobal, tests set them beforehand
+var (
+	cfg           *Config
+	db            *gorm.DB
+	cryptoBackend CryptoBackend
+)
 
 type KeyStore struct {
 	gorm.Model
-	Name       string `json:"name"`
+	Name       string `json:"name" gorm:"index"`
 	Uuid       string `json:"uuid"`
 	PrivateKey string `json:"private_key"`
 	PublicKey  string `json:"public_key"`
+	// ethereum address of secp256k1 keys, empty for other keys
+	Address string `json:"address" gorm:"index"`
+	// EC or AES
+	KeyType string `json:"key_type" gorm:"index"`
+	// ECDSA or AES
+	Algorithm string `json:"algorithm"`
+	// named curve of EC keys, e.g. secp256k1
+	Curve string `json:"curve"`
+	// key size in bits
+	KeySize int `json:"key_size"`
+	// comma separated operations the key can be used for, e.g. sign,verify
+	Usage string `json:"usage"`
+	// active, disabled, pending-deletion or destroyed
+	State string `json:"state" gorm:"index"`
+	// when a key pending deletion is destroyed
+	DeletionDate *time.Time `json:"deletion_date"`
+	// generated or imported
+	Origin string `json:"origin"`
+	// format of PrivateKey, see KeyBlobRaw, KeyBlobKEKAESECB and KeyBlobKEKAESKWP
+	BlobVersion int `json:"blob_version"`
+	// version of the KEK protecting PrivateKey, see kek.go
+	KekVersion int `json:"kek_version" gorm:"index"`
+	// base64 BIP32 chain code of master keys, see bip32.go. It is not serialized: with the
+	// private key of any non-hardened child it gives the master private key
+	ChainCode string `json:"-"`
+	// derivation path of a key derived from a BIP32 master key, such keys are never stored
+	DerivationPath string `json:"derivation_path,omitempty" gorm:"-"`
 }
 
-func ( k *KeyStore) String() string{
+func (k *KeyStore) String() string {
 	ks, _ := json.Marshal(k)
 	return string(ks)
 }
 
 type global struct {
-	cfg        *Config
-	db         *gorm.DB
-	grpcClient func() (*grpc.ClientConn, error)
+	cfg     *Config
+	db      *gorm.DB
+	backend CryptoBackend
 }
 
 func getGlobal() global {
@@ -42,10 +74,13 @@ func getGlobal() global {
 	if db == nil {
 		db = getDB(cfg)
 	}
+	if cryptoBackend == nil {
+		cryptoBackend = loadBackend(cfg)
+	}
 	return global{
-		cfg:        cfg,
-		db:         db,
-		grpcClient: grpcCall,
+		cfg:     cfg,
+		db:      db,
+		backend: cryptoBackend,
 	}
 }
 
@@ -57,14 +92,18 @@ func loadCfg() *Config {
 	return config
 }
 
-func grpcCall() (*grpc.ClientConn, error) {
-	cfg := getGlobal().cfg
+func grpcCall(cfg *Config) (*grpc.ClientConn, error) {
 	callOpts := []grpc.DialOption{
 		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})),
 		grpc.WithPerRPCCredentials(&util.IAMPerRPCCredentials{
 			APIKey:   cfg.Hpcs.IAMKey,
 			Endpoint: cfg.Hpcs.IAMEndpoint,
 		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                cfg.Hpcs.KeepaliveTime,
+			Timeout:             20 * time.Second,
+			PermitWithoutStream: false,
+		}),
 	}
 	endpoint := fmt.Sprintf("%s:%s", cfg.Hpcs.Address, cfg.Hpcs.Port)
 	return grpc.Dial(endpoint, callOpts...)
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"signing_server/util"
+)
+
+// KEK states
+const (
+	// KekStateCurrent wraps new keys, there is one current KEK
+	KekStateCurrent = "current"
+	// KekStateDecryptOnly only unwraps the keys not re-wrapped yet
+	KekStateDecryptOnly = "decrypt-only"
+	// KekStateRetired is deleted from the secure enclave
+	KekStateRetired = "retired"
+)
+
+// rotation job states
+const (
+	KekRotationRunning   = "running"
+	KekRotationCompleted = "completed"
+	KekRotationFailed    = "failed"
+)
+
+// number of keys re-wrapped per batch of a rotation job
+const kekRewrapBatchSize = 100
+
+var (
+	errKekNotFound      = errors.New("kek not found")
+	errKekStateConflict = errors.New("action is not allowed in the current kek state")
+)
+
+// KeyEncryptionKey is a version of the AES KEK protecting the private blobs,
+// the EP11 blob of the KEK itself is in SECURE_ENCLAVE_PATH, see kekPath
+type KeyEncryptionKey struct {
+	gorm.Model
+	Version   int        `json:"version" gorm:"uniqueIndex"`
+	State     string     `json:"state" gorm:"index"`
+	RetiredAt *time.Time `json:"retired_at"`
+}
+
+// KekRotation is the progress of the background job re-wrapping all keys under a new KEK.
+// The job is resumed when the server restarts.
+type KekRotation struct {
+	gorm.Model
+	ToVersion int    `json:"to_version" gorm:"uniqueIndex"`
+	State     string `json:"state" gorm:"index"`
+	Total     int64  `json:"total"`
+	Rewrapped int64  `json:"rewrapped"`
+	Failed    int64  `json:"failed"`
+	// id of the last key handled, the job continues after it
+	LastKeyID uint   `json:"last_key_id"`
+	Error     string `json:"error"`
+}
+
+// loaded KEK blobs by version
+var (
+	kekLock  sync.Mutex
+	kekCache = map[int][]byte{}
+)
+
+// kekPath is the file of a KEK version, version 1 is the KEK.key of the single KEK days
+func kekPath(version int) string {
+	if version == 1 {
+		return path.Join(getGlobal().cfg.SecureEnclavePath, "KEK.key")
+	}
+	return path.Join(getGlobal().cfg.SecureEnclavePath, fmt.Sprintf("KEK.v%d.key", version))
+}
+
+// loadKEK returns the blob of a KEK version
+func loadKEK(version int) ([]byte, error) {
+	kekLock.Lock()
+	defer kekLock.Unlock()
+	if kek, ok := kekCache[version]; ok {
+		return kek, nil
+	}
+	kekFile := kekPath(version)
+	log.WithField("kek_path", kekFile).Info("load kek")
+	kek, err := ioutil.ReadFile(kekFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kek version %d: %s", version, err)
+	}
+	if len(kek) == 0 {
+		return nil, fmt.Errorf("kek file %s is empty", kekFile)
+	}
+	kekCache[version] = kek
+	return kek, nil
+}
+
+// createKEK generates a KEK and writes it to the secure enclave
+func createKEK(version int) ([]byte, error) {
+	log.WithField("version", version).Info("generate a new KEK")
+	kek, err := generateAESKey()
+	if err != nil {
+		log.WithError(err).Error("failed to generate KEK")
+		return nil, err
+	}
+	log.Info("write kek to secure enclave data volume")
+	if err := ioutil.WriteFile(kekPath(version), kek, 0600); err != nil {
+		log.WithError(err).Error("failed to write kek")
+		return nil, err
+	}
+	kekLock.Lock()
+	kekCache[version] = kek
+	kekLock.Unlock()
+	return kek, nil
+}
+
+// currentKEK returns the KEK new keys are wrapped with.
+// The first call registers KEK.key as version 1, it is generated if it does not exist yet.
+func currentKEK() (int, []byte, error) {
+	db := getGlobal().db
+	current := &KeyEncryptionKey{}
+	err := db.First(current, "state = ?", KekStateCurrent).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		current, err = registerFirstKEK(db)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	kek, err := loadKEK(current.Version)
+	if err != nil {
+		return 0, nil, err
+	}
+	return current.Version, kek, nil
+}
+
+func registerFirstKEK(db *gorm.DB) (*KeyEncryptionKey, error) {
+	if _, err := loadKEK(1); err != nil {
+		log.WithError(err).Error("failed to read kek, start to generate a new kek")
+		if _, err := createKEK(1); err != nil {
+			return nil, err
+		}
+	}
+	first := &KeyEncryptionKey{Version: 1, State: KekStateCurrent}
+	if err := db.Create(first).Error; err != nil {
+		// another replica registered it first
+		if err := db.First(first, "state = ?", KekStateCurrent).Error; err != nil {
+			return nil, err
+		}
+	}
+	return first, nil
+}
+
+// keyWrapCheck remembers that CKM_AES_KEY_WRAP_PAD passed its known answer test
+var keyWrapCheck struct {
+	sync.Mutex
+	ok bool
+}
+
+// verifyKeyWrap checks that the HSM wraps with CKM_AES_KEY_WRAP_PAD as RFC 5649 specifies, private keys are
+// only wrapped once it did. A failure is not remembered, the check runs again on the next wrap.
+func verifyKeyWrap() error {
+	keyWrapCheck.Lock()
+	defer keyWrapCheck.Unlock()
+	if keyWrapCheck.ok {
+		return nil
+	}
+	if err := checkKeyWrap(); err != nil {
+		log.WithError(err).Error("CKM_AES_KEY_WRAP_PAD failed its known answer test, private keys can not be wrapped")
+		return fmt.Errorf("CKM_AES_KEY_WRAP_PAD failed its known answer test: %w", err)
+	}
+	log.Info("CKM_AES_KEY_WRAP_PAD passed its known answer test")
+	keyWrapCheck.ok = true
+	return nil
+}
+
+// checkKeyWrap wraps the test vectors of RFC 5649 section 6 in the HSM and checks that a modified
+// ciphertext does not unwrap
+func checkKeyWrap() error {
+	fromHex := func(s string) []byte {
+		b, _ := hex.DecodeString(s)
+		return b
+	}
+	kek, err := importTestAESKey(fromHex("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8"))
+	if err != nil {
+		return fmt.Errorf("failed to import the test KEK: %w", err)
+	}
+	for _, vector := range []struct{ key, wrapped string }{
+		{"c37b7e6492584340bed12207808941155068f738", "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a"},
+		{"466f7250617369", "afbeb0f07dfbf5419200f2ccb50bb24f"},
+	} {
+		key, wrapped := fromHex(vector.key), fromHex(vector.wrapped)
+		ciphered, err := encryptAESKWP(kek, key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(ciphered, wrapped) {
+			return fmt.Errorf("wrapping %s gives %x instead of %s", vector.key, ciphered, vector.wrapped)
+		}
+		plain, err := decryptAESKWP(kek, wrapped)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(plain, key) {
+			return fmt.Errorf("unwrapping %s gives %x instead of %s", vector.wrapped, plain, vector.key)
+		}
+		wrapped[len(wrapped)-1] ^= 1
+		if _, err := decryptAESKWP(kek, wrapped); err == nil {
+			return fmt.Errorf("a modified ciphertext was unwrapped")
+		}
+	}
+	return nil
+}
+
+// importTestAESKey imports a known AES key through a temporary transport key, only test keys are imported this way
+func importTestAESKey(value []byte) ([]byte, error) {
+	transportKey, err := generateAESKey()
+	if err != nil {
+		return nil, err
+	}
+	iv, err := generateIV()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := encryptAESCBC(transportKey, value, iv)
+	if err != nil {
+		return nil, err
+	}
+	template := ep11.EP11Attributes{
+		ep11.CKA_CLASS:       ep11.CKO_SECRET_KEY,
+		ep11.CKA_KEY_TYPE:    ep11.CKK_AES,
+		ep11.CKA_VALUE_LEN:   len(value),
+		ep11.CKA_ENCRYPT:     true,
+		ep11.CKA_DECRYPT:     true,
+		ep11.CKA_WRAP:        false,
+		ep11.CKA_UNWRAP:      false,
+		ep11.CKA_EXTRACTABLE: false,
+	}
+	response, err := getGlobal().backend.UnwrapKey(context.Background(), &pb.UnwrapKeyRequest{
+		Mech:     &pb.Mechanism{Mechanism: ep11.CKM_AES_CBC_PAD, Parameter: util.SetMechParm(iv)},
+		KeK:      transportKey,
+		Wrapped:  wrapped,
+		Template: util.AttributeMap(template),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.GetUnwrappedBytes(), nil
+}
+
+// keyBinding binds a KEK protected blob to its key: it is wrapped with the blob and checked on unwrap,
+// so a blob copied into another row fails to unwrap
+func keyBinding(key *KeyStore) []byte {
+	h := sha256.New()
+	h.Write([]byte(key.Uuid))
+	h.Write(toByte(key.PublicKey))
+	return h.Sum(nil)
+}
+
+// wrapPrivateKey protects the EP11 private key blob of a key with the current KEK.
+// The key gets its uuid here because the uuid is part of the key binding.
+func (k *KeyStore) wrapPrivateKey(blob []byte) error {
+	version, kek, err := currentKEK()
+	if err != nil {
+		return err
+	}
+	return k.sealPrivateKey(blob, version, kek)
+}
+
+// sealPrivateKey encrypts blob under a KEK version with CKM_AES_KEY_WRAP_PAD,
+// it fails while the HSM has not passed the known answer test of CKM_AES_KEY_WRAP_PAD
+func (k *KeyStore) sealPrivateKey(blob []byte, version int, kek []byte) error {
+	if err := verifyKeyWrap(); err != nil {
+		return err
+	}
+	if k.Uuid == "" {
+		k.Uuid = uuid.New().String()
+	}
+	sealed, err := encryptAESKWP(kek, append(keyBinding(k), blob...))
+	if err != nil {
+		return err
+	}
+	k.PrivateKey = toString(sealed)
+	k.BlobVersion = KeyBlobKEKAESKWP
+	k.KekVersion = version
+	return nil
+}
+
+// openPrivateKey returns the EP11 blob of a stored key, removing the KEK protection if any
+func openPrivateKey(keystore *KeyStore) ([]byte, error) {
+	switch keystore.BlobVersion {
+	case KeyBlobRaw:
+		return toByte(keystore.PrivateKey), nil
+	case KeyBlobKEKAESECB, KeyBlobKEKAESKWP:
+		if keystore.PrivateKey == "" {
+			return nil, fmt.Errorf("private key of %s is destroyed", keystore.Uuid)
+		}
+		kek, err := loadKEK(keystore.KekVersion)
+		if err != nil {
+			return nil, err
+		}
+		if keystore.BlobVersion == KeyBlobKEKAESECB {
+			return decryptAES(kek, toByte(keystore.PrivateKey))
+		}
+		plain, err := decryptAESKWP(kek, toByte(keystore.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		binding := keyBinding(keystore)
+		if len(plain) <= len(binding) || !hmac.Equal(plain[:len(binding)], binding) {
+			return nil, fmt.Errorf("private key blob of %s belongs to another key", keystore.Uuid)
+		}
+		return plain[len(binding):], nil
+	}
+	return nil, fmt.Errorf("unknown blob version %d of key %s", keystore.BlobVersion, keystore.Uuid)
+}
+
+// unwrapPrivateKey returns the EP11 blob of a stored key to use it, blobs still protected
+// with CKM_AES_ECB are moved to CKM_AES_KEY_WRAP_PAD on the way
+func unwrapPrivateKey(keystore *KeyStore) ([]byte, error) {
+	blob, err := openPrivateKey(keystore)
+	if err != nil {
+		return nil, err
+	}
+	if keystore.BlobVersion == KeyBlobKEKAESECB {
+		version, kek, err := currentKEK()
+		if err == nil {
+			err = rewrapKey(getGlobal().db, keystore, blob, version, kek)
+		}
+		if err != nil {
+			// the key is still usable, the upgrade is tried again on next use
+			log.WithError(err).WithField("key_uuid", keystore.Uuid).Warn("failed to move private key to AES-KWP")
+		}
+	}
+	return blob, nil
+}
+
+// rewrapKey stores the clear EP11 blob of a key again, under a KEK version
+func rewrapKey(db *gorm.DB, key *KeyStore, blob []byte, version int, kek []byte) error {
+	oldBlob := key.PrivateKey
+	rewrapped := *key
+	if err := rewrapped.sealPrivateKey(blob, version, kek); err != nil {
+		return err
+	}
+	// the private key condition keeps a key destroyed or rewrapped in the meantime as it is
+	result := db.Model(&KeyStore{}).
+		Where("id = ? AND private_key = ?", key.ID, oldBlob).
+		Updates(map[string]interface{}{
+			"private_key":  rewrapped.PrivateKey,
+			"blob_version": rewrapped.BlobVersion,
+			"kek_version":  rewrapped.KekVersion,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		log.WithField("key_uuid", key.Uuid).Info("key changed during rewrap, skip it")
+		return nil
+	}
+	log.WithField("key_uuid", key.Uuid).WithField("kek_version", version).Info("private key rewrapped")
+	return nil
+}
+
+// backfillKekVersion records that the keys wrapped before KEK versions existed use version 1
+func backfillKekVersion(db *gorm.DB) error {
+	return db.Model(&KeyStore{}).
+		Where("blob_version = ? AND (kek_version IS NULL OR kek_version = 0)", KeyBlobKEKAESECB).
+		Update("kek_version", 1).Error
+}
+
+// kekWrappedBlobs are the blob versions protected by a KEK
+var kekWrappedBlobs = []int{KeyBlobKEKAESECB, KeyBlobKEKAESKWP}
+
+// kekKeyCount counts the keys still wrapped under a KEK version
+func kekKeyCount(db *gorm.DB, version int) (int64, error) {
+	var count int64
+	err := db.Model(&KeyStore{}).
+		Where("blob_version IN ? AND kek_version = ? AND private_key <> ''", kekWrappedBlobs, version).
+		Count(&count).Error
+	return count, err
+}
+
+// keysToRewrap selects the keys a rotation to version still has to move,
+// blobs protected with CKM_AES_ECB are moved even if they already use the version
+func keysToRewrap(db *gorm.DB, version int) *gorm.DB {
+	return db.Model(&KeyStore{}).
+		Where("blob_version IN ? AND private_key <> ''", kekWrappedBlobs).
+		Where("kek_version <> ? OR blob_version = ?", version, KeyBlobKEKAESECB)
+}
+
+// runKekRotation re-wraps every key not under the target KEK version, batch by batch, until ctx is done
+func runKekRotation(ctx context.Context, db *gorm.DB, rotation *KekRotation) {
+	logger := log.WithField("to_version", rotation.ToVersion)
+	logger.WithField("last_key_id", rotation.LastKeyID).Info("start kek rotation")
+	kek, err := loadKEK(rotation.ToVersion)
+	if err == nil {
+		err = verifyKeyWrap()
+	}
+	if err != nil {
+		logger.WithError(err).Error("kek rotation failed")
+		db.Model(rotation).Updates(map[string]interface{}{"state": KekRotationFailed, "error": err.Error()})
+		return
+	}
+	for {
+		if ctx.Err() != nil {
+			logger.Info("kek rotation stopped, it is resumed on restart")
+			return
+		}
+		keys := []KeyStore{}
+		err := keysToRewrap(db, rotation.ToVersion).Where("id > ?", rotation.LastKeyID).
+			Order("id").Limit(kekRewrapBatchSize).Find(&keys).Error
+		if err != nil {
+			logger.WithError(err).Error("kek rotation failed")
+			db.Model(rotation).Updates(map[string]interface{}{"state": KekRotationFailed, "error": err.Error()})
+			return
+		}
+		if len(keys) == 0 {
+			break
+		}
+		for i := range keys {
+			blob, err := openPrivateKey(&keys[i])
+			if err == nil {
+				err = rewrapKey(db, &keys[i], blob, rotation.ToVersion, kek)
+			}
+			if err != nil {
+				logger.WithError(err).WithField("key_uuid", keys[i].Uuid).Error("failed to rewrap key")
+				rotation.Failed++
+				rotation.Error = err.Error()
+			} else {
+				rotation.Rewrapped++
+			}
+			rotation.LastKeyID = keys[i].ID
+		}
+		if err := db.Model(rotation).Updates(map[string]interface{}{
+			"rewrapped":   rotation.Rewrapped,
+			"failed":      rotation.Failed,
+			"last_key_id": rotation.LastKeyID,
+			"error":       rotation.Error,
+		}).Error; err != nil {
+			logger.WithError(err).Error("failed to save kek rotation progress")
+		}
+		logger.WithField("rewrapped", rotation.Rewrapped).WithField("failed", rotation.Failed).Info("kek rotation progress")
+	}
+	state := KekRotationCompleted
+	if rotation.Failed > 0 {
+		state = KekRotationFailed
+	}
+	db.Model(rotation).Update("state", state)
+	logger.WithField("rewrapped", rotation.Rewrapped).WithField("failed", rotation.Failed).WithField("state", state).Info("kek rotation finished")
+}
+
+// resumeKekRotations restarts the rotation jobs interrupted by a shutdown
+func resumeKekRotations(ctx context.Context, db *gorm.DB) {
+	rotations := []KekRotation{}
+	if err := db.Where("state = ?", KekRotationRunning).Find(&rotations).Error; err != nil {
+		log.WithError(err).Error("failed to find kek rotations")
+		return
+	}
+	for i := range rotations {
+		go runKekRotation(ctx, db, &rotations[i])
+	}
+}
+
+// abortWithKekError ends a KEK request
+func abortWithKekError(ctx *gin.Context, err error) {
+	log.WithError(err).Error("kek request failed")
+	switch {
+	case errors.Is(err, errKekNotFound):
+		ctx.AbortWithError(404, err)
+	case errors.Is(err, errKekStateConflict):
+		ctx.AbortWithError(409, err)
+	default:
+		ctx.AbortWithError(500, err)
+	}
+}
+
+// list the KEK versions with the number of keys wrapped under each
+func listKEKs(ctx *gin.Context) {
+	db := getGlobal().db
+	// make sure KEK.key is registered
+	if _, _, err := currentKEK(); err != nil {
+		abortWithKekError(ctx, err)
+		return
+	}
+	keks := []KeyEncryptionKey{}
+	if err := db.Order("version").Find(&keks).Error; err != nil {
+		abortWithKekError(ctx, err)
+		return
+	}
+	result := make([]gin.H, 0, len(keks))
+	for _, kek := range keks {
+		count, err := kekKeyCount(db, kek.Version)
+		if err != nil {
+			abortWithKekError(ctx, err)
+			return
+		}
+		result = append(result, gin.H{
+			"version":    kek.Version,
+			"state":      kek.State,
+			"created_at": kek.CreatedAt,
+			"retired_at": kek.RetiredAt,
+			"keys":       count,
+		})
+	}
+	ctx.JSON(http.StatusOK, gin.H{"keks": result})
+}
+
+// rotateKEK creates a new current KEK and starts re-wrapping all keys under it,
+// the job runs until ctx is done
+func rotateKEK(background context.Context) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		db := getGlobal().db
+		version, _, err := currentKEK()
+		if err != nil {
+			abortWithKekError(ctx, err)
+			return
+		}
+		// keys are not moved to the new KEK until the HSM wraps them as it should
+		if err := verifyKeyWrap(); err != nil {
+			abortWithKekError(ctx, err)
+			return
+		}
+		var running int64
+		if err := db.Model(&KekRotation{}).Where("state = ?", KekRotationRunning).Count(&running).Error; err != nil {
+			abortWithKekError(ctx, err)
+			return
+		}
+		if running > 0 {
+			abortWithKekError(ctx, fmt.Errorf("%w: a kek rotation is running", errKekStateConflict))
+			return
+		}
+
+		newVersion := version + 1
+		rotation := &KekRotation{ToVersion: newVersion, State: KekRotationRunning}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// the state condition makes concurrent rotations fail instead of leaving two current KEKs
+			result := tx.Model(&KeyEncryptionKey{}).Where("version = ? AND state = ?", version, KekStateCurrent).Update("state", KekStateDecryptOnly)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return fmt.Errorf("%w: kek version %d is not current anymore", errKekStateConflict, version)
+			}
+			if err := tx.Create(&KeyEncryptionKey{Version: newVersion, State: KekStateCurrent}).Error; err != nil {
+				return err
+			}
+			if err := keysToRewrap(tx, newVersion).Count(&rotation.Total).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(rotation).Error; err != nil {
+				return err
+			}
+			// the KEK is written last so that a failed rotation leaves no file behind
+			_, err := createKEK(newVersion)
+			return err
+		})
+		if err != nil {
+			abortWithKekError(ctx, err)
+			return
+		}
+		log.WithField("from_version", version).WithField("to_version", newVersion).WithField("keys", rotation.Total).Info("kek rotated")
+		go runKekRotation(background, db, rotation)
+		ctx.JSON(http.StatusOK, rotation)
+	}
+}
+
+// show the progress of the last KEK rotation
+func getKekRotation(ctx *gin.Context) {
+	rotation := &KekRotation{}
+	if err := getGlobal().db.Order("to_version desc").First(rotation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			abortWithKekError(ctx, fmt.Errorf("%w: no kek rotation", errKekNotFound))
+			return
+		}
+		abortWithKekError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, rotation)
+}
+
+// resumeKekRotation restarts a failed rotation job from the first key, e.g. after fixing a broken key
+func resumeKekRotation(background context.Context) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		db := getGlobal().db
+		rotation := &KekRotation{}
+		if err := db.Order("to_version desc").First(rotation).Error; err != nil {
+			abortWithKekError(ctx, fmt.Errorf("%w: no kek rotation", errKekNotFound))
+			return
+		}
+		result := db.Model(&KekRotation{}).Where("id = ? AND state = ?", rotation.ID, KekRotationFailed).
+			Updates(map[string]interface{}{"state": KekRotationRunning, "failed": 0, "last_key_id": 0, "error": ""})
+		if result.Error != nil {
+			abortWithKekError(ctx, result.Error)
+			return
+		}
+		if result.RowsAffected == 0 {
+			abortWithKekError(ctx, fmt.Errorf("%w: the last kek rotation is %s", errKekStateConflict, rotation.State))
+			return
+		}
+		if err := db.First(rotation, rotation.ID).Error; err != nil {
+			abortWithKekError(ctx, err)
+			return
+		}
+		go runKekRotation(background, db, rotation)
+		ctx.JSON(http.StatusOK, rotation)
+	}
+}
+
+// retire a KEK no key is wrapped under anymore, its blob is deleted from the secure enclave
+func retireKEK(ctx *gin.Context) {
+	db := getGlobal().db
+	version, err := strconv.Atoi(ctx.Param("version"))
+	if err != nil {
+		abortWithKekError(ctx, fmt.Errorf("%w: invalid version %q", errKekNotFound, ctx.Param("version")))
+		return
+	}
+	kek := &KeyEncryptionKey{}
+	if err := db.First(kek, "version = ?", version).Error; err != nil {
+		abortWithKekError(ctx, fmt.Errorf("%w: version %d", errKekNotFound, version))
+		return
+	}
+	if kek.State != KekStateDecryptOnly {
+		abortWithKekError(ctx, fmt.Errorf("%w: can not retire a %s kek", errKekStateConflict, kek.State))
+		return
+	}
+	count, err := kekKeyCount(db, version)
+	if err != nil {
+		abortWithKekError(ctx, err)
+		return
+	}
+	if count > 0 {
+		abortWithKekError(ctx, fmt.Errorf("%w: %d keys are still wrapped under kek version %d", errKekStateConflict, count, version))
+		return
+	}
+	retiredAt := time.Now()
+	result := db.Model(&KeyEncryptionKey{}).Where("id = ? AND state = ?", kek.ID, KekStateDecryptOnly).
+		Updates(map[string]interface{}{"state": KekStateRetired, "retired_at": retiredAt})
+	if result.Error != nil {
+		abortWithKekError(ctx, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		abortWithKekError(ctx, fmt.Errorf("%w: kek version %d changed", errKekStateConflict, version))
+		return
+	}
+	kekLock.Lock()
+	delete(kekCache, version)
+	kekLock.Unlock()
+	if err := os.Remove(kekPath(version)); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("version", version).Error("failed to delete retired kek")
+	}
+	log.WithField("version", version).Info("kek retired")
+	ctx.JSON(http.StatusOK, gin.H{"version": version, "state": KekStateRetired, "retired_at": retiredAt})
+}
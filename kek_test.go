@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestKeyWrap(t *testing.T) {
+	// the emulator wraps the RFC 5649 vectors
+	if err := verifyKeyWrap(); err != nil {
+		t.Fatal(err)
+	}
+	r := testRouter()
+	newKey := func() *KeyStore {
+		code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/generate_key_pair", "")
+		if code != 200 {
+			t.Fatal(code, m)
+		}
+		key, err := getKeyAt(m["uuid"].(string), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	key, other := newKey(), newKey()
+	if key.BlobVersion != KeyBlobKEKAESKWP {
+		t.Fatalf("blob version %d", key.BlobVersion)
+	}
+	if _, err := openPrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	// a blob copied into another key does not unwrap
+	other.PrivateKey = key.PrivateKey
+	if _, err := openPrivateKey(other); err == nil {
+		t.Fatal("blob of another key unwrapped")
+	}
+
+	// keys of older versions are still protected with CKM_AES_ECB
+	legacy := newKey()
+	blob, err := openPrivateKey(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, kek, err := currentKEK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := encryptAES(kek, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(legacy).Updates(map[string]interface{}{"private_key": toString(sealed), "blob_version": KeyBlobKEKAESECB, "kek_version": version}).Error; err != nil {
+		t.Fatal(err)
+	}
+	legacy, err = getKeyAt(legacy.Uuid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ECB blobs are moved to AES-KWP on first use
+	if _, err := unwrapPrivateKey(legacy); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := getKeyAt(legacy.Uuid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.BlobVersion != KeyBlobKEKAESKWP {
+		t.Fatalf("blob version %d", migrated.BlobVersion)
+	}
+	if _, err := openPrivateKey(migrated); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitKekRotation waits for the rotation to version to leave the running state
+func waitKekRotation(t *testing.T, version int) *KekRotation {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rotation := &KekRotation{}
+		if err := db.First(rotation, "to_version = ?", version).Error; err != nil {
+			t.Fatal(err)
+		}
+		if rotation.State != KekRotationRunning {
+			return rotation
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("kek rotation to version %d still running", version)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a rotation re-wraps the keys under a new KEK, is resumed after a restart
+// and the old KEK can only be retired once no key uses it
+func TestKekRotation(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/generate_key_pair", "")
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	version, _, err := currentKEK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kekVersion := func() int {
+		key, err := getKeyAt(id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openPrivateKey(key); err != nil {
+			t.Fatal(err)
+		}
+		return key.KekVersion
+	}
+	retire := func(version int) int {
+		code, m := doJSON(t, r, "POST", fmt.Sprintf("/v1/grep11/keks/%d/retire", version), nil)
+		if code != 200 && code != 409 {
+			t.Fatal(code, m)
+		}
+		return code
+	}
+	if kekVersion() != version {
+		t.Fatal(kekVersion())
+	}
+	// the current KEK is not retired
+	if code := retire(version); code != 409 {
+		t.Fatal(code)
+	}
+
+	if code, m = doJSON(t, r, "POST", "/v1/grep11/keks/rotate", nil); code != 200 || m["to_version"] != float64(version+1) {
+		t.Fatal(code, m)
+	}
+	if rotation := waitKekRotation(t, version+1); rotation.State != KekRotationCompleted || rotation.Failed != 0 {
+		t.Fatal(rotation.State, rotation.Error)
+	}
+	if kekVersion() != version+1 {
+		t.Fatal(kekVersion())
+	}
+	if code := retire(version); code != 200 {
+		t.Fatal(code)
+	}
+	if _, err := os.Stat(kekPath(version)); !os.IsNotExist(err) {
+		t.Fatal("retired kek still in the secure enclave", err)
+	}
+
+	// a server shutting down leaves the rotation running, the keys stay under the old KEK
+	stopped, stop := context.WithCancel(context.Background())
+	stop()
+	shutdown := gin.New()
+	shutdown.POST("/v1/grep11/keks/rotate", rotateKEK(stopped))
+	if code, m = doJSON(t, shutdown, "POST", "/v1/grep11/keks/rotate", nil); code != 200 {
+		t.Fatal(code, m)
+	}
+	rotation := &KekRotation{}
+	if err := db.First(rotation, "to_version = ?", version+2).Error; err != nil || rotation.State != KekRotationRunning {
+		t.Fatal(err, rotation.State)
+	}
+	if kekVersion() != version+1 {
+		t.Fatal(kekVersion())
+	}
+	// a second rotation waits for the running one
+	if code, m = doJSON(t, r, "POST", "/v1/grep11/keks/rotate", nil); code != 409 {
+		t.Fatal(code, m)
+	}
+	// the old KEK still wraps keys
+	if code := retire(version + 1); code != 409 {
+		t.Fatal(code)
+	}
+
+	// the restart resumes the rotation
+	resumeKekRotations(context.Background(), db)
+	if rotation = waitKekRotation(t, version+2); rotation.State != KekRotationCompleted || rotation.Failed != 0 {
+		t.Fatal(rotation.State, rotation.Error)
+	}
+	if kekVersion() != version+2 {
+		t.Fatal(kekVersion())
+	}
+	if code := retire(version + 1); code != 200 {
+		t.Fatal(code)
+	}
+}
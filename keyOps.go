@@ -7,8 +7,6 @@ import (
 	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/asn1"
@@ -21,28 +19,50 @@ import (
 	"io/ioutil"
 	"math/big"
 	"net/http"
-	"path"
 
 	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
 	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
-	"github.com/IBM-Cloud/hpcs-grep11-go/util"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/secp256k1"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"signing_server/util"
 )
 
 type SignBody struct {
-	Data   string //########################## TBD
+	Data string //########################## TBD
+	// digest or message, see SignModeDigest and SignModeMessage
+	Mode string `json:"mode"`
+	// hash of the message mode: SHA-256, SHA-384, SHA-512, Keccak-256 or SHA3-256
+	Hash string `json:"hash"`
+	// raw (default), der, ethereum or compact, see util.SignatureFormat
 	Format string `json:"sig_format"`
+	// normalize s to the lower half of the curve order, default depends on the format
+	LowS *bool `json:"low_s"`
+	// EIP-155 chain id applied to v of the ethereum format
+	ChainID string `json:"chain_id"`
+	// sets the compressed public key flag in the header of the compact format
+	Compressed bool `json:"compressed"`
+	// ecdsa (default), schnorr is refused since EP11 can not sign BIP-340, see errSchnorrUnsupported
+	Scheme string `json:"scheme"`
 }
 
+// VeifyEthereumPubKeyBody checks an ethereum public key is the one of a key: the key signs data, read
+// like the data of SignBody with the required mode and hash, and the signature is verified with the public key
 type VeifyEthereumPubKeyBody struct {
 	Data           string `json:"data"`
+	Mode           string `json:"mode"`
+	Hash           string `json:"hash"`
 	EthereumPubKey string `json:"ethereum_pub_key"`
 }
 
+// GenerateKeyBody is the optional body of key generation, the curve defaults to secp256k1
+type GenerateKeyBody struct {
+	Name  string `json:"key_name"`
+	Curve string `json:"curve"`
+}
+
 type ImportKeyBody struct {
 	Name string `json:"key_name"`
 	Type string `json:"key_type"`
@@ -60,6 +80,14 @@ type VerifyImportAESKeyBody struct {
 	Key   string `json:"key_content"`
 }
 
+// ECVerifyBody is the verify body of EC keys, mode and hash are the ones of SignBody
+type ECVerifyBody struct {
+	VerifyBody
+	Mode   string `json:"mode"`
+	Hash   string `json:"hash"`
+	Scheme string `json:"scheme"`
+}
+
 func (v *VerifyBody) String() string {
 	ks, _ := json.Marshal(v)
 	return string(ks)
@@ -68,37 +96,52 @@ func (v *VerifyBody) String() string {
 // generate EC key pair
 func generageECkeyPair(ctx *gin.Context) {
 	log.Info("start generte EC key")
-	aes, err := loadAesKEK()
+	requestBody := GenerateKeyBody{}
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.BindJSON(&requestBody); err != nil {
+			log.WithError(err).Error("fail to read json body")
+			return
+		}
+	}
+	if !checkKeyName(ctx, requestBody.Name) {
+		return
+	}
+	curve, err := parseCurve(requestBody.Curve)
 	if err != nil {
-		ctx.AbortWithError(500, err)
+		ctx.AbortWithError(400, err)
+		return
 	}
-
-	publicKey, privateKey, err := generateECKeyPair()
+	oid, _ := curveOID(curve)
+	publicKey, privateKey, err := generateECKeyPair(oid)
 	if err != nil {
 		ctx.AbortWithError(500, err)
+		return
 	}
 	log.WithField("wrapped-key", toString(privateKey)).Info("get wrapped key")
 
-	encryptedPrivateKey, err := encryptAES(aes, privateKey)
+	pubKeyStr := toString(publicKey)
+	key, err := newECKey("", pubKeyStr, KeyOriginGenerated)
 	if err != nil {
 		ctx.AbortWithError(500, err)
+		return
 	}
-	encryptedPrivateKeyStr := toString(encryptedPrivateKey)
-	pubKeyStr := toString(publicKey)
-	log.WithField("private_encrypt", encryptedPrivateKeyStr).WithField("public", pubKeyStr).Info("generate ec key pair")
+	if err := key.wrapPrivateKey(privateKey); err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	log.WithField("private_encrypt", key.PrivateKey).WithField("public", pubKeyStr).Info("generate ec key pair")
 
-	keys, err := insertKey(
-		getGlobal().db,
-		encryptedPrivateKeyStr,
-		pubKeyStr,
-	)
+	key.Name = requestBody.Name
+	keys, err := insertKey(getGlobal().db, key)
 	if err != nil {
 		ctx.AbortWithError(500, err)
+		return
 	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"uuid":    keys.Uuid,
+		"curve":   keys.Curve,
 		"public":  pubKeyStr,
-		"private": encryptedPrivateKeyStr,
+		"private": keys.PrivateKey,
 	})
 }
 
@@ -109,6 +152,9 @@ func importAESKey(ctx *gin.Context) {
 		log.WithError(err).Error("fail to read json body")
 		ctx.AbortWithError(400, err)
 	}
+	if !checkKeyName(ctx, requestBody.Name) {
+		return
+	}
 	tempAESKey, err := generateAESKey()
 	if err != nil {
 		log.WithError(err).Error("failed to generate temp AES key")
@@ -133,14 +179,13 @@ func importAESKey(ctx *gin.Context) {
 	}
 	importkeyStr := toString(importkey)
 	log.WithField("importkey", importkeyStr).Info("unwrap key success")
-	keys, err := insertKey(
-		getGlobal().db,
-		importkeyStr,
-		"",
-	)
+	key := newAESKey(importkeyStr, len(toByte(importeRawKey))*8, KeyOriginImported)
+	key.Name = requestBody.Name
+	keys, err := insertKey(getGlobal().db, key)
 	if err != nil {
 		log.WithError(err).Error("failed to insert AES key")
 		ctx.AbortWithError(500, err)
+		return
 	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"uuid":    keys.Uuid,
@@ -150,9 +195,9 @@ func importAESKey(ctx *gin.Context) {
 
 // importECfile
 func importECKey(ctx *gin.Context) {
-	aes, err := loadAesKEK()
-	if err != nil {
-		ctx.AbortWithError(500, err)
+	keyName := ctx.PostForm("key_name")
+	if !checkKeyName(ctx, keyName) {
+		return
 	}
 
 	file, header, err := ctx.Request.FormFile("file")
@@ -219,23 +264,24 @@ func importECKey(ctx *gin.Context) {
 		log.WithError(err).Error("failed to unwrap EC key")
 		ctx.AbortWithError(500, err)
 	}
-	encryptedUnwrappedPrivateKey, err := encryptAES(aes, unwrappedECKey)
+	pubBlockStr := toString(pubBlock)
+	key, err := newECKey("", pubBlockStr, KeyOriginImported)
 	if err != nil {
+		log.WithError(err).Error("unsupported EC key")
+		ctx.AbortWithError(400, err)
+		return
+	}
+	if err := key.wrapPrivateKey(unwrappedECKey); err != nil {
 		ctx.AbortWithError(500, err)
+		return
 	}
-
-	encryptedUnwrappedPrivateKeyStr := toString(encryptedUnwrappedPrivateKey)
-	pubBlockStr := toString(pubBlock)
-	log.WithField("importkey", encryptedUnwrappedPrivateKeyStr).WithField("pub", pubBlockStr).Info("unwrap key success")
-	keys, err := insertKey(
-		getGlobal().db,
-		encryptedUnwrappedPrivateKeyStr,
-		pubBlockStr,
-	)
-
+	log.WithField("importkey", key.PrivateKey).WithField("pub", pubBlockStr).Info("unwrap key success")
+	key.Name = keyName
+	keys, err := insertKey(getGlobal().db, key)
 	if err != nil {
 		log.WithError(err).Error("failed to insert EC key")
 		ctx.AbortWithError(500, err)
+		return
 	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"uuid":    keys.Uuid,
@@ -314,15 +360,19 @@ func importECKey2(ctx *gin.Context) {
 	unwrappedECKeyStr := toString(unwrappedECKey)
 	pubBlockStr := toString(pubBlock)
 	log.WithField("importkey", unwrappedECKeyStr).WithField("pub", pubBlockStr).Info("unwrap key success")
-	keys, err := insertKey(
-		getGlobal().db,
-		unwrappedECKeyStr,
-		pubBlockStr,
-	)
-
+	key, err := newECKey(unwrappedECKeyStr, pubBlockStr, KeyOriginImported)
+	if err != nil {
+		log.WithError(err).Error("unsupported EC key")
+		ctx.AbortWithError(400, err)
+		return
+	}
+	// the unwrapped blob is stored without KEK protection
+	key.BlobVersion = KeyBlobRaw
+	keys, err := insertKey(getGlobal().db, key)
 	if err != nil {
 		log.WithError(err).Error("failed to insert EC key")
 		ctx.AbortWithError(500, err)
+		return
 	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"uuid":    keys.Uuid,
@@ -332,12 +382,6 @@ func importECKey2(ctx *gin.Context) {
 }
 
 func unwrapECkey(encryptedPrivateKey, tempAESKey, iv []byte) ([]byte, error) {
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
-
 	keyLen := 128 // bits
 	ecUnwrapKeyTemplate := ep11.EP11Attributes{
 		ep11.CKA_KEY_TYPE:    ep11.CKK_EC,
@@ -355,7 +399,7 @@ func unwrapECkey(encryptedPrivateKey, tempAESKey, iv []byte) ([]byte, error) {
 		Wrapped:  encryptedPrivateKey,
 		Template: util.AttributeMap(ecUnwrapKeyTemplate),
 	}
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 
 	// Unwrap the AES key
 	unwrappedResponse, err := cryptoClient.UnwrapKey(context.Background(), unwrapRequest)
@@ -389,9 +433,19 @@ func verifyImportAESKey(ctx *gin.Context) {
 		log.WithError(err).Error("failed to encrypted byte by local")
 		ctx.AbortWithError(500, err)
 	}
-	keystore := getKeyByUUID(getGlobal().db, keyUUID)
+	keystore, err := getUsableKey(keyUUID, KeyAlgorithmAES, KeyUsageEncrypt)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
 	log.WithField("key", keystore).Info("load key success")
-	target2, err := encryptAESCBC(toByte(keystore.PrivateKey), []byte(requestBody.Data), iv)
+	secretKey, err := unwrapPrivateKey(keystore)
+	if err != nil {
+		log.WithError(err).Error("failed to load AES key")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	target2, err := encryptAESCBC(secretKey, []byte(requestBody.Data), iv)
 	if err != nil {
 		log.WithError(err).Error("failed to encrypted byte by hpcs")
 		ctx.AbortWithError(500, err)
@@ -406,10 +460,6 @@ func verifyImportAESKey(ctx *gin.Context) {
 
 // sign by private key
 func sign(ctx *gin.Context) {
-	aes, err := loadAesKEK()
-	if err != nil {
-		ctx.AbortWithError(500, err)
-	}
 	requestBody := SignBody{}
 
 	if err := ctx.BindJSON(&requestBody); err != nil {
@@ -418,46 +468,38 @@ func sign(ctx *gin.Context) {
 	}
 
 	keyUUID := ctx.Param("id")
-	keystore := getKeyByUUID(getGlobal().db, keyUUID)
-	log.WithField("key_uuid", keyUUID).WithField("data", requestBody.Data).Info("start sign")
-	rawPrivate := toByte(keystore.PrivateKey)
-	privatekey, err := decryptAES(aes, rawPrivate)
+	keystore, err := getUsableKeyAt(keyUUID, ctx.Query("path"), KeyAlgorithmECDSA, KeyUsageSign)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	if requestBody.Scheme == SignSchemeSchnorr {
+		ctx.AbortWithError(501, errSchnorrUnsupported)
+		return
+	}
+	mech, data, digest, err := ecSignInput(keystore, requestBody.Scheme, requestBody.Mode, requestBody.Hash, toByte(requestBody.Data))
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
+	}
+	log.WithField("key_uuid", keyUUID).WithField("data", requestBody.Data).WithField("mode", requestBody.Mode).WithField("hash", requestBody.Hash).WithField("scheme", requestBody.Scheme).Info("start sign")
+	privatekey, err := unwrapPrivateKey(keystore)
 	if err != nil {
 		log.WithError(err).Error("failed to decrypt private key")
 		ctx.AbortWithError(500, err)
+		return
 	}
-	// data, err := hexutil.Decode(requestBody.Data)
-	// if err != nil {
-	// 	log.WithError(err).Error("failed to decrypt private key")
-	// 	ctx.AbortWithError(500, err)
-	// }
-	sig, err := signEC(privatekey, toByte(requestBody.Data))
+	sig, err := signECMechanism(mech, privatekey, data)
 	if err != nil {
 		log.WithError(err).Error("failed to sign data")
 		ctx.AbortWithError(500, err)
+		return
 	}
-	if requestBody.Format == "ans1" {
-		log.Info("change to ANS1 format")
-		// ep11 returns a raw signature byte array that must be encoded to ASN1 for tls package usage.
-		var sigLen = len(sig)
-		if sigLen%2 != 0 {
-			err = fmt.Errorf("Signature length is not even: [%d]", sigLen)
-			ctx.AbortWithError(500, err)
-		}
-		r := new(big.Int)
-		s := new(big.Int)
-
-		type ecdsaSignature struct {
-			R, S *big.Int
-		}
-
-		r.SetBytes(sig[0 : sigLen/2])
-		s.SetBytes(sig[sigLen/2:])
-		sig, err = asn1.Marshal(ecdsaSignature{r, s})
-		if err != nil {
-			log.WithError(err).Error("fail change ans1.format")
-			ctx.AbortWithError(500, err)
-		}
+	sig, err = formatSignature(sig, digest, keystore, &requestBody)
+	if err != nil {
+		log.WithError(err).WithField("sig_format", requestBody.Format).Error("fail to format signature")
+		ctx.AbortWithError(400, err)
+		return
 	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"uuid":      keystore.Uuid,
@@ -466,6 +508,53 @@ func sign(ctx *gin.Context) {
 	})
 }
 
+// formatSignature encodes a raw EP11 signature as requested by the sign body
+func formatSignature(sig, data []byte, keystore *KeyStore, requestBody *SignBody) ([]byte, error) {
+	opts, err := signatureOptions(keystore, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Format == util.SigFormatRaw && !opts.LowS {
+		return sig, nil
+	}
+	log.WithField("sig_format", opts.Format).WithField("low_s", opts.LowS).Info("change signature format")
+	publicKey, err := ecPublicKey(keystore)
+	if err != nil {
+		return nil, err
+	}
+	return util.FormatSignature(sig, data, publicKey, opts)
+}
+
+// signatureOptions checks the signature options of the sign body against the key
+func signatureOptions(keystore *KeyStore, requestBody *SignBody) (util.SignatureOptions, error) {
+	format, err := util.ParseSignatureFormat(requestBody.Format)
+	if err != nil {
+		return util.SignatureOptions{}, err
+	}
+	opts := util.SignatureOptions{Format: format, LowS: format.DefaultLowS()}
+	if requestBody.LowS != nil {
+		opts.LowS = *requestBody.LowS
+	}
+	if requestBody.ChainID != "" {
+		if format != util.SigFormatEthereum {
+			return opts, fmt.Errorf("chain_id only applies to the ethereum format")
+		}
+		if opts.ChainID, err = parseBigInt("chain_id", requestBody.ChainID, true); err != nil {
+			return opts, err
+		}
+	}
+	if requestBody.Compressed {
+		if format != util.SigFormatCompact {
+			return opts, fmt.Errorf("compressed only applies to the compact format")
+		}
+		opts.Compressed = true
+	}
+	if format.Recoverable() && keystore.Curve != CurveSecp256k1 {
+		return opts, fmt.Errorf("%s signatures require a secp256k1 key, key %s is %s", format, keystore.Uuid, keystore.Curve)
+	}
+	return opts, nil
+}
+
 // sign by private key
 func sign_EC(ctx *gin.Context) {
 	// aes, err := loadAesKEK("")
@@ -480,14 +569,18 @@ func sign_EC(ctx *gin.Context) {
 	}
 
 	keyUUID := ctx.Param("id")
-	keystore := getKeyByUUID(getGlobal().db, keyUUID)
+	keystore, err := getUsableKey(keyUUID, KeyAlgorithmECDSA, KeyUsageSign)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
 	log.WithField("key_uuid", keyUUID).WithField("data", requestBody.Data).Info("start sign")
-	privatekey := toByte(keystore.PrivateKey)
-	// privatekey, err := decryptAES(aes, rawPrivate)
-	// if err != nil {
-	// 	log.WithError(err).Error("failed to decrypt private key")
-	// 	ctx.AbortWithError(500, err)
-	// }
+	privatekey, err := unwrapPrivateKey(keystore)
+	if err != nil {
+		log.WithError(err).Error("failed to decrypt private key")
+		ctx.AbortWithError(500, err)
+		return
+	}
 	data := bytes.NewBufferString(requestBody.Data).Bytes()
 	sig, err := signEC(privatekey, data)
 	if err != nil {
@@ -508,19 +601,46 @@ func findKeyByUUID(ctx *gin.Context) {
 		ctx.AbortWithError(400, fmt.Errorf("invalid key id"))
 	}
 
-	key := getKeyByUUID(getGlobal().db, keyUUID)
-	if key == nil {
-		ctx.AbortWithError(400, fmt.Errorf("invalid key id"))
+	key, err := getKeyAt(keyUUID, ctx.Query("path"))
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
 	}
 	if keyType == "public" {
-		ctx.JSON(http.StatusOK, gin.H{
+		if key.Algorithm == KeyAlgorithmBIP32 {
+			ctx.AbortWithError(400, fmt.Errorf("key %s is a BIP32 master key, use it with a derivation path", key.Uuid))
+			return
+		}
+		if key.KeyType != KeyTypeEC {
+			ctx.AbortWithError(400, fmt.Errorf("%s key has no public key", key.KeyType))
+			return
+		}
+		response := gin.H{
 			"uuid":    key.Uuid,
 			"type":    "public",
+			"curve":   key.Curve,
 			"content": key.PublicKey,
-		})
+		}
+		if key.DerivationPath != "" {
+			response["path"] = key.DerivationPath
+		}
+		// BIP-340 and taproot identify secp256k1 keys by their x coordinate
+		if key.Curve == CurveSecp256k1 {
+			publicKey, err := ecPublicKey(key)
+			if err != nil {
+				ctx.AbortWithError(500, err)
+				return
+			}
+			response["x_only"] = hex.EncodeToString(util.XOnlyPublicKey(publicKey))
+		}
+		ctx.JSON(http.StatusOK, response)
 		return
 	}
 	if keyType == "private" {
+		if key.DerivationPath != "" {
+			ctx.AbortWithError(400, fmt.Errorf("derived keys are not stored, export the master key %s", key.Uuid))
+			return
+		}
 		ctx.JSON(http.StatusOK, gin.H{
 			"uuid":    key.Uuid,
 			"type":    "private",
@@ -537,9 +657,18 @@ func getEthereumKey(ctx *gin.Context) {
 		ctx.AbortWithError(400, fmt.Errorf("invalid key id"))
 	}
 
-	key := getKeyByUUID(getGlobal().db, keyUUID)
-	if key == nil {
-		ctx.AbortWithError(400, fmt.Errorf("invalid key id"))
+	key, err := getKeyAt(keyUUID, ctx.Query("path"))
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	if key.Algorithm == KeyAlgorithmBIP32 {
+		ctx.AbortWithError(400, fmt.Errorf("key %s is a BIP32 master key, use it with a derivation path", key.Uuid))
+		return
+	}
+	if key.Curve != CurveSecp256k1 {
+		ctx.AbortWithError(400, fmt.Errorf("key %s is not a secp256k1 key", key.Uuid))
+		return
 	}
 	pubKeyBytes := toByte(key.PublicKey)
 	log.WithField("pubKeyBytes", toString(pubKeyBytes)).Info("get pub key bytes")
@@ -557,67 +686,83 @@ func getEthereumKey(ctx *gin.Context) {
 
 	address := crypto.PubkeyToAddress(*publicKey).Hex()
 	log.WithField("ethereum_address", address).Info("address")
+	p2wpkh, rawtr, err := bitcoinAddresses(publicKey)
+	if err != nil {
+		log.WithError(err).Error("fail to get bitcoin addresses")
+		ctx.AbortWithError(500, err)
+		return
+	}
 
-	ctx.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"uuid":              key.Uuid,
 		"type":              "EthereumKey",
 		"EthereumPublicKey": hexEthereumPublick,
 		"format":            "hex",
 		"address":           address,
-	})
+		"p2wpkh_address":    p2wpkh,
+		"rawtr_address":     rawtr,
+	}
+	if key.DerivationPath != "" {
+		response["path"] = key.DerivationPath
+	}
+	ctx.JSON(http.StatusOK, response)
 }
 
 func verifyEthereumKey(ctx *gin.Context) {
 	keyUUID := ctx.Param("id")
-	if keyUUID == "" {
-		ctx.AbortWithError(400, fmt.Errorf("invalid key id"))
-	}
 	requestBody := VeifyEthereumPubKeyBody{}
 	if err := ctx.BindJSON(&requestBody); err != nil {
 		log.WithError(err).Error("fail to read json body")
-		ctx.AbortWithError(400, err)
+		return
 	}
 
-	aes, err := loadAesKEK()
+	keystore, err := getUsableKey(keyUUID, KeyAlgorithmECDSA, KeyUsageSign)
 	if err != nil {
-		ctx.AbortWithError(500, err)
+		abortWithKeyError(ctx, err)
+		return
 	}
-
-	keystore := getKeyByUUID(getGlobal().db, keyUUID)
-	if keystore == nil {
-		ctx.AbortWithError(400, fmt.Errorf("invalid key id"))
+	if keystore.Curve != CurveSecp256k1 {
+		ctx.AbortWithError(400, fmt.Errorf("key %s is not a secp256k1 key", keystore.Uuid))
+		return
+	}
+	pubkey, err := hexutil.Decode(requestBody.EthereumPubKey)
+	if err != nil {
+		ctx.AbortWithError(400, fmt.Errorf("invalid ethereum_pub_key: %s", err))
+		return
+	}
+	publicKey, err := crypto.UnmarshalPubkey(pubkey)
+	if err != nil {
+		ctx.AbortWithError(400, fmt.Errorf("invalid ethereum_pub_key: %s", err))
+		return
+	}
+	mech, data, digest, err := ecSignInput(keystore, SignSchemeECDSA, requestBody.Mode, requestBody.Hash, toByte(requestBody.Data))
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
 	}
 
-	log.WithField("key_uuid", keyUUID).WithField("privatekey", keystore.PrivateKey).WithField("sign data", requestBody.Data).Info("start sign")
+	log.WithField("key_uuid", keyUUID).WithField("data", requestBody.Data).WithField("mode", requestBody.Mode).WithField("hash", requestBody.Hash).Info("start sign")
 
-	rawPrivate := toByte(keystore.PrivateKey)
-	privatekey, err := decryptAES(aes, rawPrivate)
+	privatekey, err := unwrapPrivateKey(keystore)
 	if err != nil {
 		log.WithError(err).Error("failed to decrypt private key")
 		ctx.AbortWithError(500, err)
+		return
 	}
-	data := bytes.NewBufferString(requestBody.Data).Bytes()
-
-	sig, err := signEC(privatekey, data)
+	sig, err := signECMechanism(mech, privatekey, data)
 	if err != nil {
 		log.WithError(err).Error("failed to sign data")
 		ctx.AbortWithError(500, err)
+		return
 	}
-
-	pubkey, err := hexutil.Decode(requestBody.EthereumPubKey)
-	if err != nil {
-		log.WithError(err).Error("failed to debug public key")
-		ctx.AbortWithError(500, err)
-	}
-
-	result := crypto.VerifySignature(pubkey, []byte(requestBody.Data), sig)
+	r, s := new(big.Int).SetBytes(sig[:len(sig)/2]), new(big.Int).SetBytes(sig[len(sig)/2:])
 	ctx.JSON(http.StatusOK, gin.H{
-		"result": result,
+		"result": ecdsa.Verify(publicKey, digest, r, s),
 	})
 }
 
 func verifySignature(ctx *gin.Context) {
-	requestBody := VerifyBody{}
+	requestBody := ECVerifyBody{}
 	if err := ctx.BindJSON(&requestBody); err != nil {
 		log.WithError(err).Error("fail to read json body")
 		ctx.AbortWithError(400, err)
@@ -625,12 +770,26 @@ func verifySignature(ctx *gin.Context) {
 
 	log.WithField("requestBody", requestBody).Info("start sign")
 	keyUUID := ctx.Param("id")
-	keystore := getKeyByUUID(getGlobal().db, keyUUID)
-	//data := bytes.NewBufferString(requestBody.Data).Bytes()
-	result, err := verifyEC(toByte(requestBody.Signature), toByte(keystore.PublicKey), toByte(requestBody.Data))
+	keystore, err := getUsableKeyAt(keyUUID, ctx.Query("path"), KeyAlgorithmECDSA, KeyUsageVerify)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	mech, data, _, err := ecSignInput(keystore, requestBody.Scheme, requestBody.Mode, requestBody.Hash, toByte(requestBody.Data))
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
+	}
+	// BIP-340 is checked by the server, EP11 has no BIP-340 mechanism
+	if requestBody.Scheme == SignSchemeSchnorr {
+		ctx.JSON(http.StatusOK, gin.H{"result": checkSchnorrSignature(keystore, data, toByte(requestBody.Signature)) == nil})
+		return
+	}
+	result, err := verifyEC(mech, toByte(requestBody.Signature), toByte(keystore.PublicKey), data)
 	if err != nil {
 		log.WithError(err).Error("failed to verify signature")
 		ctx.AbortWithError(500, err)
+		return
 	}
 	ctx.JSON(http.StatusOK, gin.H{"result": result})
 }
@@ -643,41 +802,8 @@ func getMechanismInfo(ctx *gin.Context) {
 	ctx.String(http.StatusOK, mc)
 }
 
-func loadAesKEK() ([]byte, error) {
-	kekPath := path.Join(getGlobal().cfg.SecureEnclavePath, "KEK.key")
-	if len(kek) != 0 {
-		return kek, nil
-	}
-	log.WithField("kay_path", kekPath).Info("get kek")
-	kek, err := ioutil.ReadFile(kekPath)
-	if err == nil && len(kek) > 0 {
-		log.Info("load kek from local file")
-		return kek, nil
-	}
-	log.WithError(err).Error("failed to read key path from load, start to generate a new kek")
-	log.Info("generate a new KEK")
-	kek, err = generateAESKey()
-	if err != nil {
-		log.WithError(err).Error("failed to generate KEK")
-		return nil, err
-	}
-	log.WithField("kek", toString(kek)).Info("success generate KEK")
-	log.Info("write kek to secure enclave data volume")
-	if err = ioutil.WriteFile(kekPath, kek, 0644); err != nil {
-		log.WithError(err).Error("generate key fail")
-		return nil, err
-	}
-	return kek, nil
-}
-
 func generateIV() ([]byte, error) {
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
-
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 	rngTemplate := &pb.GenerateRandomRequest{
 		Len: (uint64)(ep11.AES_BLOCK_SIZE),
 	}
@@ -692,13 +818,7 @@ func generateIV() ([]byte, error) {
 
 // generate aes to kek
 func generateAESKey() ([]byte, error) {
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
-
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 	keyLen := 128 // bits
 
 	// Setup the AES key's attributes
@@ -727,13 +847,7 @@ func generateAESKey() ([]byte, error) {
 
 // 通过KEK加密私钥
 func encryptAES(kek, plain []byte) ([]byte, error) {
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
-
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 
 	encryptRequest := &pb.EncryptSingleRequest{
 		Mech:  &pb.Mechanism{Mechanism: ep11.CKM_AES_ECB},
@@ -751,13 +865,7 @@ func encryptAES(kek, plain []byte) ([]byte, error) {
 }
 
 func encryptAESCBC(key, plain, iv []byte) ([]byte, error) {
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
-
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 
 	encryptRequest := &pb.EncryptSingleRequest{
 		Mech:  &pb.Mechanism{Mechanism: ep11.CKM_AES_CBC_PAD, Parameter: util.SetMechParm(iv)},
@@ -776,13 +884,7 @@ func encryptAESCBC(key, plain, iv []byte) ([]byte, error) {
 
 // 通过KEK解密私钥
 func decryptAES(kek, ciphered []byte) ([]byte, error) {
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
-
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 
 	decryptSingleRequest := &pb.DecryptSingleRequest{
 		Mech:     &pb.Mechanism{Mechanism: ep11.CKM_AES_ECB},
@@ -799,16 +901,47 @@ func decryptAES(kek, ciphered []byte) ([]byte, error) {
 	return decryptResponse.GetPlain(), nil
 }
 
-func unwrapByAESCBC(encryptedPrivateKey, aesKey, iv []byte) ([]byte, error) {
-	keyLen := 128 // bits
+// 通过KEK以AES-KWP (RFC 5649) 加密私钥，密文带完整性校验
+func encryptAESKWP(kek, plain []byte) ([]byte, error) {
+	cryptoClient := getGlobal().backend
+
+	// without parameter the default initial value of RFC 5649 is used
+	encryptRequest := &pb.EncryptSingleRequest{
+		Mech:  &pb.Mechanism{Mechanism: ep11.CKM_AES_KEY_WRAP_PAD},
+		Key:   kek,
+		Plain: plain,
+	}
+
+	encryptResponse, err := cryptoClient.EncryptSingle(context.Background(), encryptRequest)
+	if err != nil {
+		log.WithError(err).Error("failed to encrypt key by aes kwp")
+		return nil, err
+	}
+	return encryptResponse.GetCiphered(), nil
+}
+
+// 通过KEK解密AES-KWP 加密的私钥，密文被修改时解密失败
+func decryptAESKWP(kek, ciphered []byte) ([]byte, error) {
+	cryptoClient := getGlobal().backend
+
+	decryptSingleRequest := &pb.DecryptSingleRequest{
+		Mech:     &pb.Mechanism{Mechanism: ep11.CKM_AES_KEY_WRAP_PAD},
+		Key:      kek,
+		Ciphered: ciphered,
+	}
 
-	conn, err := getGlobal().grpcClient()
+	decryptResponse, err := cryptoClient.DecryptSingle(context.Background(), decryptSingleRequest)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to server: %s", err)
+		log.WithError(err).Error("fail to decrypt private key by KEK with aes kwp, the key blob is corrupted")
+		return nil, err
 	}
-	defer conn.Close()
+	return decryptResponse.GetPlain(), nil
+}
+
+func unwrapByAESCBC(encryptedPrivateKey, aesKey, iv []byte) ([]byte, error) {
+	keyLen := 128 // bits
 
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 
 	// Setup the AES key's attributes
 	aesUnwrapKeyTemplate := ep11.EP11Attributes{
@@ -838,16 +971,10 @@ func unwrapByAESCBC(encryptedPrivateKey, aesKey, iv []byte) ([]byte, error) {
 	return unwrappedResponse.GetUnwrappedBytes(), nil
 }
 
-// generate EC Key pair
-func generateECKeyPair() (public, private []byte, err error) {
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
-
-	cryptoClient := pb.NewCryptoClient(conn)
-	ecParameters, err := asn1.Marshal(util.OIDNamedCurveSecp256k1)
+// generate EC Key pair on a named curve
+func generateECKeyPair(curve asn1.ObjectIdentifier) (public, private []byte, err error) {
+	cryptoClient := getGlobal().backend
+	ecParameters, err := asn1.Marshal(curve)
 	if err != nil {
 		log.WithError(err).Error("unable to encode parameter OID")
 		return nil, nil, err
@@ -877,17 +1004,18 @@ func generateECKeyPair() (public, private []byte, err error) {
 }
 
 func signEC(privateKey, data []byte) (signature []byte, err error) {
+	return signECMechanism(&pb.Mechanism{Mechanism: ep11.CKM_ECDSA}, privateKey, data)
+}
+
+// signECMechanism signs with CKM_ECDSA, one of the CKM_ECDSA_SHA* mechanisms hashing the data first,
+// or the BIP-340 Schnorr mechanism
+func signECMechanism(mech *pb.Mechanism, privateKey, data []byte) (signature []byte, err error) {
 	log.WithField("privatekey", toString(privateKey)).WithField("data", string(data)).Info("us ec to sign data")
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return nil, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
 
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 
 	signRequest := &pb.SignSingleRequest{
-		Mech:    &pb.Mechanism{Mechanism: ep11.CKM_ECDSA},
+		Mech:    mech,
 		PrivKey: privateKey,
 		Data:    data,
 	}
@@ -902,23 +1030,19 @@ func signEC(privateKey, data []byte) (signature []byte, err error) {
 	return signSingleResponse.GetSignature(), nil
 }
 
-func verifyEC(signature, pubKey, data []byte) (bool, error) {
+// verifyEC verifies with the mechanisms of signECMechanism
+func verifyEC(mech *pb.Mechanism, signature, pubKey, data []byte) (bool, error) {
 	log.Info("使用椭圆曲线算法公钥验证签名")
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return false, fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 
 	verifySingleRequest := &pb.VerifySingleRequest{
-		Mech:      &pb.Mechanism{Mechanism: ep11.CKM_ECDSA},
+		Mech:      mech,
 		PubKey:    pubKey,
 		Data:      data,
 		Signature: signature,
 	}
 
-	_, err = cryptoClient.VerifySingle(context.Background(), verifySingleRequest)
+	_, err := cryptoClient.VerifySingle(context.Background(), verifySingleRequest)
 	if ok, ep11Status := util.Convert(err); !ok {
 		if ep11Status.Code == ep11.CKR_SIGNATURE_INVALID {
 			log.WithError(err).Info("invalid signature")
@@ -931,30 +1055,10 @@ func verifyEC(signature, pubKey, data []byte) (bool, error) {
 	return true, nil
 }
 
-// https://blog.csdn.net/qq_28058509/article/details/120997693
-// https://www.systutorials.com/how-to-generate-rsa-private-and-public-key-pair-in-go-lang/
-func generateRSAPairLocal() (privateKeyBytes, publicKeyBytes []byte) {
-	//生成私钥
-	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		panic(err)
-	}
-	//生成公钥
-	publicKey := &privateKey.PublicKey
-	privateKeyBytes = x509.MarshalPKCS1PrivateKey(privateKey)
-	publicKeyBytes = x509.MarshalPKCS1PublicKey(publicKey)
-	return privateKeyBytes, publicKeyBytes
-}
-
 func listMechanismInfo() (string, error) {
 	log.Info("get mechanism")
-	conn, err := getGlobal().grpcClient()
-	if err != nil {
-		return "", fmt.Errorf("could not connect to server: %s", err)
-	}
-	defer conn.Close()
 
-	cryptoClient := pb.NewCryptoClient(conn)
+	cryptoClient := getGlobal().backend
 
 	mechanismListRequest := &pb.GetMechanismListRequest{}
 
@@ -1036,7 +1140,7 @@ func toByte(src string) []byte {
 // ecPubKeyASN defines the ECDSA public key ASN1 encoding structure for GREP11
 func Convert(pubKey []byte /*hsm respone中的public key*/, curve asn1.ObjectIdentifier) ([]byte, *ecdsa.PublicKey, error) {
 	nistCurve := GetNamedCurveFromOID(curve)
-	if curve == nil {
+	if nistCurve == nil {
 		return nil, nil, fmt.Errorf("could not recognize Curve from OID")
 	}
 	bitPoint, err := util.GetPubkeyBytesFromSPKI(pubKey)
@@ -1054,6 +1158,16 @@ func Convert(pubKey []byte /*hsm respone中的public key*/, curve asn1.ObjectIde
 	return ski, &ecdsa.PublicKey{Curve: nistCurve, X: x, Y: y}, nil
 }
 
+// ecPublicKey parses the public key of an EC key on the curve of the key
+func ecPublicKey(keystore *KeyStore) (*ecdsa.PublicKey, error) {
+	oid, err := curveOID(keystore.Curve)
+	if err != nil {
+		return nil, err
+	}
+	_, publicKey, err := Convert(toByte(keystore.PublicKey), oid)
+	return publicKey, err
+}
+
 // GetNamedCurveFromOID returns an elliptic curve from the specified curve OID
 func GetNamedCurveFromOID(oid asn1.ObjectIdentifier) elliptic.Curve {
 	if oid.Equal(util.OIDNamedCurveSecp256k1) {
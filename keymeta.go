@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"signing_server/util"
+)
+
+// key types
+const (
+	KeyTypeEC  = "EC"
+	KeyTypeRSA = "RSA"
+	KeyTypeAES = "AES"
+)
+
+// algorithms the keys are used with
+const (
+	KeyAlgorithmECDSA = "ECDSA"
+	KeyAlgorithmEdDSA = "EdDSA"
+	KeyAlgorithmRSA   = "RSA"
+	KeyAlgorithmAES   = "AES"
+	// KeyAlgorithmBIP32 master keys only derive the secp256k1 ECDSA keys of their paths
+	KeyAlgorithmBIP32 = "BIP32"
+)
+
+// named curves of EC keys
+const (
+	CurveSecp256k1 = "secp256k1"
+	CurveP224      = "P-224"
+	CurveP256      = "P-256"
+	CurveP384      = "P-384"
+	CurveP521      = "P-521"
+	// CurveEd25519 keys are EdDSA keys, they are not in namedCurves
+	CurveEd25519 = "Ed25519"
+)
+
+// key origins, keys stored before the metadata existed are unknown
+const (
+	KeyOriginGenerated = "generated"
+	KeyOriginImported  = "imported"
+	KeyOriginUnknown   = "unknown"
+)
+
+// key states, see lifecycle.go for the transitions
+const (
+	KeyStateActive          = "active"
+	KeyStateDisabled        = "disabled"
+	KeyStatePendingDeletion = "pending-deletion"
+	KeyStateDestroyed       = "destroyed"
+)
+
+// key usages, KeyStore.Usage is a comma separated list of them
+const (
+	KeyUsageSign    = "sign"
+	KeyUsageVerify  = "verify"
+	KeyUsageEncrypt = "encrypt"
+	KeyUsageDecrypt = "decrypt"
+	KeyUsageDerive  = "derive"
+)
+
+// formats of KeyStore.PrivateKey
+const (
+	// KeyBlobRaw is the EP11 key blob as returned by HPCS
+	KeyBlobRaw = 1
+	// KeyBlobKEKAESECB is the EP11 key blob encrypted by the KEK with CKM_AES_ECB,
+	// such blobs are moved to KeyBlobKEKAESKWP when the key is used
+	KeyBlobKEKAESECB = 2
+	// KeyBlobKEKAESKWP is the SHA-256 of the key uuid and public key followed by the EP11 key blob,
+	// wrapped by the KEK with CKM_AES_KEY_WRAP_PAD (RFC 5649). Version 3 is not used.
+	KeyBlobKEKAESKWP = 4
+)
+
+var errKeyNotFound = errors.New("invalid key id")
+
+var namedCurves = []struct {
+	name string
+	oid  asn1.ObjectIdentifier
+	size int
+	// other names of the curve accepted in requests, e.g. the openssl ones
+	aliases []string
+}{
+	{CurveSecp256k1, util.OIDNamedCurveSecp256k1, 256, nil},
+	{CurveP224, util.OIDNamedCurveP224, 224, []string{"secp224r1"}},
+	{CurveP256, util.OIDNamedCurveP256, 256, []string{"secp256r1", "prime256v1"}},
+	{CurveP384, util.OIDNamedCurveP384, 384, []string{"secp384r1"}},
+	{CurveP521, util.OIDNamedCurveP521, 521, []string{"secp521r1"}},
+}
+
+// parseCurve maps a curve of a request to its name in KeyStore.Curve, empty is secp256k1
+func parseCurve(curve string) (string, error) {
+	if curve == "" {
+		return CurveSecp256k1, nil
+	}
+	for _, c := range namedCurves {
+		if strings.EqualFold(curve, c.name) {
+			return c.name, nil
+		}
+		for _, alias := range c.aliases {
+			if strings.EqualFold(curve, alias) {
+				return c.name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unsupported curve %q", curve)
+}
+
+// curveOID returns the OID of a curve name of KeyStore.Curve
+func curveOID(curve string) (asn1.ObjectIdentifier, error) {
+	for _, c := range namedCurves {
+		if c.name == curve {
+			return c.oid, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported curve %q", curve)
+}
+
+// ecPublicKeyCurve returns the curve name and size of an EC public key in SPKI form
+func ecPublicKeyCurve(spki []byte) (string, int, error) {
+	info := struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{}
+	if _, err := asn1.Unmarshal(spki, &info); err != nil {
+		return "", 0, fmt.Errorf("invalid public key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(util.OIDECPublicKey) {
+		return "", 0, fmt.Errorf("public key algorithm %s is not EC", info.Algorithm.Algorithm)
+	}
+	oid := asn1.ObjectIdentifier{}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &oid); err != nil {
+		return "", 0, fmt.Errorf("invalid curve parameters: %s", err)
+	}
+	for _, c := range namedCurves {
+		if c.oid.Equal(oid) {
+			return c.name, c.size, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unsupported curve %s", oid)
+}
+
+// newECKey describes a signing key pair, privateKey is the KEK protected blob and publicKey the SPKI, both base64.
+// New keys pass an empty privateKey and set it with wrapPrivateKey.
+func newECKey(privateKey, publicKey, origin string) (*KeyStore, error) {
+	curve, size, err := ecPublicKeyCurve(toByte(publicKey))
+	if err != nil {
+		return nil, err
+	}
+	return &KeyStore{
+		PrivateKey:  privateKey,
+		PublicKey:   publicKey,
+		KeyType:     KeyTypeEC,
+		Algorithm:   KeyAlgorithmECDSA,
+		Curve:       curve,
+		KeySize:     size,
+		Usage:       strings.Join([]string{KeyUsageSign, KeyUsageVerify}, ","),
+		Origin:      origin,
+		BlobVersion: KeyBlobKEKAESECB,
+	}, nil
+}
+
+// newEd25519Key describes an EdDSA key pair, publicKey is the SPKI returned by EP11 in base64.
+// The private key is set with wrapPrivateKey.
+func newEd25519Key(publicKey, origin string) *KeyStore {
+	return &KeyStore{
+		PublicKey: publicKey,
+		KeyType:   KeyTypeEC,
+		Algorithm: KeyAlgorithmEdDSA,
+		Curve:     CurveEd25519,
+		KeySize:   256,
+		Usage:     strings.Join([]string{KeyUsageSign, KeyUsageVerify}, ","),
+		Origin:    origin,
+	}
+}
+
+// newRSAKey describes an RSA signing key pair of size bits, publicKey is the SPKI in base64.
+// The private key is set with wrapPrivateKey.
+func newRSAKey(publicKey string, size int, origin string) *KeyStore {
+	return &KeyStore{
+		PublicKey: publicKey,
+		KeyType:   KeyTypeRSA,
+		Algorithm: KeyAlgorithmRSA,
+		KeySize:   size,
+		Usage:     strings.Join([]string{KeyUsageSign, KeyUsageVerify}, ","),
+		Origin:    origin,
+	}
+}
+
+// newBIP32MasterKey describes a BIP32 master key, chainCode and the SPKI publicKey are base64. Master keys
+// are not used to sign so they have no address, the private key is set with wrapPrivateKey.
+func newBIP32MasterKey(chainCode, publicKey, origin string) *KeyStore {
+	return &KeyStore{
+		PublicKey: publicKey,
+		ChainCode: chainCode,
+		KeyType:   KeyTypeEC,
+		Algorithm: KeyAlgorithmBIP32,
+		Curve:     CurveSecp256k1,
+		KeySize:   256,
+		Usage:     KeyUsageDerive,
+		Origin:    origin,
+	}
+}
+
+// newAESKey describes a secret key, secretKey is the raw EP11 blob in base64
+func newAESKey(secretKey string, size int, origin string) *KeyStore {
+	return &KeyStore{
+		PrivateKey:  secretKey,
+		KeyType:     KeyTypeAES,
+		Algorithm:   KeyAlgorithmAES,
+		KeySize:     size,
+		Usage:       strings.Join([]string{KeyUsageEncrypt, KeyUsageDecrypt}, ","),
+		Origin:      origin,
+		BlobVersion: KeyBlobRaw,
+	}
+}
+
+// allows checks that the key is active and meant for the operation
+func (k *KeyStore) allows(usage string) error {
+	if k.State != KeyStateActive {
+		return fmt.Errorf("key %s is %s", k.Uuid, k.State)
+	}
+	for _, u := range strings.Split(k.Usage, ",") {
+		if u == usage {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s key %s can not be used to %s", k.KeyType, k.Uuid, usage)
+}
+
+// getUsableKey finds a key by uuid or alias and checks that it can be used for the operation with the algorithm
+func getUsableKey(keyID, algorithm, usage string) (*KeyStore, error) {
+	return getUsableKeyAt(keyID, "", algorithm, usage)
+}
+
+// getUsableKeyAt is getUsableKey for the key derived at path from a BIP32 master key, or the key itself when path is empty
+func getUsableKeyAt(keyID, path, algorithm, usage string) (*KeyStore, error) {
+	keystore, err := getKeyAt(keyID, path)
+	if err != nil {
+		return nil, err
+	}
+	if keystore.Algorithm == KeyAlgorithmBIP32 && algorithm != KeyAlgorithmBIP32 {
+		return nil, fmt.Errorf("key %s is a BIP32 master key, use it with a derivation path", keystore.Uuid)
+	}
+	if keystore.Algorithm != algorithm {
+		return nil, fmt.Errorf("key %s is an %s key, not %s", keystore.Uuid, keystore.Algorithm, algorithm)
+	}
+	if err := keystore.allows(usage); err != nil {
+		return nil, err
+	}
+	return keystore, nil
+}
+
+// abortWithKeyError ends a request that could not get a usable key
+func abortWithKeyError(ctx *gin.Context, err error) {
+	log.WithError(err).WithField("key_uuid", ctx.Param("id")).Error("key can not be used")
+	if errors.Is(err, errKeyNotFound) {
+		ctx.AbortWithError(404, err)
+		return
+	}
+	if errors.Is(err, errUnsupported) {
+		ctx.AbortWithError(501, err)
+		return
+	}
+	ctx.AbortWithError(400, err)
+}
+
+// backfillKeyMetadata describes keys stored before the metadata columns existed:
+// keys without public key are imported AES keys kept as raw blobs, the others are KEK protected EC keys
+func backfillKeyMetadata(db *gorm.DB) error {
+	keys := []KeyStore{}
+	if err := db.Where("key_type IS NULL OR key_type = ''").Find(&keys).Error; err != nil {
+		return err
+	}
+	for i := range keys {
+		key := &keys[i]
+		var described *KeyStore
+		if key.PublicKey == "" {
+			described = newAESKey(key.PrivateKey, 0, KeyOriginImported)
+		} else {
+			var err error
+			if described, err = newECKey(key.PrivateKey, key.PublicKey, KeyOriginUnknown); err != nil {
+				log.WithError(err).WithField("key_uuid", key.Uuid).Warn("can not describe key")
+				continue
+			}
+		}
+		if err := db.Model(key).Updates(map[string]interface{}{
+			"key_type":     described.KeyType,
+			"algorithm":    described.Algorithm,
+			"curve":        described.Curve,
+			"key_size":     described.KeySize,
+			"usage":        described.Usage,
+			"state":        KeyStateActive,
+			"origin":       described.Origin,
+			"blob_version": described.BlobVersion,
+		}).Error; err != nil {
+			return err
+		}
+		log.WithField("key_uuid", key.Uuid).WithField("key_type", described.KeyType).Info("backfill key metadata")
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultKeyPageSize = 50
+	maxKeyPageSize     = 500
+)
+
+// KeyFilter selects keys of the listing API, empty fields match every key
+type KeyFilter struct {
+	Name          string
+	KeyType       string
+	Curve         string
+	State         string
+	Address       string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// AfterID is the position of the cursor, only keys with a greater id are returned
+	AfterID uint
+	Limit   int
+}
+
+// KeyInfo is the description of a key returned by the listing API, the private blob is only set on request
+type KeyInfo struct {
+	Uuid        string    `json:"uuid"`
+	Name        string    `json:"name"`
+	KeyType     string    `json:"key_type"`
+	Algorithm   string    `json:"algorithm"`
+	Curve       string    `json:"curve,omitempty"`
+	KeySize     int       `json:"key_size"`
+	Usage       string    `json:"usage"`
+	State       string    `json:"state"`
+	Origin      string    `json:"origin"`
+	BlobVersion int       `json:"blob_version"`
+	KekVersion  int       `json:"kek_version,omitempty"`
+	Address     string    `json:"address,omitempty"`
+	PublicKey   string    `json:"public_key,omitempty"`
+	PrivateKey  string    `json:"private_key,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newKeyInfo(key *KeyStore, withPrivate bool) *KeyInfo {
+	info := &KeyInfo{
+		Uuid:        key.Uuid,
+		Name:        key.Name,
+		KeyType:     key.KeyType,
+		Algorithm:   key.Algorithm,
+		Curve:       key.Curve,
+		KeySize:     key.KeySize,
+		Usage:       key.Usage,
+		State:       key.State,
+		Origin:      key.Origin,
+		BlobVersion: key.BlobVersion,
+		KekVersion:  key.KekVersion,
+		Address:     key.Address,
+		PublicKey:   key.PublicKey,
+		CreatedAt:   key.CreatedAt,
+		UpdatedAt:   key.UpdatedAt,
+	}
+	if withPrivate {
+		info.PrivateKey = key.PrivateKey
+	}
+	return info
+}
+
+// encodeKeyCursor turns the id of the last key of a page into an opaque cursor
+func encodeKeyCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(id), 10)))
+}
+
+func decodeKeyCursor(cursor string) (uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return uint(id), nil
+}
+
+// parseKeyFilter reads the query parameters of the listing API
+func parseKeyFilter(ctx *gin.Context) (*KeyFilter, error) {
+	filter := &KeyFilter{
+		Name:    ctx.Query("name"),
+		KeyType: ctx.Query("key_type"),
+		Curve:   ctx.Query("curve"),
+		State:   ctx.Query("state"),
+		Limit:   defaultKeyPageSize,
+	}
+	if strings.EqualFold(filter.Curve, CurveEd25519) {
+		filter.Curve = CurveEd25519
+	} else if filter.Curve != "" {
+		curve, err := parseCurve(filter.Curve)
+		if err != nil {
+			return nil, err
+		}
+		filter.Curve = curve
+	}
+	if address := ctx.Query("address"); address != "" {
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+		filter.Address = common.HexToAddress(address).Hex()
+	}
+	for param, field := range map[string]**time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		if value := ctx.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s, expect RFC3339 time: %s", param, err)
+			}
+			*field = &t
+		}
+	}
+	if limit := ctx.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxKeyPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxKeyPageSize)
+		}
+		filter.Limit = n
+	}
+	if cursor := ctx.Query("cursor"); cursor != "" {
+		id, err := decodeKeyCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter.AfterID = id
+	}
+	return filter, nil
+}
+
+// list keys page by page, private blobs are only returned with include_private=true
+func listKeys(ctx *gin.Context) {
+	filter, err := parseKeyFilter(ctx)
+	if err != nil {
+		log.WithError(err).Error("invalid key filter")
+		ctx.AbortWithError(400, err)
+		return
+	}
+	withPrivate := ctx.Query("include_private") == "true"
+
+	// fetch one more key to know if there is a next page
+	keys, err := searchKeys(getGlobal().db, filter, filter.Limit+1)
+	if err != nil {
+		log.WithError(err).Error("failed to list keys")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	nextCursor := ""
+	if len(keys) > filter.Limit {
+		keys = keys[:filter.Limit]
+		nextCursor = encodeKeyCursor(keys[len(keys)-1].ID)
+	}
+
+	infos := make([]*KeyInfo, 0, len(keys))
+	for i := range keys {
+		infos = append(infos, newKeyInfo(&keys[i], withPrivate))
+	}
+	log.WithField("count", len(infos)).WithField("include_private", withPrivate).Info("list keys")
+	ctx.JSON(http.StatusOK, gin.H{
+		"keys":        infos,
+		"next_cursor": nextCursor,
+	})
+}
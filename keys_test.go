@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listTestKeys lists the keys matching query and returns them with the cursor of the next page
+func listTestKeys(t *testing.T, r *gin.Engine, query url.Values) ([]map[string]interface{}, string) {
+	t.Helper()
+	code, m := doJSON(t, r, "GET", "/v1/grep11/keys?"+query.Encode(), nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	keys := []map[string]interface{}{}
+	for _, key := range m["keys"].([]interface{}) {
+		keys = append(keys, key.(map[string]interface{}))
+	}
+	return keys, m["next_cursor"].(string)
+}
+
+// the listing pages with a cursor, filters keys and leaves private blobs out unless asked
+func TestListKeys(t *testing.T) {
+	r := testRouter()
+	start := time.Now().Add(-time.Second)
+	created := []string{}
+	addresses := map[string]string{}
+	for _, route := range []struct{ url, curve string }{
+		{"/v1/grep11/key/secp256k1/generate_key_pair", ""},
+		{"/v1/grep11/key/secp256k1/generate_key_pair", CurveP256},
+		{"/v1/grep11/key/secp256k1/generate_key_pair", ""},
+		{"/v1/grep11/key/ed25519/generate_key_pair", ""},
+		{"/v1/grep11/key/secp256k1/generate_key_pair", ""},
+	} {
+		code, m := doJSON(t, r, "POST", route.url, map[string]string{"curve": route.curve})
+		if code != 200 {
+			t.Fatal(code, m)
+		}
+		id := m["uuid"].(string)
+		created = append(created, id)
+		addresses[id] = getKey(getGlobal().db, id).Address
+	}
+	ours := func(keys []map[string]interface{}) []string {
+		uuids := []string{}
+		for _, key := range keys {
+			for _, id := range created {
+				if key["uuid"] == id {
+					uuids = append(uuids, id)
+				}
+			}
+		}
+		return uuids
+	}
+	after := start.Format(time.RFC3339Nano)
+
+	// start after the keys of the other tests, pages of two keys come in creation order and the last one has no cursor
+	listed := []string{}
+	query := url.Values{"cursor": {encodeKeyCursor(getKey(getGlobal().db, created[0]).ID - 1)}, "limit": {"2"}}
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatal("cursor never ends")
+		}
+		keys, cursor := listTestKeys(t, r, query)
+		for _, key := range keys {
+			listed = append(listed, key["uuid"].(string))
+		}
+		if cursor == "" {
+			break
+		}
+		query.Set("cursor", cursor)
+	}
+	if len(listed) != len(created) {
+		t.Fatal(listed)
+	}
+	for i := range created {
+		if listed[i] != created[i] {
+			t.Fatal(i, listed)
+		}
+	}
+
+	if keys, _ := listTestKeys(t, r, url.Values{"created_after": {after}, "curve": {"prime256v1"}}); len(ours(keys)) != 1 || ours(keys)[0] != created[1] {
+		t.Fatal(keys)
+	}
+	if keys, _ := listTestKeys(t, r, url.Values{"created_after": {after}, "curve": {"ed25519"}}); len(ours(keys)) != 1 || ours(keys)[0] != created[3] {
+		t.Fatal(keys)
+	}
+	if keys, _ := listTestKeys(t, r, url.Values{"created_after": {after}, "curve": {CurveSecp256k1}}); len(ours(keys)) != 3 {
+		t.Fatal(keys)
+	}
+	if keys, _ := listTestKeys(t, r, url.Values{"address": {addresses[created[2]]}}); len(keys) != 1 || keys[0]["uuid"] != created[2] {
+		t.Fatal(keys)
+	}
+	if keys, _ := listTestKeys(t, r, url.Values{"created_before": {after}}); len(ours(keys)) != 0 {
+		t.Fatal(keys)
+	}
+	if code, m := doJSON(t, r, "POST", "/v1/grep11/keys/"+created[4]+"/disable", nil); code != 200 {
+		t.Fatal(code, m)
+	}
+	if keys, _ := listTestKeys(t, r, url.Values{"created_after": {after}, "state": {KeyStateDisabled}}); len(ours(keys)) != 1 || ours(keys)[0] != created[4] {
+		t.Fatal(keys)
+	}
+
+	keys, _ := listTestKeys(t, r, url.Values{"created_after": {after}})
+	for _, key := range keys {
+		if _, ok := key["private_key"]; ok {
+			t.Fatal("private key listed without include_private")
+		}
+	}
+	keys, _ = listTestKeys(t, r, url.Values{"created_after": {after}, "include_private": {"true"}})
+	if len(ours(keys)) != len(created) {
+		t.Fatal(keys)
+	}
+	for _, key := range keys {
+		stored := getKey(getGlobal().db, key["uuid"].(string)).PrivateKey
+		if stored != "" && key["private_key"] != stored {
+			t.Fatal("private key missing with include_private")
+		}
+	}
+
+	for _, query := range []url.Values{
+		{"cursor": {"not a cursor"}},
+		{"limit": {"0"}},
+		{"limit": {"501"}},
+		{"curve": {"curve25519"}},
+		{"address": {"0x1234"}},
+		{"created_after": {"yesterday"}},
+	} {
+		if code, m := doJSON(t, r, "GET", "/v1/grep11/keys?"+query.Encode(), nil); code != 400 {
+			t.Fatal(query, code, m)
+		}
+	}
+}
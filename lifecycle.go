@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// key lifecycle actions
+const (
+	KeyActionDisable          = "disable"
+	KeyActionEnable           = "enable"
+	KeyActionScheduleDeletion = "schedule_deletion"
+	KeyActionCancelDeletion   = "cancel_deletion"
+	KeyActionDestroy          = "destroy"
+)
+
+// keyTransitions lists for each action the states it starts from and the state it leads to
+var keyTransitions = map[string]struct {
+	from []string
+	to   string
+}{
+	KeyActionDisable:          {[]string{KeyStateActive}, KeyStateDisabled},
+	KeyActionEnable:           {[]string{KeyStateDisabled}, KeyStateActive},
+	KeyActionScheduleDeletion: {[]string{KeyStateActive, KeyStateDisabled}, KeyStatePendingDeletion},
+	KeyActionCancelDeletion:   {[]string{KeyStatePendingDeletion}, KeyStateDisabled},
+	KeyActionDestroy:          {[]string{KeyStateDisabled, KeyStatePendingDeletion}, KeyStateDestroyed},
+}
+
+var errKeyStateConflict = errors.New("action is not allowed in the current key state")
+
+// KeyAudit records every lifecycle change of a key
+type KeyAudit struct {
+	gorm.Model
+	KeyUuid   string `json:"key_uuid" gorm:"index"`
+	Action    string `json:"action"`
+	FromState string `json:"from_state"`
+	ToState   string `json:"to_state"`
+	// who asked for the change, the client address or "sweeper"
+	Actor  string `json:"actor"`
+	Detail string `json:"detail"`
+}
+
+// ScheduleDeletionBody sets the waiting period of a scheduled deletion, in days
+type ScheduleDeletionBody struct {
+	PendingDays int `json:"pending_days"`
+}
+
+// transitionKey applies a lifecycle action and its audit record in one transaction.
+// update holds the extra columns changed by the action.
+func transitionKey(db *gorm.DB, keyUUID, action, actor, detail string, update map[string]interface{}) (*KeyStore, error) {
+	transition, ok := keyTransitions[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+	key := &KeyStore{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(key, "uuid = ?", keyUUID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errKeyNotFound
+			}
+			return err
+		}
+		fromState := key.State
+		columns := map[string]interface{}{"state": transition.to}
+		for column, value := range update {
+			columns[column] = value
+		}
+		// the state condition makes concurrent transitions of the same key fail instead of overwriting each other
+		result := tx.Model(&KeyStore{}).Where("id = ? AND state IN ?", key.ID, transition.from).Updates(columns)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("%w: can not %s a %s key", errKeyStateConflict, action, fromState)
+		}
+		audit := &KeyAudit{
+			KeyUuid:   keyUUID,
+			Action:    action,
+			FromState: fromState,
+			ToState:   transition.to,
+			Actor:     actor,
+			Detail:    detail,
+		}
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		return tx.First(key, key.ID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("key_uuid", keyUUID).WithField("action", action).WithField("state", key.State).WithField("actor", actor).Info("key state changed")
+	return key, nil
+}
+
+// changeKeyState is the handler of the lifecycle endpoints, /v1/grep11/keys/:id/<action>
+func changeKeyState(action string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		keyUUID := resolveKeyID(getGlobal().db, ctx.Param("id"))
+		if keyUUID == "" {
+			ctx.AbortWithError(404, errKeyNotFound)
+			return
+		}
+		update := map[string]interface{}{}
+		detail := ""
+		switch action {
+		case KeyActionScheduleDeletion:
+			requestBody := ScheduleDeletionBody{}
+			if ctx.Request.ContentLength > 0 {
+				if err := ctx.BindJSON(&requestBody); err != nil {
+					log.WithError(err).Error("fail to read json body")
+					return
+				}
+			}
+			waitingPeriod := getGlobal().cfg.KeyDeletionWaitingPeriod
+			if requestBody.PendingDays < 0 {
+				ctx.AbortWithError(400, fmt.Errorf("pending_days must be positive"))
+				return
+			}
+			if requestBody.PendingDays > 0 {
+				waitingPeriod = time.Duration(requestBody.PendingDays) * 24 * time.Hour
+			}
+			deletionDate := time.Now().Add(waitingPeriod)
+			update["deletion_date"] = deletionDate
+			detail = fmt.Sprintf("deletion date %s", deletionDate.Format(time.RFC3339))
+		case KeyActionCancelDeletion:
+			update["deletion_date"] = nil
+		case KeyActionDestroy:
+			update["private_key"] = ""
+			update["chain_code"] = ""
+			update["deletion_date"] = nil
+			detail = "private key blob and chain code wiped"
+		}
+
+		key, err := transitionKey(getGlobal().db, keyUUID, action, ctx.ClientIP(), detail, update)
+		if err != nil {
+			log.WithError(err).WithField("key_uuid", keyUUID).WithField("action", action).Error("fail to change key state")
+			switch {
+			case errors.Is(err, errKeyNotFound):
+				ctx.AbortWithError(404, err)
+			case errors.Is(err, errKeyStateConflict):
+				ctx.AbortWithError(409, err)
+			default:
+				ctx.AbortWithError(500, err)
+			}
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"uuid":          key.Uuid,
+			"action":        action,
+			"state":         key.State,
+			"deletion_date": key.DeletionDate,
+		})
+	}
+}
+
+// sweepKeys destroys the keys whose deletion date has passed
+func sweepKeys(db *gorm.DB) {
+	keys := []KeyStore{}
+	if err := db.Where("state = ? AND deletion_date <= ?", KeyStatePendingDeletion, time.Now()).Find(&keys).Error; err != nil {
+		log.WithError(err).Error("failed to find keys to destroy")
+		return
+	}
+	for _, key := range keys {
+		update := map[string]interface{}{"private_key": "", "chain_code": "", "deletion_date": nil}
+		if _, err := transitionKey(db, key.Uuid, KeyActionDestroy, "sweeper", "waiting period is over, private key blob and chain code wiped", update); err != nil {
+			log.WithError(err).WithField("key_uuid", key.Uuid).Error("failed to destroy key")
+		}
+	}
+}
+
+// runKeySweeper destroys keys pending deletion every interval until ctx is done, an interval of 0 or less disables it
+func runKeySweeper(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	if interval <= 0 {
+		log.WithField("interval", interval).Warn("key deletion sweeper disabled, keys pending deletion are only destroyed on request")
+		return
+	}
+	log.WithField("interval", interval).Info("start key deletion sweeper")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sweepKeys(db)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
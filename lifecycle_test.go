@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// the sweeper destroys keys whose waiting period is over, an interval of 0 disables it
+func TestKeySweeper(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/generate_key_pair", "")
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	if code, m = doJSON(t, r, "POST", "/v1/grep11/keys/"+id+"/schedule_deletion", nil); code != 200 {
+		t.Fatal(code, m)
+	}
+	db := getGlobal().db
+	if err := db.Model(&KeyStore{}).Where("uuid = ?", id).Update("deletion_date", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		runKeySweeper(context.Background(), db, 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("disabled sweeper keeps running")
+	}
+	if key := getKey(db, id); key.State != KeyStatePendingDeletion {
+		t.Fatal(key.State)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runKeySweeper(ctx, db, time.Hour)
+	if key := getKey(db, id); key.State != KeyStateDestroyed || key.PrivateKey != "" {
+		t.Fatal(key.State)
+	}
+}
@@ -1,12 +1,83 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
 	log.Info("start signing server...")
+	// 启动时连接数据库与HPCS，失败时直接退出
+	getGlobal()
+	// 使用RFC 5649 的测试向量检查HPCS 的CKM_AES_KEY_WRAP_PAD，检查通过前拒绝产生、导入与重新加密私钥，
+	// 每次加密私钥时重新检查直到通过
+	verifyKeyWrap()
+	// 启动时检查CA profile 文件，配置错误时直接退出
+	if _, err := caProfiles(); err != nil {
+		log.WithError(err).Fatal("failed to load CA profiles")
+	}
+	// 后台任务在退出时停止
+	background, stopBackground := context.WithCancel(context.Background())
+	go runKeySweeper(background, getGlobal().db, getGlobal().cfg.KeyDeletionSweepInterval)
+	resumeKekRotations(background, getGlobal().db)
+
+	router := newRouter(background)
+
+	// 配置TLS_KEY_ID 后使用HTTPS，TLS 私钥为HPCS 中的密钥，证书文件修改后或收到SIGHUP 时重新加载
+	tlsConfig, tlsReloader, err := newTLSConfig(getGlobal().cfg)
+	if err != nil {
+		log.WithError(err).Fatal("failed to load TLS configuration")
+	}
+	srv := &http.Server{
+		Addr:      getGlobal().cfg.ListenAddress,
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			log.Warn("TLS_KEY_ID is not set, serve plain HTTP")
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(fmt.Sprintf("err: %v", err))
+		}
+	}()
+	if tlsReloader != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go tlsReloader.watch(background, getGlobal().cfg.TLSReloadInterval, hup)
+	}
+
+	// 收到退出信号后，先停止接收新请求并等待处理中的请求结束，再关闭到HPCS 的连接
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Info("shutdown signing server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("failed to shutdown http server")
+	}
+	stopBackground()
+	if err := getGlobal().backend.Close(); err != nil {
+		log.WithError(err).Error("failed to close crypto backend")
+	}
+}
+
+// newRouter registers the routes of the server, the KEK rotations run in background
+func newRouter(background context.Context) *gin.Engine {
 	router := gin.Default()
 
 	//get getMechanismInfo
@@ -15,6 +86,10 @@ func main() {
 	// generage key pair
 	router.POST("/v1/grep11/key/secp256k1/generate_key_pair", generageECkeyPair)
 
+	// 分页查询密钥，支持 name, key_type, curve, state, address, created_after, created_before 过滤，
+	// 默认不返回被包裹的私钥，include_private=true 时返回
+	router.GET("/v1/grep11/keys", listKeys)
+
 	// get public key
 	router.GET("/v1/grep11/key/secp256k1/:keyType/:id", findKeyByUUID)
 
@@ -28,9 +103,60 @@ func main() {
 	// sign
 	router.POST("/v1/grep11/key/secp256k1/sign/:id", sign)
 
+	// 批量签名，每个条目为 {key_id, digest, sig_format}，每个密钥只解密一次，按配置的并发数签名，
+	// 返回每个条目的签名或错误，单个条目失败不影响其他条目
+	router.POST("/v1/grep11/sign/batch", signBatch)
+
+	// 流式签名大文件，请求体为原始数据(支持chunked) 或multipart 的file 字段，边读取边计算摘要，内存占用与文件大小无关；
+	// 支持EC 与RSA 密钥，参数通过query 传入，返回签名与摘要
+	router.POST("/v1/grep11/sign/stream/:id", signStream)
+
+	// 在服务端完成以太坊交易的哈希、签名、low-S 处理与recovery id 计算，返回签名后的raw transaction
+	router.POST("/v1/grep11/key/secp256k1/sign_transaction/:id", signTransaction)
+
+	// EIP-191 personal_sign 与EIP-712 结构化数据签名，返回65 字节 r||s||v (v 为27/28)，可用ecrecover 恢复出地址
+	router.POST("/v1/grep11/key/secp256k1/personal_sign/:id", personalSign)
+	router.POST("/v1/grep11/key/secp256k1/sign_typed_data/:id", signTypedData)
+
+	// 比特币PSBT (BIP-174) 签名：对属于该密钥的输入计算legacy 或BIP-143 segwit 的sighash，
+	// 在HPCS 内签名后把DER 签名加sighash 字节写入PSBT_IN_PARTIAL_SIG，返回更新后的PSBT(base64)；
+	// taproot 输入需要BIP-340 Schnorr 签名，EP11 没有对应的机制，返回501
+	router.POST("/v1/grep11/key/secp256k1/sign_psbt/:id", signPSBT)
+
+	// Clef 外部签名器JSON-RPC 接口 (account_list, account_signTransaction, account_signData, account_signTypedData)
+	// geth 等工具可以通过 --signer https://<host>:8080/v1/clef 使用HPCS 中的secp256k1 密钥
+	router.POST("/v1/clef", gin.WrapH(newClefServer()))
+
 	// verify signature
 	router.POST("/v1/grep11/key/secp256k1/verify/:id", verifySignature)
 
+	// 任意曲线的EC 密钥：产生密钥时通过curve 指定 secp256k1 (默认), P-224, P-256, P-384, P-521，
+	// 签名、验签与公钥导出使用密钥自身的曲线；上面 /key/secp256k1 下的路由同样适用于其他曲线
+	router.POST("/v1/grep11/key/ec/generate_key_pair", generageECkeyPair)
+	router.GET("/v1/grep11/key/ec/:keyType/:id", findKeyByUUID)
+	router.POST("/v1/grep11/key/ec/sign/:id", sign)
+	router.POST("/v1/grep11/key/ec/verify/:id", verifySignature)
+
+	// Ed25519 (EdDSA) 密钥，在HPCS 内产生，使用CKM_IBM_ED25519_SHA512 对完整消息签名；
+	// 公钥可以导出为32 字节原始格式与SPKI 格式
+	router.POST("/v1/grep11/key/ed25519/generate_key_pair", generateEd25519KeyPair)
+	router.GET("/v1/grep11/key/ed25519/public/:id", getEd25519PublicKey)
+	router.POST("/v1/grep11/key/ed25519/sign/:id", signEd25519)
+	router.POST("/v1/grep11/key/ed25519/verify/:id", verifyEd25519)
+
+	// RSA 密钥(2048/3072/4096 位)，在HPCS 内产生，对digest 签名，支持PKCS#1 v1.5 与PSS 填充，
+	// hash 可选sha224/sha256/sha384/sha512
+	router.POST("/v1/grep11/key/rsa/generate_key_pair", generateRSAKeyPair)
+	router.GET("/v1/grep11/key/rsa/public/:id", getRSAPublicKey)
+	router.POST("/v1/grep11/key/rsa/sign/:id", signRSA)
+	router.POST("/v1/grep11/key/rsa/verify/:id", verifyRSA)
+
+	// BIP32 分层确定性密钥：主密钥由HPCS 内随机产生的种子派生，子密钥按路径(如 m/44'/60'/0'/0/0)
+	// 在HPCS 内通过CKM_IBM_BTC_DERIVE 派生，不落库；签名、验签、公钥、get_ethereum_key、
+	// sign_transaction、personal_sign 与sign_typed_data 路由通过 ?path= 使用派生密钥
+	router.POST("/v1/grep11/key/bip32/generate_master", generateBIP32Master)
+	router.GET("/v1/grep11/key/bip32/xpub/:id", getBIP32XPub)
+
 	// import aes key
 	router.POST("/v1/grep11/key/aes/import", importAESKey)
 
@@ -40,5 +166,44 @@ func main() {
 	// import ec key
 	router.POST("/v1/grep11/key/import_ec", importECKey)
 
-	router.Run()
+	// 密钥生命周期管理：禁用、启用、计划删除(等待期后由后台任务销毁)、取消删除、销毁
+	router.POST("/v1/grep11/keys/:id/disable", changeKeyState(KeyActionDisable))
+	router.POST("/v1/grep11/keys/:id/enable", changeKeyState(KeyActionEnable))
+	router.POST("/v1/grep11/keys/:id/schedule_deletion", changeKeyState(KeyActionScheduleDeletion))
+	router.POST("/v1/grep11/keys/:id/cancel_deletion", changeKeyState(KeyActionCancelDeletion))
+	router.POST("/v1/grep11/keys/:id/destroy", changeKeyState(KeyActionDestroy))
+
+	// PKCS#10 证书签名请求：指定subject、SAN 与key_usage/ext_key_usage，由HPCS 中的私钥签名后返回PEM，
+	// 私钥不离开HSM；支持P-224/P-256/P-384/P-521 与RSA 密钥
+	router.POST("/v1/grep11/keys/:id/csr", createCSR)
+
+	// 私有CA：把P-*/RSA 密钥指定为根CA，或导入由其他CA 签发的证书作为中间CA；按配置的profile(有效期、
+	// key usage、名称约束) 从CSR 签发证书，序列号记录在数据库中；吊销后的证书通过CRL 与OCSP 发布，均由CA 密钥在HPCS 内签名
+	router.GET("/v1/grep11/ca/profiles", listCAProfiles)
+	router.POST("/v1/grep11/cas", createCA)
+	router.GET("/v1/grep11/cas", listCAs)
+	router.GET("/v1/grep11/cas/:name", getCA)
+	router.GET("/v1/grep11/cas/:name/certificate", getCACertificate)
+	router.POST("/v1/grep11/cas/:name/issue", issueCertificate)
+	router.GET("/v1/grep11/cas/:name/certificates", listIssuedCertificates)
+	router.GET("/v1/grep11/cas/:name/certificates/:serial", getIssuedCertificate)
+	router.POST("/v1/grep11/cas/:name/certificates/:serial/revoke", revokeCertificate)
+	router.GET("/v1/grep11/cas/:name/crl", getCRL)
+	router.POST("/v1/grep11/cas/:name/ocsp", ocspResponder)
+	router.GET("/v1/grep11/cas/:name/ocsp/*request", ocspResponder)
+
+	// 密钥别名，所有 /:id 路由都可以使用uuid 或别名
+	router.GET("/v1/grep11/aliases", listAliases)
+	router.POST("/v1/grep11/aliases", createAlias)
+	router.PUT("/v1/grep11/aliases/:alias", updateAlias)
+	router.DELETE("/v1/grep11/aliases/:alias", deleteAlias)
+
+	// KEK 轮换：创建新版本的KEK 后，后台任务把所有私钥重新用新KEK 加密，服务重启后任务会继续；
+	// 没有密钥再使用的旧KEK 可以退役，退役后KEK 文件从secure enclave 中删除
+	router.GET("/v1/grep11/keks", listKEKs)
+	router.POST("/v1/grep11/keks/rotate", rotateKEK(background))
+	router.GET("/v1/grep11/keks/rotation", getKekRotation)
+	router.POST("/v1/grep11/keks/rotation/resume", resumeKekRotation(background))
+	router.POST("/v1/grep11/keks/:version/retire", retireKEK)
+	return router
 }
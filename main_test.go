@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// TestMain runs the tests against the EP11 emulator and an in-memory SQLite database
+func TestMain(m *testing.M) {
+	enclave, err := ioutil.TempDir("", "secure-enclave")
+	if err != nil {
+		panic(err)
+	}
+	for name, value := range map[string]string{
+		"POSTGRESS_ADDRESS":     "localhost",
+		"POSTGRESS_PORT":        "5432",
+		"POSTGRESS_USERNAME":    "test",
+		"POSTGRESS_PASSWORD":    "test",
+		"POSTGRESS_DBNAME":      "test",
+		"POSTGRESS_SSLROOTCERT": "test",
+		"SECURE_ENCLAVE_PATH":   enclave,
+		"CRYPTO_BACKEND":        BackendEmulator,
+	} {
+		os.Setenv(name, value)
+	}
+	gin.SetMode(gin.TestMode)
+	log.SetLevel(log.WarnLevel)
+	cfg = loadCfg()
+	db, err = gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
+	if err != nil {
+		panic(err)
+	}
+	if err := migrateDB(db); err != nil {
+		panic(err)
+	}
+	cryptoBackend = loadBackend(cfg)
+	code := m.Run()
+	os.RemoveAll(enclave)
+	os.Exit(code)
+}
+
+// testRouter serves the routes of main
+func testRouter() *gin.Engine {
+	return newRouter(context.Background())
+}
+
+// doJSON sends a JSON request and decodes the JSON response
+func doJSON(t *testing.T, r *gin.Engine, method, url string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	var data []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		data = []byte(b)
+	default:
+		data = mustJSON(t, b)
+	}
+	code, response := doRaw(r, method, url, data)
+	result := map[string]interface{}{}
+	json.Unmarshal(response, &result)
+	if code != 200 {
+		t.Logf("%s %s: %d %s", method, url, code, response)
+	}
+	return code, result
+}
+
+// doRaw sends a request and returns the response as is
+func doRaw(r *gin.Engine, method, url string, body []byte) (int, []byte) {
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// importTestKey stores the secp256k1 private key of a test vector, returns its uuid
+func importTestKey(t *testing.T, privateKey string) string {
+	t.Helper()
+	key, err := crypto.HexToECDSA(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid, _ := curveOID(CurveSecp256k1)
+	params, _ := asn1.Marshal(oid)
+	spki, err := marshalEmulatorECPublicKey(params, &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := getGlobal().backend.(*emulator).seal(&emulatorKeyObject{
+		Class:   int64(ep11.CKO_PRIVATE_KEY),
+		KeyType: int64(ep11.CKK_EC),
+		Params:  params,
+		Value:   key.D.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystore, err := newECKey("", toString(spki), KeyOriginImported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keystore.wrapPrivateKey(blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertKey(getGlobal().db, keystore); err != nil {
+		t.Fatal(err)
+	}
+	return keystore.Uuid
+}
+
+// half the order of secp256k1, the largest low-S value
+var secp256k1HalfN = new(big.Int).Rsh(crypto.S256().Params().N, 1)
+
+// isLowS tells if the s of a r||s signature is low
+func isLowS(sig []byte) bool {
+	return new(big.Int).SetBytes(sig[32:64]).Cmp(secp256k1HalfN) <= 0
+}
@@ -1,6 +1,8 @@
 
-export SIGN_HOST=localhost
+# 签名服务未设置TLS_KEY_ID 时使用HTTP，启用TLS 后SIGN_HOST 改为https://
+export SIGN_HOST=http://localhost
 export SIGNING_PORT=8080
+# 签名服务使用私有CA 的证书时，curl 需要 --cacert 指定CA 证书(可以写在 ~/.curlrc 中)；服务要求客户端证书时再加上 --cert 与 --key
 
 # 测试连通性
 curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/get_mechanismsc
@@ -8,25 +10,152 @@ curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/get_mechanismsc
 # 产生椭圆曲线Key pair
 curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/generate_key_pair -X POST -s | jq
 
-# 获取公钥
+# 产生Key pair 时可以指定key_name，key_name 会作为密钥的别名，所有 /:id 的路由都可以使用uuid 或别名
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/generate_key_pair -X POST -s -d '{"key_name":"treasury-hot-1"}' | jq
+
+# 产生其他曲线的EC Key pair，curve 可选 secp256k1 (默认), P-224, P-256, P-384, P-521 (也接受secp256r1/prime256v1 等别名)，
+# 签名、验签与公钥导出使用密钥自身的曲线，ethereum/compact 格式的签名只支持secp256k1
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/ec/generate_key_pair -X POST -s -d '{"curve":"P-256"}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/ec/public/${KEY_UUID} -s | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/ec/sign/${KEY_UUID} -X POST -s -d '{"mode":"digest","data":"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ","sig_format":"der"}' | jq
+
+# 产生Ed25519 Key pair (Solana, Cosmos, SSH 等使用)，签名的data 为base64 编码的完整消息，签名为64 字节 R||S；
+# 公钥导出为32 字节原始格式(raw, raw_base64) 与SPKI 格式(spki 为RFC 8410 格式，ep11_spki 为HPCS 返回的格式)
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/ed25519/generate_key_pair -X POST -s | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/ed25519/public/${KEY_UUID} -s | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/ed25519/sign/${KEY_UUID} -X POST -s -d '{"data":"aGVsbG8gd29ybGQ"}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/ed25519/verify/${KEY_UUID} -X POST -s -d '{"data":"aGVsbG8gd29ybGQ","signature":"<签名>"}' | jq
+
+# 产生RSA Key pair，key_size 可选2048(默认)、3072、4096；签名的data 为base64 编码的digest，
+# hash 可选sha224、sha256(默认)、sha384、sha512，padding 可选pkcs1v15(默认) 或pss，pss 的salt_length 默认为hash 长度
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/rsa/generate_key_pair -X POST -s -d '{"key_size":3072}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/rsa/public/${KEY_UUID} -s | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/rsa/sign/${KEY_UUID} -X POST -s -d '{"data":"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ","hash":"sha256","padding":"pss"}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/rsa/verify/${KEY_UUID} -X POST -s -d '{"data":"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ","hash":"sha256","padding":"pss","signature":"<签名>"}' | jq
+
+# BIP32 分层确定性密钥：主密钥(algorithm 为BIP32)由HPCS 内产生的64 字节种子通过CKM_IBM_BTC_DERIVE 派生，种子与私钥不离开HSM；
+# 子密钥按路径(如 m/44'/60'/0'/0/0，' 或h 表示hardened)在使用时派生，不落库，因此主密钥本身没有地址，不会出现在Clef 的账户列表中。
+# grep11 1.2.2 没有定义BTCDeriveParm，无法向HPCS 传递CKM_IBM_BTC_DERIVE 的参数，BIP32 目前只能在CRYPTO_BACKEND=emulator 时使用，grep11 后端返回501；
+# 主密钥的公钥取自派生结果并保存。xpub 为主网格式，path 默认为m
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/bip32/generate_master -X POST -s -d '{"key_name":"deposit-master"}' | jq
+curl "${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/bip32/xpub/deposit-master?path=m/44'/60'/0'/0" -s | jq
+# 通过 ?path= 使用派生密钥：公钥、以太坊地址、签名、验签、交易签名、personal_sign 与sign_typed_data
+curl "${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/public/deposit-master?path=m/44'/60'/0'/0/7" -s | jq
+curl "${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/get_ethereum_key/deposit-master?path=m/44'/60'/0'/0/7" -s | jq
+curl "${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign/deposit-master?path=m/44'/60'/0'/0/7" -X POST -s -d '{"mode":"digest","data":"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ","sig_format":"ethereum"}' | jq
+
+# 为HPCS 中的密钥生成PKCS#10 证书签名请求(PEM)，由私钥在HSM 内签名；只支持P-224/P-256/P-384/P-521 与RSA 密钥，
+# crypto/x509 不支持secp256k1。key_usage 可选digital_signature、content_commitment、key_encipherment、data_encipherment、
+# key_agreement、cert_sign、crl_sign；ext_key_usage 可选server_auth、client_auth、code_signing、email_protection、time_stamping、ocsp_signing
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keys/${KEY_UUID}/csr -X POST -s -d '{"subject":{"common_name":"signing.internal","organization":["Example"]},"dns_names":["signing.internal"],"ip_addresses":["10.0.0.8"],"key_usage":["digital_signature"],"ext_key_usage":["server_auth","client_auth"]}' | jq -r .csr
+
+# 私有CA：把P-*/RSA 密钥指定为CA，证书与CRL、OCSP 响应都由CA 私钥在HSM 内签名。不带certificate 时创建自签名的根CA，
+# validity 默认87600h；带certificate(由其他CA 签发给该密钥的CA 证书) 时为中间CA，chain 为上级证书，签发者是本地CA 时可省略
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/cas -X POST -s -d '{"name":"internal-root","key_id":"root-key","subject":{"common_name":"Internal Root CA","organization":["Example"]},"max_path_len":1}' | jq
+# 按profile 从CSR 签发证书，默认profile 为server、client、mtls(90 天) 与intermediate(5 年，签发中间CA)，
+# 可以通过CA_PROFILES 指定的YAML 文件增加或覆盖，文件格式如下：
+#   mtls:
+#     validity: 720h
+#     key_usage: [digital_signature]
+#     ext_key_usage: [server_auth, client_auth]
+#     name_constraints:
+#       permitted_dns_domains: [svc.internal]
+#       permitted_ip_ranges: [10.0.0.0/8]
+# 请求中的validity 不能超过profile 的有效期，证书不会超过CA 证书的有效期；返回证书、序列号与证书链
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/ca/profiles -s | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/cas/internal-root/issue -X POST -s -d "{\"profile\":\"mtls\",\"csr\":$(jq -Rs . < service.csr)}" | jq
+curl "${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/cas/internal-root/certificates?revoked=false&limit=100" -s | jq
+# 吊销证书，reason 为RFC 5280 的CRLReason(0 未指定、1 密钥泄露、4 被替代、5 停止使用等)；
+# CRL 默认为DER，format=pem 返回PEM；OCSP 支持POST(DER 请求) 与GET(base64 请求)
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/cas/internal-root/certificates/${SERIAL}/revoke -X POST -s -d '{"reason":1}' | jq
+curl "${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/cas/internal-root/crl?format=pem" -s
+openssl ocsp -issuer ca.pem -cert service.pem -url ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/cas/internal-root/ocsp -resp_text
+
+# 启用HTTPS：先以HTTP 启动(此时SIGN_HOST 使用http://)，在HPCS 中产生TLS 密钥并生成CSR，由私有CA(或其他CA) 签发证书后设置TLS_KEY_ID 与TLS_CERT_FILE 重启；
+# TLS 私钥只在HPCS 内签名握手。续期时覆盖证书文件即可，TLS_KEY_ID 使用别名时，把别名指向新密钥并替换证书可以不停机轮换密钥
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/ec/generate_key_pair -X POST -s -d '{"curve":"P-256","key_name":"signing-tls"}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keys/signing-tls/csr -X POST -s -d '{"subject":{"common_name":"signing.internal"},"dns_names":["signing.internal"]}' | jq -r .csr > signing-tls.csr
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/cas/internal-root/issue -X POST -s -d "{\"profile\":\"server\",\"csr\":$(jq -Rs . < signing-tls.csr)}" | jq -r '.certificate, .chain' > signing-tls.pem
+
+# 别名管理：创建、修改(重命名或指向其他密钥)、删除、查询
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/aliases -X POST -s -d '{"alias":"treasury-hot-2","key_id":"treasury-hot-1"}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/aliases/treasury-hot-2 -X PUT -s -d '{"alias":"treasury-cold-1"}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/aliases/treasury-cold-1 -X DELETE -s | jq
+curl "${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/aliases?key_id=treasury-hot-1" -s | jq
+
+# 分页查询密钥，返回的next_cursor 作为下一页的cursor 参数，为空时表示没有更多数据
+curl "${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keys?key_type=EC&curve=secp256k1&state=active&limit=20" -s | jq
+
+# 密钥生命周期：active -> disabled -> pending-deletion -> destroyed
+# 禁用/启用密钥，禁用后所有签名、验签、加密操作都会被拒绝
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keys/${KEY_UUID}/disable -s -X POST | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keys/${KEY_UUID}/enable -s -X POST | jq
+# 计划删除，pending_days 不填时使用KEY_DELETION_WAITING_PERIOD，等待期内可以取消(取消后密钥为disabled 状态)
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keys/${KEY_UUID}/schedule_deletion -s -X POST -d '{"pending_days":7}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keys/${KEY_UUID}/cancel_deletion -s -X POST | jq
+# 立即销毁disabled 或pending-deletion 状态的密钥，被包裹的私钥会被擦除且不可恢复，公钥与审计记录保留
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keys/${KEY_UUID}/destroy -s -X POST | jq
+
+# KEK 轮换：生成新版本KEK (SECURE_ENCLAVE_PATH/KEK.v<N>.key，版本1 为原来的KEK.key)，后台任务把所有私钥重新加密，
+# 通过rotation 查看进度，任务失败后可以resume；旧KEK 没有密钥使用后可以退役
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keks -s | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keks/rotate -s -X POST | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keks/rotation -s | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keks/rotation/resume -s -X POST | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/keks/1/retire -s -X POST | jq
+
+# 获取公钥，x_only 为BIP-340/taproot 使用的32 字节x 坐标公钥(hex)
 curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/public/${KEY_UUID} -s | jq
 
-# 获取ethereum 格式的公钥
+# 获取ethereum 格式的公钥，同时返回比特币P2WPKH 地址p2wpkh_address 与未tweak 的taproot 地址rawtr_address(网络由BITCOIN_NETWORK 指定)；
+# HPCS 不能对私钥做BIP-86 tweak，rawtr_address 的输出公钥即密钥本身，对应descriptor 为rawtr(KEY)，不是tr(KEY) 钱包的地址
 curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/get_ethereum_key/${KEY_UUID}  -s | jq
 
 # 使用secp256k1类型的私钥在HPCS 上签名，签名后使用ethereum类型的公钥验证签名，
-# 验证签名方法直接调用以太坊的库执行  crypto.VerifySignature
-# 以太坊的签名摘要必须是32位
-curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/verify_ethereum_pub_key/${KEY_UUID} -X POST  -s -d '{"data":"fad9c8855b740a0b7ed4c221dbad0f33","ethereum_pub_key":"0x0474618a3e3a8a7207c008d9a993b611b2f38f281c53cb8e1e67e5f2c9f0fd8fe572037924791385a203afe1c45149f3918b6df86918a020a822df3d1fc8508b3a"}' | jq
+# data、mode 与hash 的含义与sign 接口相同，mode 必填(digest 或message)，签名后在服务器用ethereum_pub_key 验证
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/verify_ethereum_pub_key/${KEY_UUID} -X POST  -s -d '{"mode":"digest","data":"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ","ethereum_pub_key":"0x0474618a3e3a8a7207c008d9a993b611b2f38f281c53cb8e1e67e5f2c9f0fd8fe572037924791385a203afe1c45149f3918b6df86918a020a822df3d1fc8508b3a"}' | jq
 
 ·# 获取被包裹的私钥
 curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/private/${KEY_UUID} -s | jq
 
-# 使用私钥签名数据
-curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign/${KEY_UUID}  -s -X POST -d '{"data":"the text need to encrypted to verify kay."}' | jq
+# 使用私钥签名数据，mode 必填：digest 表示data 为已计算好的摘要(长度需与曲线匹配，以太坊为32 字节Keccak-256 摘要)，
+# message 表示data 为原始消息，由hash 指定摘要算法 SHA-256、SHA-384、SHA-512 (使用HPCS 的CKM_ECDSA_SHA* 组合机制)、
+# Keccak-256、SHA3-256 (在服务端计算摘要)；data 均为base64 编码，验签使用相同的mode 与hash
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign/${KEY_UUID}  -s -X POST -d '{"mode":"message","hash":"SHA-256","data":"dGhlIHRleHQgbmVlZCB0byBlbmNyeXB0ZWQgdG8gdmVyaWZ5IGtheS4"}' | jq
+
+# 批量签名32 字节摘要，key_id 可以是uuid 或别名，sig_format/low_s/chain_id 与单个签名相同；
+# 返回的results 与items 顺序一致，每个条目包含signature 或error
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/sign/batch -s -X POST -d '{"items":[{"key_id":"treasury-hot-1","digest":"+tnIhVt0CgtrvXEdKK0PM/rZyIVbdAoLa71xHSitDzM","sig_format":"ethereum"},{"key_id":"'${KEY_UUID}'","digest":"LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ","sig_format":"der"}]}' | jq
+
+# 流式签名大文件，hash 必填(EC: SHA-256/SHA-384/SHA-512/Keccak-256/SHA3-256，RSA: sha224/sha256/sha384/sha512)，
+# EC 密钥可以指定sig_format/low_s/chain_id，RSA 密钥可以指定padding/salt_length；返回signature、digest(base64)、digest_hex 与size
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/sign/stream/${KEY_UUID}?hash=SHA-256\&sig_format=der -s -X POST -H "Content-Type: application/octet-stream" -H "Transfer-Encoding: chunked" --data-binary @./artifact.tar.gz | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/sign/stream/${KEY_UUID}?hash=sha256\&padding=pss -s -X POST -F "file=@./artifact.tar.gz" | jq
+
+# 签名以太坊交易，返回签名后的raw transaction 与交易哈希，可以直接通过 eth_sendRawTransaction 广播
+# value 与 gasPrice 单位为wei，支持十进制或0x 开头的十六进制
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign_transaction/${KEY_UUID} -s -X POST -d '{"nonce":0,"to":"0x3535353535353535353535353535353535353535","value":"1000000000000000","gas":21000,"gasPrice":"20000000000","data":"0x","chainId":"4"}' | jq
+
+# 签名EIP-1559 (type 2) 交易；type 1 为EIP-2930 access list 交易，使用gasPrice 与accessList
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign_transaction/${KEY_UUID} -s -X POST -d '{"type":2,"nonce":0,"to":"0x3535353535353535353535353535353535353535","value":"1000000000000000","gas":21000,"maxFeePerGas":"30000000000","maxPriorityFeePerGas":"1500000000","accessList":[],"chainId":"5"}' | jq
+
+# EIP-191 personal_sign，message 为文本，或者通过data 传入0x 开头的十六进制字节
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/personal_sign/${KEY_UUID} -s -X POST -d '{"message":"hello signing server"}' | jq
+
+# EIP-712 结构化数据签名，请求体与 eth_signTypedData_v4 的参数一致
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign_typed_data/${KEY_UUID} -s -X POST -d '{"types":{"EIP712Domain":[{"name":"name","type":"string"},{"name":"chainId","type":"uint256"}],"Mail":[{"name":"contents","type":"string"}]},"primaryType":"Mail","domain":{"name":"Ether Mail","chainId":"1"},"message":{"contents":"Hello, Bob!"}}' | jq
+
+# 比特币PSBT (BIP-174) 签名，psbt 为base64；对属于该密钥的P2PKH、P2SH、P2WPKH、P2SH-P2WPKH、P2WSH 输入计算sighash 并签名，
+# 签名(DER 加sighash 字节) 写入PSBT_IN_PARTIAL_SIG；legacy 输入需要PSBT_IN_NON_WITNESS_UTXO。
+# P2TR 输入需要BIP-340 Schnorr 签名，EP11 没有对应的机制，PSBT 中有属于该密钥的P2TR 输入时返回501；
+# 输入中的PSBT_IN_SIGHASH_TYPE 优先，其次为sighash_type，默认SIGHASH_ALL；inputs 中返回每个输入的类型、sighash 与结果
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign_psbt/${KEY_UUID} -s -X POST -d '{"psbt":"cHNidP8BAHECAAAAAf...","sighash_type":1}' | jq
+
+# Clef 外部签名器接口，账户为secp256k1 密钥对应的以太坊地址，geth 可以通过 --signer ${SIGN_HOST}:${SIGNING_PORT}/v1/clef 使用
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/clef -s -X POST -H "Content-Type: application/json" -d '{"jsonrpc":"2.0","id":1,"method":"account_list","params":[]}' | jq
 
 # 使用公钥验证签名
-curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/verify/${KEY_UUID}  -s -X POST -d '{"data":"the text need to encrypted to verify kay.","signature":"Tw/Dk0NUNbklut31DQctitAFeFwkCtdRP7hAcMU84dYRkdXFlCB9mEFzaGpZ+dK/786k7iVQ8a8WRCNF0U7r/Q"}' |jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/verify/${KEY_UUID}  -s -X POST -d '{"mode":"message","hash":"SHA-256","data":"dGhlIHRleHQgbmVlZCB0byBlbmNyeXB0ZWQgdG8gdmVyaWZ5IGtheS4","signature":"Tw/Dk0NUNbklut31DQctitAFeFwkCtdRP7hAcMU84dYRkdXFlCB9mEFzaGpZ+dK/786k7iVQ8a8WRCNF0U7r/Q"}' |jq
 
 # 使用master key包裹导入的AES，并持久化到HPDBaaS
 curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/aes/import -X POST -s -d '{"key_content":"E5E9FA1BA31ECD1AE84F75CAAA474F3A"}' |jq
@@ -44,15 +173,25 @@ openssl ec -in secp256k1-key-pair.pem -pubout > secp256k1-key-pub.pem
 curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/import_ec -X POST -s  -F "file=@./secp256k1-key-pair.pem" | jq
 
 # 签名ec
-curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/sign/${KEY_UUID} -s -X POST -d '{"data":"the text need to encrypted to verify kay."}' | jq
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/sign/${KEY_UUID} -s -X POST -d '{"mode":"message","hash":"SHA-256","data":"dGhlIHRleHQgbmVlZCB0byBlbmNyeXB0ZWQgdG8gdmVyaWZ5IGtheS4"}' | jq
 
 # 使用公钥验证签名
-curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/verify/${KEY_UUID} -s -X POST -d '{"data":"the text need to encrypted to verify kay.","signature":"vW3UVySThT4qQRmocPQiIus8gz1e5+Ch0XHs2YY7LlNN6HWfgWLtYcIjkZdsp0PTYYY73ffF1PnLQ1tTqmyaaQ"}'
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/verify/${KEY_UUID} -s -X POST -d '{"mode":"message","hash":"SHA-256","data":"dGhlIHRleHQgbmVlZCB0byBlbmNyeXB0ZWQgdG8gdmVyaWZ5IGtheS4","signature":"vW3UVySThT4qQRmocPQiIus8gz1e5+Ch0XHs2YY7LlNN6HWfgWLtYcIjkZdsp0PTYYY73ffF1PnLQ1tTqmyaaQ"}'
+
+#  签名ec 返回ASN.1 DER 格式 (sig_format 可选 raw/der/ethereum/compact，默认raw；"ans1" 作为der 的别名保留)
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/sign/${KEY_UUID}  -s -X POST -d '{"mode":"message","hash":"SHA-256","data":"dGhlIHRleHQgbmVlZCB0byBlbmNyeXB0ZWQgdG8gdmVyaWZ5IGtheS4","sig_format":"der"}' | jq
+
+# 签名32 字节摘要并返回以太坊65 字节 r||s||v 格式；ethereum/compact 默认做low-S 处理，可通过low_s 关闭，
+# 指定chain_id 时v 为 35+2*chain_id+recid (EIP-155)，否则为27/28
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign/${KEY_UUID}  -s -X POST -d '{"mode":"digest","data":"+tnIhVt0CgtrvXEdKK0PM/rZyIVbdAoLa71xHSitDzM","sig_format":"ethereum","chain_id":"5"}' | jq
+# compact 为比特币签名消息使用的65 字节 header||r||s，header 为27+recid，compressed 为true 时再加4(对应压缩公钥的地址)
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/sign/${KEY_UUID}  -s -X POST -d '{"mode":"digest","data":"+tnIhVt0CgtrvXEdKK0PM/rZyIVbdAoLa71xHSitDzM","sig_format":"compact","compressed":true}' | jq
 
-#  签名ec 返回ANS1
-curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/sign/${KEY_UUID}  -s -X POST -d '{"data":"the text need to encrypted to verify kay.","sig_format":"ans1"}' | jq
+# BIP-340 Schnorr 验签(scheme 为schnorr，默认ecdsa)，只支持secp256k1 密钥；验证32 字节摘要(digest 模式，或message 模式由服务器计算的摘要)的64 字节签名，由服务器完成。
+# EP11 没有产生BIP-340 签名的机制(CKM_IBM_ECDSA_OTHER 的ECSG_IBM_ECSDSA_S256 是EC-SDSA，不是BIP-340)，scheme 为schnorr 的签名请求返回501
+curl ${SIGN_HOST}:${SIGNING_PORT}/v1/grep11/key/secp256k1/verify/${KEY_UUID}  -s -X POST -d '{"scheme":"schnorr","mode":"digest","data":"+tnIhVt0CgtrvXEdKK0PM/rZyIVbdAoLa71xHSitDzM","signature":"<签名>"}' | jq
 
 # 使用本地公钥验证签名
 echo -n "the text need to encrypted to verify kay." > test.data
 echo -n "MEUCIAgZXWc826mQ9ogdt6lVYiYYHp16rDyutc4Hb8OQdH3CAiEA3OOoTPtz9QW13+RlDTO8DCSOPv4M2Q1HKlf/xXJS6+c" |gbase64 --decode -w 0  > signature.sig
-openssl pkeyutl -verify -in test.data -sigfile  signature.sig  -pubin  -inkey ec256-key-pub.pem
\ No newline at end of file
+openssl dgst -sha256 -verify ec256-key-pub.pem -signature signature.sig test.data
\ No newline at end of file
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+	"gorm.io/gorm"
+)
+
+// ocspValidity is how long OCSP responses may be cached
+const ocspValidity = time.Hour
+
+// needsRenewal tells if a signed CRL or OCSP response has less than half of its validity left,
+// until then the stored copy is served and unauthenticated downloads do not make the CA key sign
+func needsRenewal(nextUpdate time.Time, validity time.Duration) bool {
+	return time.Until(nextUpdate) < validity/2
+}
+
+var errCertificateRevoked = errors.New("certificate already revoked")
+
+// oidExtensionReasonCode is the CRL entry extension of the revocation reason
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// RevokeBody gives the RFC 5280 CRLReason of a revocation: 0 unspecified, 1 key compromise, 2 CA compromise,
+// 3 affiliation changed, 4 superseded, 5 cessation of operation, 6 certificate hold, 9 privilege withdrawn, 10 AA compromise
+type RevokeBody struct {
+	Reason int `json:"reason"`
+}
+
+// revoke a certificate issued by a CA, it is listed in the next CRLs and OCSP answers revoked
+func revokeCertificate(ctx *gin.Context) {
+	requestBody := RevokeBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	// 7 is unused and 8 remove from CRL is only for delta CRLs
+	if requestBody.Reason < 0 || requestBody.Reason > 10 || requestBody.Reason == 7 || requestBody.Reason == 8 {
+		abortWithCAError(ctx, fmt.Errorf("invalid revocation reason %d", requestBody.Reason))
+		return
+	}
+	db := getGlobal().db
+	issued, err := findIssuedCertificate(db, ctx.Param("name"), ctx.Param("serial"))
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	now := time.Now()
+	revoked := false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// only the first revocation of a certificate updates it
+		result := tx.Model(issued).Where("revoked_at IS NULL").Updates(map[string]interface{}{"revoked_at": now, "revocation_reason": requestBody.Reason, "ocsp_response": ""})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		revoked = true
+		// the stored CRL misses the certificate
+		return tx.Model(&CertificateAuthority{}).Where("name = ?", issued.CAName).Update("crl", "").Error
+	})
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	if !revoked {
+		abortWithCAError(ctx, fmt.Errorf("%w: %s", errCertificateRevoked, issued.Serial))
+		return
+	}
+	log.WithField("ca", issued.CAName).WithField("serial", issued.Serial).WithField("reason", requestBody.Reason).Info("certificate revoked")
+	// the next CRL is signed now, if it fails the next download signs it
+	if err := publishCRL(db, issued.CAName); err != nil {
+		log.WithError(err).WithField("ca", issued.CAName).Warn("failed to sign the CRL of the revocation")
+	}
+	issued.RevokedAt, issued.RevocationReason = &now, requestBody.Reason
+	ctx.JSON(http.StatusOK, issuedInfo(issued, false))
+}
+
+// publishCRL signs and stores a new CRL of a CA
+func publishCRL(db *gorm.DB, name string) error {
+	ca, caCert, err := loadCA(db, name)
+	if err != nil {
+		return err
+	}
+	keystore, err := caKey(ca)
+	if err != nil {
+		return err
+	}
+	signer, err := x509Signer(keystore)
+	if err != nil {
+		return err
+	}
+	_, err = signCRL(db, ca, caCert, signer)
+	return err
+}
+
+// publish the CRL of a CA in DER, or in PEM with format=pem. The stored CRL is served until it nears
+// its next update, revocations sign a new one.
+func getCRL(ctx *gin.Context) {
+	db := getGlobal().db
+	ca, caCert, err := loadCA(db, ctx.Param("name"))
+	if err != nil {
+		abortWithCAError(ctx, err)
+		return
+	}
+	der := toByte(ca.CRL)
+	if len(der) == 0 || needsRenewal(ca.CRLNextUpdate, getGlobal().cfg.CACRLValidity) {
+		signer, ok := caSigner(ctx, ca)
+		if !ok {
+			return
+		}
+		if der, err = signCRL(db, ca, caCert, signer); err != nil {
+			log.WithError(err).Error("failed to sign CRL")
+			ctx.AbortWithError(500, err)
+			return
+		}
+	}
+	if ctx.Query("format") == "pem" {
+		ctx.Data(http.StatusOK, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+		return
+	}
+	ctx.Data(http.StatusOK, "application/pkix-crl", der)
+}
+
+// signCRL signs a CRL of the revoked certificates of a CA with the next CRL number and stores it
+func signCRL(db *gorm.DB, ca *CertificateAuthority, caCert *x509.Certificate, signer crypto.Signer) ([]byte, error) {
+	revoked := []IssuedCertificate{}
+	// expired certificates stay in the CRL, so that a late check of a revoked certificate does not find it valid
+	if err := db.Where("ca_name = ? AND revoked_at IS NOT NULL", ca.Name).Order("id").Find(&revoked).Error; err != nil {
+		return nil, err
+	}
+	crlNumber, err := nextCRLNumber(db, ca)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:     crlNumber,
+		ThisUpdate: now,
+		NextUpdate: now.Add(getGlobal().cfg.CACRLValidity),
+	}
+	for i := range revoked {
+		entry, err := revokedEntry(&revoked[i])
+		if err != nil {
+			return nil, err
+		}
+		template.RevokedCertificates = append(template.RevokedCertificates, entry)
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, caCert, signer)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("ca", ca.Name).WithField("crl_number", crlNumber).WithField("revoked", len(revoked)).Info("CRL signed")
+	// a CRL signed meanwhile with a larger number is not replaced
+	err = db.Model(&CertificateAuthority{}).Where("id = ? AND crl_number = ?", ca.ID, ca.CRLNumber).
+		Updates(map[string]interface{}{"crl": toString(der), "crl_next_update": template.NextUpdate}).Error
+	return der, err
+}
+
+// nextCRLNumber increments the CRL number of a CA, CRL numbers must increase
+func nextCRLNumber(db *gorm.DB, ca *CertificateAuthority) (*big.Int, error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(ca).Update("crl_number", gorm.Expr("crl_number + 1")).Error; err != nil {
+			return err
+		}
+		return tx.Select("crl_number").First(ca, ca.ID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(ca.CRLNumber), nil
+}
+
+func revokedEntry(issued *IssuedCertificate) (pkix.RevokedCertificate, error) {
+	entry := pkix.RevokedCertificate{RevocationTime: issued.RevokedAt.UTC()}
+	serial, ok := new(big.Int).SetString(issued.Serial, 16)
+	if !ok {
+		return entry, fmt.Errorf("invalid serial %q", issued.Serial)
+	}
+	entry.SerialNumber = serial
+	// RFC 5280 omits the unspecified reason
+	if issued.RevocationReason != ocsp.Unspecified {
+		value, err := asn1.Marshal(asn1.Enumerated(issued.RevocationReason))
+		if err != nil {
+			return entry, err
+		}
+		entry.Extensions = []pkix.Extension{{Id: oidExtensionReasonCode, Value: value}}
+	}
+	return entry, nil
+}
+
+// answer OCSP requests for the certificates of a CA, POSTed in DER or in base64 in the URL, with responses signed by the CA key
+func ocspResponder(ctx *gin.Context) {
+	var request []byte
+	var err error
+	if ctx.Request.Method == http.MethodGet {
+		request, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(ctx.Param("request"), "/"))
+	} else {
+		request, err = ioutil.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, 64*1024))
+	}
+	if err != nil {
+		writeOCSP(ctx, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	req, err := ocsp.ParseRequest(request)
+	if err != nil {
+		log.WithError(err).Warn("malformed OCSP request")
+		writeOCSP(ctx, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	db := getGlobal().db
+	ca, caCert, err := loadCA(db, ctx.Param("name"))
+	if err != nil {
+		log.WithError(err).Warn("OCSP request for an unknown CA")
+		writeOCSP(ctx, ocsp.UnauthorizedErrorResponse)
+		return
+	}
+	if !issuedBy(req, caCert) {
+		// the responder only answers for the certificates of this CA
+		writeOCSP(ctx, ocsp.UnauthorizedErrorResponse)
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Minute)
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ocspValidity),
+		IssuerHash:   req.HashAlgorithm,
+	}
+	issued := &IssuedCertificate{}
+	err = db.First(issued, "ca_name = ? AND serial = ?", ca.Name, req.SerialNumber.Text(16)).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// RFC 5019 answers unauthorized for certificates the responder has no status of, unsigned
+		writeOCSP(ctx, ocsp.UnauthorizedErrorResponse)
+		return
+	case err != nil:
+		log.WithError(err).Error("failed to find certificate")
+		writeOCSP(ctx, ocsp.InternalErrorErrorResponse)
+		return
+	case issued.RevokedAt != nil:
+		template.Status = ocsp.Revoked
+		template.RevokedAt = issued.RevokedAt.UTC()
+		template.RevocationReason = issued.RevocationReason
+	}
+	if issued.OCSPResponse != "" && issued.OCSPHash == uint(req.HashAlgorithm) && !needsRenewal(issued.OCSPNextUpdate, ocspValidity) {
+		writeOCSP(ctx, toByte(issued.OCSPResponse))
+		return
+	}
+	keystore, err := caKey(ca)
+	var signer crypto.Signer
+	if err == nil {
+		signer, err = x509Signer(keystore)
+	}
+	if err != nil {
+		log.WithError(err).WithField("ca", ca.Name).Error("CA key can not sign OCSP responses")
+		writeOCSP(ctx, ocsp.InternalErrorErrorResponse)
+		return
+	}
+	response, err := ocsp.CreateResponse(caCert, caCert, template, signer)
+	if err != nil {
+		log.WithError(err).Error("failed to sign OCSP response")
+		writeOCSP(ctx, ocsp.InternalErrorErrorResponse)
+		return
+	}
+	log.WithField("ca", ca.Name).WithField("serial", issued.Serial).WithField("status", template.Status).Info("OCSP response signed")
+	update := db.Model(issued)
+	// a good response must not replace the revocation of a concurrent request
+	if template.Status == ocsp.Good {
+		update = update.Where("revoked_at IS NULL")
+	}
+	if err := update.Updates(map[string]interface{}{"ocsp_response": toString(response), "ocsp_hash": uint(req.HashAlgorithm), "ocsp_next_update": template.NextUpdate}).Error; err != nil {
+		log.WithError(err).Warn("failed to store OCSP response")
+	}
+	writeOCSP(ctx, response)
+}
+
+// issuedBy tells if the issuer hashes of an OCSP request are the ones of a CA certificate
+func issuedBy(req *ocsp.Request, caCert *x509.Certificate) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(caCert.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false
+	}
+	h := req.HashAlgorithm.New()
+	h.Write(caCert.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(h.Sum(nil), req.IssuerKeyHash)
+}
+
+func writeOCSP(ctx *gin.Context, response []byte) {
+	ctx.Data(http.StatusOK, "application/ocsp-response", response)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"signing_server/util"
+)
+
+// RSA modulus sizes keys can be generated with
+var rsaKeySizes = []int{2048, 3072, 4096}
+
+// rsaPublicExponent is F4, the exponent crypto/rsa and most HSMs use
+const rsaPublicExponent = 65537
+
+// GenerateRSAKeyBody is the optional body of RSA key generation, the key size defaults to 2048 bits
+type GenerateRSAKeyBody struct {
+	Name    string `json:"key_name"`
+	KeySize int    `json:"key_size"`
+}
+
+// RSASignBody signs the base64 digest data, hash is sha224, sha256 (default), sha384 or sha512,
+// padding is pkcs1v15 (default) or pss. The PSS salt length defaults to the hash size.
+type RSASignBody struct {
+	Data       string `json:"data"`
+	Hash       string `json:"hash"`
+	Padding    string `json:"padding"`
+	SaltLength int    `json:"salt_length"`
+}
+
+// RSAVerifyBody verifies a signature of the base64 digest data, with the same options as RSASignBody
+type RSAVerifyBody struct {
+	RSASignBody
+	Signature string `json:"signature"`
+}
+
+// generate an RSA key pair in HPCS
+func generateRSAKeyPair(ctx *gin.Context) {
+	log.Info("start generate RSA key")
+	requestBody := GenerateRSAKeyBody{}
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.BindJSON(&requestBody); err != nil {
+			log.WithError(err).Error("fail to read json body")
+			return
+		}
+	}
+	if requestBody.KeySize == 0 {
+		requestBody.KeySize = rsaKeySizes[0]
+	}
+	supported := false
+	for _, size := range rsaKeySizes {
+		supported = supported || size == requestBody.KeySize
+	}
+	if !supported {
+		ctx.AbortWithError(400, fmt.Errorf("unsupported key_size %d, use one of %v", requestBody.KeySize, rsaKeySizes))
+		return
+	}
+	if !checkKeyName(ctx, requestBody.Name) {
+		return
+	}
+	publicKey, privateKey, err := generateRSAKeyPairInHSM(requestBody.KeySize)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	key := newRSAKey(toString(publicKey), requestBody.KeySize, KeyOriginGenerated)
+	if err := key.wrapPrivateKey(privateKey); err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	key.Name = requestBody.Name
+	keys, err := insertKey(getGlobal().db, key)
+	if err != nil {
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":     keys.Uuid,
+		"key_size": keys.KeySize,
+		"public":   keys.PublicKey,
+		"private":  keys.PrivateKey,
+	})
+}
+
+// export the public key of an RSA key as SPKI, in base64 and PEM
+func getRSAPublicKey(ctx *gin.Context) {
+	key := getKey(getGlobal().db, ctx.Param("id"))
+	if key == nil {
+		ctx.AbortWithError(404, errKeyNotFound)
+		return
+	}
+	if key.Algorithm != KeyAlgorithmRSA {
+		ctx.AbortWithError(400, fmt.Errorf("key %s is not an RSA key", key.Uuid))
+		return
+	}
+	spki := toByte(key.PublicKey)
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":     key.Uuid,
+		"key_size": key.KeySize,
+		"content":  key.PublicKey,
+		"pem":      string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: spki})),
+	})
+}
+
+// sign a digest with an RSA key
+func signRSA(ctx *gin.Context) {
+	requestBody := RSASignBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	keystore, err := getUsableKey(ctx.Param("id"), KeyAlgorithmRSA, KeyUsageSign)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	mech, data, err := rsaSignMechanism(&requestBody)
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
+	}
+	log.WithField("key_uuid", keystore.Uuid).WithField("hash", requestBody.Hash).WithField("padding", requestBody.Padding).Info("start sign RSA")
+	privateKey, err := unwrapPrivateKey(keystore)
+	if err != nil {
+		log.WithError(err).Error("failed to decrypt private key")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	signSingleResponse, err := getGlobal().backend.SignSingle(context.Background(), &pb.SignSingleRequest{
+		Mech:    mech,
+		PrivKey: privateKey,
+		Data:    data,
+	})
+	if err != nil {
+		log.WithError(err).Error("fail to sign data with RSA")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":      keystore.Uuid,
+		"action":    "sign",
+		"signature": toString(signSingleResponse.GetSignature()),
+	})
+}
+
+// verify an RSA signature in HPCS
+func verifyRSA(ctx *gin.Context) {
+	requestBody := RSAVerifyBody{}
+	if err := ctx.BindJSON(&requestBody); err != nil {
+		log.WithError(err).Error("fail to read json body")
+		return
+	}
+	keystore, err := getUsableKey(ctx.Param("id"), KeyAlgorithmRSA, KeyUsageVerify)
+	if err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	mech, data, err := rsaSignMechanism(&requestBody.RSASignBody)
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
+	}
+	_, err = getGlobal().backend.VerifySingle(context.Background(), &pb.VerifySingleRequest{
+		Mech:      mech,
+		PubKey:    toByte(keystore.PublicKey),
+		Data:      data,
+		Signature: toByte(requestBody.Signature),
+	})
+	if ok, ep11Status := util.Convert(err); !ok {
+		if ep11Status.Code == ep11.CKR_SIGNATURE_INVALID || ep11Status.Code == ep11.CKR_SIGNATURE_LEN_RANGE {
+			log.WithError(err).Info("invalid signature")
+			ctx.JSON(http.StatusOK, gin.H{"result": false})
+			return
+		}
+		log.WithError(err).Error("failed to verify signature")
+		ctx.AbortWithError(500, fmt.Errorf("verify error: [%d]: %s", ep11Status.Code, ep11Status.Detail))
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"result": true})
+}
+
+func rsaSignMechanism(requestBody *RSASignBody) (*pb.Mechanism, []byte, error) {
+	hash, err := util.ParseRSAHash(requestBody.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return util.RSASignMechanism(hash, toByte(requestBody.Data), requestBody.Padding, requestBody.SaltLength)
+}
+
+// generateRSAKeyPairInHSM returns the SPKI and the private key blob of a new RSA key pair
+func generateRSAKeyPairInHSM(bits int) (public, private []byte, err error) {
+	publicKeyTemplate := ep11.EP11Attributes{
+		ep11.CKA_VERIFY:          true,
+		ep11.CKA_MODULUS_BITS:    bits,
+		ep11.CKA_PUBLIC_EXPONENT: rsaPublicExponent,
+		ep11.CKA_EXTRACTABLE:     false,
+	}
+	privateKeyTemplate := ep11.EP11Attributes{
+		ep11.CKA_PRIVATE:     true,
+		ep11.CKA_SENSITIVE:   true,
+		ep11.CKA_SIGN:        true,
+		ep11.CKA_EXTRACTABLE: false,
+	}
+	generateKeyPairResponse, err := getGlobal().backend.GenerateKeyPair(context.Background(), &pb.GenerateKeyPairRequest{
+		Mech:            &pb.Mechanism{Mechanism: ep11.CKM_RSA_PKCS_KEY_PAIR_GEN},
+		PubKeyTemplate:  util.AttributeMap(publicKeyTemplate),
+		PrivKeyTemplate: util.AttributeMap(privateKeyTemplate),
+	})
+	if err != nil {
+		log.WithError(err).Error("generate RSA key pair error")
+		return nil, nil, err
+	}
+	if _, ok := parseRSAPublicKey(generateKeyPairResponse.GetPubKeyBytes()); !ok {
+		return nil, nil, fmt.Errorf("HPCS did not return an RSA public key")
+	}
+	return generateKeyPairResponse.GetPubKeyBytes(), generateKeyPairResponse.GetPrivKeyBytes(), nil
+}
+
+func parseRSAPublicKey(spki []byte) (*rsa.PublicKey, bool) {
+	publicKey, _, err := util.GetPubKey(spki)
+	if err != nil {
+		return nil, false
+	}
+	key, ok := publicKey.(*rsa.PublicKey)
+	return key, ok
+}
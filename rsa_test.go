@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+)
+
+// PKCS#1 v1.5 and PSS signatures of every hash verify with crypto/rsa and with the verify route
+func TestRSASignatures(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/rsa/generate_key_pair", nil)
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	spki, err := x509.ParsePKIXPublicKey(toByte(m["public"].(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, ok := spki.(*rsa.PublicKey)
+	if !ok || publicKey.N.BitLen() != 2048 {
+		t.Fatalf("%T", spki)
+	}
+
+	message := []byte("rsa signatures of a digest")
+	for _, test := range []struct {
+		hash        string
+		crypto      crypto.Hash
+		padding     string
+		saltLength  int
+		checkLength int
+	}{
+		{"sha224", crypto.SHA224, "pkcs1v15", 0, 0},
+		{"sha256", crypto.SHA256, "", 0, 0},
+		{"sha384", crypto.SHA384, "pkcs1v15", 0, 0},
+		{"sha512", crypto.SHA512, "pkcs1v15", 0, 0},
+		{"sha224", crypto.SHA224, "pss", 0, rsa.PSSSaltLengthEqualsHash},
+		{"sha256", crypto.SHA256, "pss", 0, rsa.PSSSaltLengthEqualsHash},
+		{"sha384", crypto.SHA384, "pss", 0, rsa.PSSSaltLengthEqualsHash},
+		{"sha512", crypto.SHA512, "pss", 0, rsa.PSSSaltLengthEqualsHash},
+		{"sha256", crypto.SHA256, "pss", 20, 20},
+	} {
+		h := test.crypto.New()
+		h.Write(message)
+		digest := h.Sum(nil)
+		body := RSASignBody{Data: toString(digest), Hash: test.hash, Padding: test.padding, SaltLength: test.saltLength}
+		code, m := doJSON(t, r, "POST", "/v1/grep11/key/rsa/sign/"+id, body)
+		if code != 200 {
+			t.Fatal(test.hash, test.padding, code, m)
+		}
+		signature := toByte(m["signature"].(string))
+		if test.padding == "pss" {
+			err = rsa.VerifyPSS(publicKey, test.crypto, digest, signature, &rsa.PSSOptions{SaltLength: test.checkLength})
+		} else {
+			err = rsa.VerifyPKCS1v15(publicKey, test.crypto, digest, signature)
+		}
+		if err != nil {
+			t.Fatal(test.hash, test.padding, err)
+		}
+
+		verify := RSAVerifyBody{RSASignBody: body, Signature: toString(signature)}
+		if code, m = doJSON(t, r, "POST", "/v1/grep11/key/rsa/verify/"+id, verify); code != 200 || m["result"] != true {
+			t.Fatal(test.hash, test.padding, code, m)
+		}
+		digest[0] ^= 1
+		verify.Data = toString(digest)
+		if code, m = doJSON(t, r, "POST", "/v1/grep11/key/rsa/verify/"+id, verify); code != 200 || m["result"] != false {
+			t.Fatal(test.hash, test.padding, code, m)
+		}
+	}
+
+	// the digest has to match the hash
+	body := RSASignBody{Data: toString(make([]byte, 20)), Hash: "sha256"}
+	if code, m = doJSON(t, r, "POST", "/v1/grep11/key/rsa/sign/"+id, body); code != 400 {
+		t.Fatal(code, m)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"signing_server/util"
+)
+
+// test vectors 0 and 1 of BIP-340
+var bip340Vectors = []struct {
+	privateKey, publicKey, message, signature string
+}{
+	{
+		"0000000000000000000000000000000000000000000000000000000000000003",
+		"f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca821525f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0",
+	},
+	{
+		"b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef",
+		"dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659",
+		"243f6a8885a308d313198a2e03707344a4093822299f31d0082efa98ec4e6c89",
+		"6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8dcf8c78de33418906d11ac976abccb20b091292bff4ea897efcb639ea871cfa95f6de339e4b0a",
+	},
+}
+
+// BIP-340 signatures are verified by the server, signing them is refused
+func TestSchnorrBIP340(t *testing.T) {
+	r := testRouter()
+	for i, v := range bip340Vectors {
+		id := importTestKey(t, v.privateKey)
+		message, signature := mustHex(t, v.message), mustHex(t, v.signature)
+		tampered := append([]byte{}, signature...)
+		tampered[63] ^= 1
+		for _, c := range []struct {
+			signature []byte
+			result    bool
+		}{{signature, true}, {tampered, false}} {
+			code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/verify/"+id, map[string]string{"scheme": "schnorr", "mode": "digest", "data": toString(message), "signature": toString(c.signature)})
+			if code != 200 || m["result"] != c.result {
+				t.Fatalf("vector %d: verify %v: %d %v", i, c.result, code, m)
+			}
+		}
+
+		// EP11 has no mechanism signing BIP-340
+		code, m := doJSON(t, r, "POST", "/v1/grep11/key/secp256k1/sign/"+id, map[string]string{"scheme": "schnorr", "mode": "digest", "data": toString(message)})
+		if code != 501 {
+			t.Fatalf("vector %d: %d %v", i, code, m)
+		}
+	}
+	// the emulator does not sign with the EC-SDSA variant of CKM_IBM_ECDSA_OTHER as if it were BIP-340
+	blob, err := unwrapPrivateKey(getKey(getGlobal().db, importTestKey(t, bip340Vectors[1].privateKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecsdsa := &pb.Mechanism{Mechanism: ep11.CKM_VENDOR_DEFINED + 0x10031, Parameter: util.SetMechParm([]byte{0, 0, 0, 0, 0, 0, 0, 3})}
+	if _, err := getGlobal().backend.SignSingle(context.Background(), &pb.SignSingleRequest{Mech: ecsdsa, PrivKey: blob, Data: mustHex(t, bip340Vectors[1].message)}); err == nil {
+		t.Fatal("emulator signed with CKM_IBM_ECDSA_OTHER")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"signing_server/util"
+)
+
+// streamSigner signs the digest of a streamed payload with one key
+type streamSigner struct {
+	hashName string
+	newHash  func() hash.Hash
+	// sign returns the signature of the digest with the unwrapped private key
+	sign func(privateKey, digest []byte) ([]byte, error)
+}
+
+// sign a payload of any size streamed as the request body, raw (chunked or not) or as the "file" part of a
+// multipart form. The payload is hashed while it is read and only the digest is sent to HPCS, so memory
+// does not depend on the payload size. Options are query parameters: hash (required), sig_format, low_s
+// and chain_id for EC keys, padding and salt_length for RSA keys.
+func signStream(ctx *gin.Context) {
+	keystore := getKey(getGlobal().db, ctx.Param("id"))
+	if keystore == nil {
+		abortWithKeyError(ctx, errKeyNotFound)
+		return
+	}
+	signer, err := newStreamSigner(ctx, keystore)
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
+	}
+	if keystore, err = getUsableKey(ctx.Param("id"), keystore.Algorithm, KeyUsageSign); err != nil {
+		abortWithKeyError(ctx, err)
+		return
+	}
+	payload, err := streamPayload(ctx)
+	if err != nil {
+		ctx.AbortWithError(400, err)
+		return
+	}
+	log.WithField("key_uuid", keystore.Uuid).WithField("hash", signer.hashName).Info("start stream sign")
+	h := signer.newHash()
+	size, err := io.Copy(h, payload)
+	if err != nil {
+		log.WithError(err).Error("fail to read payload")
+		ctx.AbortWithError(400, fmt.Errorf("failed to read payload: %s", err))
+		return
+	}
+	digest := h.Sum(nil)
+	privateKey, err := unwrapPrivateKey(keystore)
+	if err != nil {
+		log.WithError(err).Error("failed to decrypt private key")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	sig, err := signer.sign(privateKey, digest)
+	if err != nil {
+		log.WithError(err).Error("failed to sign digest")
+		ctx.AbortWithError(500, err)
+		return
+	}
+	log.WithField("key_uuid", keystore.Uuid).WithField("size", size).Info("stream signed")
+	ctx.JSON(http.StatusOK, gin.H{
+		"uuid":       keystore.Uuid,
+		"action":     "sign",
+		"hash":       signer.hashName,
+		"size":       size,
+		"digest":     toString(digest),
+		"digest_hex": hex.EncodeToString(digest),
+		"signature":  toString(sig),
+	})
+}
+
+// newStreamSigner checks the query options against the key before the payload is read
+func newStreamSigner(ctx *gin.Context, keystore *KeyStore) (*streamSigner, error) {
+	hashName := ctx.Query("hash")
+	if hashName == "" {
+		return nil, fmt.Errorf("hash is required")
+	}
+	switch keystore.Algorithm {
+	case KeyAlgorithmECDSA:
+		h, err := parseMessageHash(hashName)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDigestSize(keystore, make([]byte, h.new().Size())); err != nil {
+			return nil, err
+		}
+		body := &SignBody{Format: ctx.Query("sig_format"), ChainID: ctx.Query("chain_id")}
+		if lowS := ctx.Query("low_s"); lowS != "" {
+			value, err := strconv.ParseBool(lowS)
+			if err != nil {
+				return nil, fmt.Errorf("invalid low_s %q", lowS)
+			}
+			body.LowS = &value
+		}
+		opts, err := signatureOptions(keystore, body)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Format.Recoverable() && h.new().Size() != 32 {
+			return nil, fmt.Errorf("%s signatures require a 32 bytes hash, %s is %d bytes", opts.Format, h.name, h.new().Size())
+		}
+		return &streamSigner{hashName: h.name, newHash: h.new, sign: func(privateKey, digest []byte) ([]byte, error) {
+			sig, err := signEC(privateKey, digest)
+			if err != nil {
+				return nil, err
+			}
+			return formatSignature(sig, digest, keystore, body)
+		}}, nil
+	case KeyAlgorithmRSA:
+		h, err := util.ParseRSAHash(hashName)
+		if err != nil {
+			return nil, err
+		}
+		padding := ctx.Query("padding")
+		saltLength := 0
+		if salt := ctx.Query("salt_length"); salt != "" {
+			if saltLength, err = strconv.Atoi(salt); err != nil {
+				return nil, fmt.Errorf("invalid salt_length %q", salt)
+			}
+		}
+		if _, _, err := util.RSASignMechanism(h, make([]byte, h.Size()), padding, saltLength); err != nil {
+			return nil, err
+		}
+		return &streamSigner{hashName: h.String(), newHash: h.New, sign: func(privateKey, digest []byte) ([]byte, error) {
+			mech, data, err := util.RSASignMechanism(h, digest, padding, saltLength)
+			if err != nil {
+				return nil, err
+			}
+			signSingleResponse, err := getGlobal().backend.SignSingle(context.Background(), &pb.SignSingleRequest{
+				Mech:    mech,
+				PrivKey: privateKey,
+				Data:    data,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return signSingleResponse.GetSignature(), nil
+		}}, nil
+	}
+	if keystore.Algorithm == KeyAlgorithmEdDSA {
+		return nil, fmt.Errorf("%s keys can not sign a stream, Ed25519 signs the whole message in one call", keystore.Algorithm)
+	}
+	return nil, fmt.Errorf("%s keys can not sign a stream", keystore.Algorithm)
+}
+
+// streamPayload returns the "file" part of a multipart body, or the body itself.
+// Parts are read from the connection as they come, they are not buffered in memory or on disk.
+func streamPayload(ctx *gin.Context) (io.Reader, error) {
+	if !strings.HasPrefix(ctx.ContentType(), "multipart/form-data") {
+		return ctx.Request.Body, nil
+	}
+	reader, err := ctx.Request.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("multipart body has no file part")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// a stream hash longer than the curve order is rejected like a digest of the digest mode
+func TestSignStreamDigestSize(t *testing.T) {
+	r := testRouter()
+	code, m := doJSON(t, r, "POST", "/v1/grep11/key/ec/generate_key_pair", map[string]string{"curve": "P-256"})
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	id := m["uuid"].(string)
+	spki, err := x509.ParsePKIXPublicKey(toByte(m["public"].(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("artifact")
+	if code, body := doRaw(r, "POST", "/v1/grep11/sign/stream/"+id+"?hash=SHA-512&sig_format=der", payload); code != 400 {
+		t.Fatal(code, string(body))
+	}
+	code, m = doJSON(t, r, "POST", "/v1/grep11/sign/stream/"+id+"?hash=SHA-256&sig_format=der", string(payload))
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	digest := sha256.Sum256(payload)
+	if m["digest"] != toString(digest[:]) {
+		t.Fatal(m)
+	}
+	if pub := spki.(*ecdsa.PublicKey); pub.Curve != elliptic.P256() || !ecdsa.VerifyASN1(pub, digest[:], toByte(m["signature"].(string))) {
+		t.Fatal("signature does not verify")
+	}
+}
+
+// keys that can not sign a stream are named by their algorithm, only Ed25519 keys are told to sign in one call
+func TestSignStreamAlgorithm(t *testing.T) {
+	for _, test := range []struct {
+		algorithm string
+		ed25519   bool
+	}{
+		{KeyAlgorithmEdDSA, true},
+		{KeyAlgorithmBIP32, false},
+		{KeyAlgorithmAES, false},
+	} {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("POST", "/v1/grep11/sign/stream/id?hash=SHA-256", nil)
+		_, err := newStreamSigner(ctx, &KeyStore{Algorithm: test.algorithm})
+		if err == nil || !strings.HasPrefix(err.Error(), test.algorithm+" keys") || strings.Contains(err.Error(), "Ed25519") != test.ed25519 {
+			t.Fatal(test.algorithm, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The server key of HTTPS is a P-* or RSA key of the KeyStore: its blob only signs the handshakes
+// in HPCS through util.EP11PrivateKey. The key, certificate chain and client CAs are reloaded when
+// their files change or on SIGHUP, so certificates are renewed without restart. TLS_KEY_ID may be an
+// alias, pointing it to a new key with the new certificate rotates the key the same way.
+
+const (
+	// TLSClientAuthNone does not ask clients for certificates
+	TLSClientAuthNone = "none"
+	// TLSClientAuthOptional verifies the certificates clients send
+	TLSClientAuthOptional = "optional"
+	// TLSClientAuthRequire rejects clients without a certificate issued by the client CAs
+	TLSClientAuthRequire = "require"
+)
+
+// tlsReloader holds the current server certificate and client CAs
+type tlsReloader struct {
+	cfg *Config
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// newTLSConfig returns the TLS configuration of the server, or nil when TLS_KEY_ID is not set
+func newTLSConfig(cfg *Config) (*tls.Config, *tlsReloader, error) {
+	if cfg.TLSKeyId == "" {
+		return nil, nil, nil
+	}
+	var clientAuth tls.ClientAuthType
+	switch cfg.TLSClientAuth {
+	case "", TLSClientAuthNone:
+		clientAuth = tls.NoClientCert
+	case TLSClientAuthOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case TLSClientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil, fmt.Errorf("invalid tls_client_auth %q, use %s, %s or %s", cfg.TLSClientAuth, TLSClientAuthNone, TLSClientAuthOptional, TLSClientAuthRequire)
+	}
+	if clientAuth != tls.NoClientCert && cfg.TLSClientCAFile == "" {
+		return nil, nil, fmt.Errorf("tls_client_ca_file is required by tls_client_auth %s", cfg.TLSClientAuth)
+	}
+	if cfg.TLSCertFile == "" {
+		return nil, nil, fmt.Errorf("tls_cert_file is required by tls_key_id")
+	}
+	reloader := &tlsReloader{cfg: cfg}
+	if err := reloader.reload(); err != nil {
+		return nil, nil, err
+	}
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: clientAuth,
+	}
+	config := base.Clone()
+	// each handshake takes the certificate and client CAs loaded last
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		reloader.mu.RLock()
+		defer reloader.mu.RUnlock()
+		c := base.Clone()
+		c.Certificates = []tls.Certificate{*reloader.cert}
+		c.ClientCAs = reloader.clientCAs
+		return c, nil
+	}
+	return config, reloader, nil
+}
+
+// reload loads the server key, certificate chain and client CAs, the current ones stay in use if they are invalid
+func (r *tlsReloader) reload() error {
+	modTimes := map[string]time.Time{}
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	cert, err := r.loadCertificate()
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if r.cfg.TLSClientCAFile != "" {
+		data, err := ioutil.ReadFile(r.cfg.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no PEM certificate in %s", r.cfg.TLSClientCAFile)
+		}
+	}
+	r.mu.Lock()
+	r.cert, r.clientCAs, r.modTimes = cert, clientCAs, modTimes
+	r.mu.Unlock()
+	log.WithField("key_id", r.cfg.TLSKeyId).WithField("subject", cert.Leaf.Subject.String()).WithField("not_after", cert.Leaf.NotAfter).Info("TLS certificate loaded")
+	return nil
+}
+
+// loadCertificate returns the certificate with its chain and the EP11 signer of the TLS key
+func (r *tlsReloader) loadCertificate() (*tls.Certificate, error) {
+	certs, err := readCertificates(r.cfg.TLSCertFile)
+	if err != nil {
+		return nil, err
+	}
+	// the chain follows the certificate in its file or is in its own file
+	if r.cfg.TLSChainFile != "" {
+		chain, err := readCertificates(r.cfg.TLSChainFile)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, chain...)
+	}
+	leaf := certs[0]
+	if time.Now().After(leaf.NotAfter) {
+		log.WithField("not_after", leaf.NotAfter).Warn("TLS certificate expired")
+	}
+	keystore, err := getKeyAt(r.cfg.TLSKeyId, "")
+	if err == nil {
+		err = checkX509Key(keystore)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS key: %w", err)
+	}
+	signer, err := x509Signer(keystore)
+	if err != nil {
+		return nil, err
+	}
+	if publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(leaf.PublicKey) {
+		return nil, fmt.Errorf("%s is not a certificate of key %s", r.cfg.TLSCertFile, r.cfg.TLSKeyId)
+	}
+	cert := &tls.Certificate{PrivateKey: signer, Leaf: leaf}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{}
+	for _, path := range []string{r.cfg.TLSCertFile, r.cfg.TLSChainFile, r.cfg.TLSClientCAFile} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// changed tells if a file was modified since the last reload
+func (r *tlsReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		// a file being replaced may be missing for a moment
+		if err == nil && !info.ModTime().Equal(r.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files when they change until ctx is done, an interval of 0 only reloads on SIGHUP
+func (r *tlsReloader) watch(ctx context.Context, interval time.Duration, hup <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+		case <-hup:
+		}
+		if err := r.reload(); err != nil {
+			log.WithError(err).Error("failed to reload TLS certificate, keep the current one")
+		}
+	}
+}
+
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificates in %s: %s", path, err)
+	}
+	return certs, nil
+}
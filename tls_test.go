@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the server key signs TLS 1.2 and 1.3 handshakes, the certificate is reloaded when its file changes
+func TestTLS(t *testing.T) {
+	r := testRouter()
+	dir := t.TempDir()
+
+	_, m := doJSON(t, r, "POST", "/v1/grep11/key/ec/generate_key_pair", `{"curve":"P-256"}`)
+	c, m := doJSON(t, r, "POST", "/v1/grep11/cas", `{"name":"tls-root","key_id":"`+m["uuid"].(string)+`","subject":{"common_name":"TLS Root"}}`)
+	if c != 200 {
+		t.Fatal(c, m)
+	}
+	root := pemCert(t, m["certificate"].(string))
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), []byte(m["certificate"].(string)), 0600)
+
+	issueServer := func(gen, body string) (string, string) {
+		_, m := doJSON(t, r, "POST", gen, body)
+		id := m["uuid"].(string)
+		_, m = doJSON(t, r, "POST", "/v1/grep11/keys/"+id+"/csr", `{"dns_names":["localhost"],"ip_addresses":["127.0.0.1"]}`)
+		c, m := doJSON(t, r, "POST", "/v1/grep11/cas/tls-root/issue", map[string]string{"csr": m["csr"].(string), "profile": "server"})
+		if c != 200 {
+			t.Fatal(c, m)
+		}
+		return id, m["certificate"].(string)
+	}
+	keyID, certPEM := issueServer("/v1/grep11/key/ec/generate_key_pair", `{"curve":"P-256"}`)
+	certFile := filepath.Join(dir, "server.pem")
+	ioutil.WriteFile(certFile, []byte(certPEM), 0600)
+
+	// client certificate
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "svc"}}, clientKey)
+	c, m = doJSON(t, r, "POST", "/v1/grep11/cas/tls-root/issue", map[string]string{"csr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})), "profile": "client"})
+	if c != 200 {
+		t.Fatal(c, m)
+	}
+	clientCert := tls.Certificate{Certificate: [][]byte{pemCert(t, m["certificate"].(string)).Raw}, PrivateKey: clientKey}
+
+	tlsCfg := &Config{TLSKeyId: keyID, TLSCertFile: certFile, TLSClientAuth: "require", TLSClientCAFile: filepath.Join(dir, "ca.pem")}
+	if _, _, err := newTLSConfig(&Config{TLSKeyId: keyID, TLSCertFile: certFile, TLSClientAuth: "require"}); err == nil {
+		t.Fatal("no client CA")
+	}
+	if _, _, err := newTLSConfig(&Config{TLSKeyId: keyID, TLSCertFile: filepath.Join(dir, "ca.pem")}); err == nil {
+		t.Fatal("wrong cert")
+	}
+	if c, _, err := newTLSConfig(&Config{}); c != nil || err != nil {
+		t.Fatal(err)
+	}
+	config, reloader, err := newTLSConfig(tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	engine := gin.New()
+	engine.GET("/ping", func(ctx *gin.Context) { ctx.String(200, "pong") })
+	srv := &http.Server{Handler: engine, TLSConfig: config}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	get := func(certs []tls.Certificate, version uint16) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs, MaxVersion: version}}}
+		return client.Get("https://" + ln.Addr().String() + "/ping")
+	}
+	for _, v := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		resp, err := get([]tls.Certificate{clientCert}, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "pong" {
+			t.Fatal(string(b))
+		}
+	}
+	if _, err := get(nil, tls.VersionTLS13); err == nil {
+		t.Fatal("client without certificate")
+	}
+
+	// renewal with a certificate of an RSA key
+	rsaID, rsaPEM := issueServer("/v1/grep11/key/rsa/generate_key_pair", "")
+	tlsCfg.TLSKeyId = rsaID
+	time.Sleep(10 * time.Millisecond)
+	ioutil.WriteFile(certFile, []byte(rsaPEM), 0600)
+	os.Chtimes(certFile, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	if !reloader.changed() {
+		t.Fatal("not changed")
+	}
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if reloader.changed() {
+		t.Fatal("changed")
+	}
+	for _, v := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		resp, err := get([]tls.Certificate{clientCert}, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := resp.TLS.PeerCertificates[0].PublicKey.(*ecdsa.PublicKey); ok {
+			t.Fatal("old certificate")
+		}
+		resp.Body.Close()
+	}
+	// an invalid file keeps the current certificate
+	ioutil.WriteFile(certFile, []byte("junk"), 0600)
+	if err := reloader.reload(); err == nil {
+		t.Fatal("junk loaded")
+	}
+	if resp, err := get([]tls.Certificate{clientCert}, 0); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// the listen address falls back to the PORT variable, then to :8080
+func TestListenAddress(t *testing.T) {
+	for _, c := range []struct {
+		listen, port, address string
+	}{
+		{"", "", ":8080"},
+		{"", "9090", ":9090"},
+		{"127.0.0.1:7070", "9090", "127.0.0.1:7070"},
+	} {
+		t.Setenv("LISTEN_ADDRESS", c.listen)
+		t.Setenv("PORT", c.port)
+		config, err := loadConfigFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ListenAddress != c.address {
+			t.Fatal(c, config.ListenAddress)
+		}
+	}
+}
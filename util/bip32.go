@@ -0,0 +1,162 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+)
+
+// CKM_IBM_BTC_DERIVE derives BIP32 keys of secp256k1, grep11 1.2.2 does not define it
+const CKM_IBM_BTC_DERIVE = ep11.CKM_VENDOR_DEFINED + 0x70001
+
+// BIP32 derivation types of CKM_IBM_BTC_DERIVE (CK_IBM_BIP0032_*)
+const (
+	BIP32PrivateToPrivate = 1
+	BIP32PrivateToPublic  = 2
+	BIP32PublicToPublic   = 3
+	BIP32MasterKey        = 4
+)
+
+const (
+	// BIP32Hardened is added to the index of hardened children
+	BIP32Hardened uint32 = 0x80000000
+	// BIP32ChainCodeLength is the length of chain codes, CKM_IBM_BTC_DERIVE returns them first in the checksum
+	BIP32ChainCodeLength = 32
+	// BTCDeriveParmVersion is the version of CK_IBM_BTC_DERIVE_PARAMS
+	BTCDeriveParmVersion = 1
+
+	// version bytes of mainnet extended public keys
+	xpubVersion = 0x0488B21E
+)
+
+// BTCDeriveParm holds the fields of CK_IBM_BTC_DERIVE_PARAMS, the parameter of CKM_IBM_BTC_DERIVE that later
+// grep11 releases send as the typed BTCDeriveParm message. grep11 1.2.2 has no such message, so Mechanism
+// encodes it as ParameterB in a layout of this package: type, childKeyIndex, the chain code, its length and
+// version, the integers 8 bytes big endian. Only the emulator reads this layout, it is not what HPCS expects.
+type BTCDeriveParm struct {
+	Type          uint64
+	ChildKeyIndex uint64
+	// empty for the master key
+	ChainCode []byte
+	Version   uint64
+}
+
+// Mechanism returns the CKM_IBM_BTC_DERIVE mechanism of the parameter
+func (p *BTCDeriveParm) Mechanism() *pb.Mechanism {
+	parm := &bytes.Buffer{}
+	binary.Write(parm, binary.BigEndian, p.Type)
+	binary.Write(parm, binary.BigEndian, p.ChildKeyIndex)
+	parm.Write(p.ChainCode)
+	binary.Write(parm, binary.BigEndian, uint64(len(p.ChainCode)))
+	binary.Write(parm, binary.BigEndian, p.Version)
+	return &pb.Mechanism{Mechanism: CKM_IBM_BTC_DERIVE, Parameter: SetMechParm(parm.Bytes())}
+}
+
+// ParseBTCDeriveParm decodes the parameter of a mechanism built by BTCDeriveParm.Mechanism
+func ParseBTCDeriveParm(mech *pb.Mechanism) (*BTCDeriveParm, error) {
+	parm := mech.GetParameterB()
+	if len(parm) < 32 {
+		return nil, fmt.Errorf("truncated BTC derive parameter")
+	}
+	n := binary.BigEndian.Uint64(parm[len(parm)-16:])
+	if n+32 != uint64(len(parm)) {
+		return nil, fmt.Errorf("invalid BTC derive parameter length")
+	}
+	p := &BTCDeriveParm{
+		Type:          binary.BigEndian.Uint64(parm),
+		ChildKeyIndex: binary.BigEndian.Uint64(parm[8:]),
+		ChainCode:     parm[16 : 16+n],
+		Version:       binary.BigEndian.Uint64(parm[len(parm)-8:]),
+	}
+	if p.Version != BTCDeriveParmVersion {
+		return nil, fmt.Errorf("unsupported BTC derive parameter version %d", p.Version)
+	}
+	return p, nil
+}
+
+// ParseBIP32Path parses a derivation path like m/44'/60'/0'/0/1, hardened indexes end with ' or h
+func ParseBIP32Path(path string) ([]uint32, error) {
+	elements := strings.Split(strings.TrimSpace(path), "/")
+	if elements[0] != "m" {
+		return nil, fmt.Errorf("derivation path %q must start with m", path)
+	}
+	indexes := make([]uint32, 0, len(elements)-1)
+	for _, element := range elements[1:] {
+		hardened := strings.HasSuffix(element, "'") || strings.HasSuffix(element, "h") || strings.HasSuffix(element, "H")
+		if hardened {
+			element = element[:len(element)-1]
+		}
+		index, err := strconv.ParseUint(element, 10, 32)
+		if err != nil || uint32(index) >= BIP32Hardened {
+			return nil, fmt.Errorf("invalid index %q in derivation path %q", element, path)
+		}
+		if hardened {
+			index += uint64(BIP32Hardened)
+		}
+		indexes = append(indexes, uint32(index))
+	}
+	return indexes, nil
+}
+
+// FormatBIP32Path formats indexes as a derivation path, hardened indexes end with '
+func FormatBIP32Path(indexes []uint32) string {
+	path := "m"
+	for _, index := range indexes {
+		if index >= BIP32Hardened {
+			path += fmt.Sprintf("/%d'", index-BIP32Hardened)
+		} else {
+			path += fmt.Sprintf("/%d", index)
+		}
+	}
+	return path
+}
+
+// BIP32Fingerprint returns the first 4 bytes of the HASH160 of a compressed public key
+func BIP32Fingerprint(compressedPublicKey []byte) []byte {
+	return Hash160(compressedPublicKey)[:4]
+}
+
+// SerializeXPub encodes a mainnet extended public key, see BIP32 "Serialization format"
+func SerializeXPub(depth int, parentFingerprint []byte, childIndex uint32, chainCode, compressedPublicKey []byte) string {
+	data := &bytes.Buffer{}
+	binary.Write(data, binary.BigEndian, uint32(xpubVersion))
+	data.WriteByte(byte(depth))
+	data.Write(parentFingerprint)
+	binary.Write(data, binary.BigEndian, childIndex)
+	data.Write(chainCode)
+	data.Write(compressedPublicKey)
+	first := sha256.Sum256(data.Bytes())
+	checksum := sha256.Sum256(first[:])
+	data.Write(checksum[:4])
+	return base58Encode(data.Bytes())
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(data []byte) string {
+	n := new(big.Int).SetBytes(data)
+	radix, mod := big.NewInt(58), new(big.Int)
+	encoded := []byte{}
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+	// leading zero bytes are encoded as leading 1s
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
@@ -0,0 +1,129 @@
+package util
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// BitcoinHRP returns the bech32 human readable part of a network: mainnet, testnet, signet or regtest
+func BitcoinHRP(network string) (string, error) {
+	switch strings.ToLower(network) {
+	case "", "mainnet":
+		return "bc", nil
+	case "testnet", "signet":
+		return "tb", nil
+	case "regtest":
+		return "bcrt", nil
+	}
+	return "", fmt.Errorf("unknown bitcoin network %q", network)
+}
+
+// Hash160 is ripemd160(sha256(data)), the hash of public keys and scripts in bitcoin outputs
+func Hash160(data []byte) []byte {
+	sha := sha256.Sum256(data)
+	h := ripemd160.New()
+	h.Write(sha[:])
+	return h.Sum(nil)
+}
+
+// P2PKHScript is OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG, also the scriptCode of P2WPKH
+func P2PKHScript(pubKeyHash []byte) []byte {
+	return append(append([]byte{0x76, 0xa9, 0x14}, pubKeyHash...), 0x88, 0xac)
+}
+
+// P2WPKHScript is OP_0 <hash>
+func P2WPKHScript(pubKeyHash []byte) []byte {
+	return append([]byte{0x00, 0x14}, pubKeyHash...)
+}
+
+// P2SHScript is OP_HASH160 <hash> OP_EQUAL
+func P2SHScript(scriptHash []byte) []byte {
+	return append(append([]byte{0xa9, 0x14}, scriptHash...), 0x87)
+}
+
+// P2WSHScript is OP_0 <sha256 of the witness script>
+func P2WSHScript(witnessScript []byte) []byte {
+	sum := sha256.Sum256(witnessScript)
+	return append([]byte{0x00, 0x20}, sum[:]...)
+}
+
+// P2TRScript is OP_1 <x-only output key>
+func P2TRScript(outputKey []byte) []byte {
+	return append([]byte{0x51, 0x20}, outputKey...)
+}
+
+// SegwitAddress encodes a witness program, bech32 for version 0 and bech32m for later versions (BIP-350)
+func SegwitAddress(hrp string, version byte, program []byte) (string, error) {
+	data, err := convertBits(program, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	constant := uint32(1)
+	if version > 0 {
+		constant = 0x2bc830a3
+	}
+	return bech32Encode(hrp, append([]byte{version}, data...), constant), nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	generator := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32Encode(hrp string, data []byte, constant uint32) string {
+	values := []byte{}
+	for _, c := range hrp {
+		values = append(values, byte(c>>5))
+	}
+	values = append(values, 0)
+	for _, c := range hrp {
+		values = append(values, byte(c&31))
+	}
+	values = append(values, data...)
+	polymod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ constant
+	encoded := &strings.Builder{}
+	encoded.WriteString(hrp)
+	encoded.WriteByte('1')
+	for _, d := range data {
+		encoded.WriteByte(bech32Charset[d])
+	}
+	for i := 0; i < 6; i++ {
+		encoded.WriteByte(bech32Charset[(polymod>>uint(5*(5-i)))&31])
+	}
+	return encoded.String()
+}
+
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<to - 1
+	result := []byte{}
+	for _, b := range data {
+		acc = acc<<from | uint32(b)
+		bits += from
+		for bits >= to {
+			bits -= to
+			result = append(result, byte((acc>>bits)&maxv))
+		}
+	}
+	if pad && bits > 0 {
+		result = append(result, byte((acc<<(to-bits))&maxv))
+	} else if !pad && (bits >= from || (acc<<(to-bits))&maxv != 0) {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return result, nil
+}
@@ -0,0 +1,399 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// sighash types of bitcoin signatures
+const (
+	// SigHashDefault is SIGHASH_ALL for taproot signatures, which then have no sighash byte
+	SigHashDefault      uint32 = 0x00
+	SigHashAll          uint32 = 0x01
+	SigHashNone         uint32 = 0x02
+	SigHashSingle       uint32 = 0x03
+	SigHashAnyoneCanPay uint32 = 0x80
+)
+
+// BTCTx is a bitcoin transaction, see https://en.bitcoin.it/wiki/Protocol_documentation#tx
+type BTCTx struct {
+	Version  int32
+	Inputs   []*BTCTxIn
+	Outputs  []*BTCTxOut
+	LockTime uint32
+}
+
+// BTCTxIn spends the output Index of the transaction Hash, Hash is in internal byte order
+type BTCTxIn struct {
+	Hash     [32]byte
+	Index    uint32
+	Script   []byte
+	Sequence uint32
+	Witness  [][]byte
+}
+
+// BTCTxOut is a transaction output, Value is in satoshis
+type BTCTxOut struct {
+	Value  int64
+	Script []byte
+}
+
+// ParseBTCTx decodes a transaction with or without witnesses, all bytes must be used
+func ParseBTCTx(data []byte) (*BTCTx, error) {
+	r := bytes.NewReader(data)
+	tx, err := readBTCTx(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bitcoin transaction: %s", err)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("invalid bitcoin transaction: %d trailing bytes", r.Len())
+	}
+	return tx, nil
+}
+
+func readBTCTx(r *bytes.Reader) (*BTCTx, error) {
+	tx := &BTCTx{}
+	if err := binary.Read(r, binary.LittleEndian, &tx.Version); err != nil {
+		return nil, err
+	}
+	count, err := readCompactSize(r)
+	if err != nil {
+		return nil, err
+	}
+	// BIP-144: a zero input count is the segwit marker, followed by the flag 1
+	segwit := false
+	if count == 0 {
+		flag, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if flag != 1 {
+			return nil, fmt.Errorf("unknown segwit flag %d", flag)
+		}
+		segwit = true
+		if count, err = readCompactSize(r); err != nil {
+			return nil, err
+		}
+	}
+	if count > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	for i := uint64(0); i < count; i++ {
+		in := &BTCTxIn{}
+		if _, err := io.ReadFull(r, in.Hash[:]); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &in.Index); err != nil {
+			return nil, err
+		}
+		if in.Script, err = readVarBytes(r); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &in.Sequence); err != nil {
+			return nil, err
+		}
+		tx.Inputs = append(tx.Inputs, in)
+	}
+	if count, err = readCompactSize(r); err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	for i := uint64(0); i < count; i++ {
+		out := &BTCTxOut{}
+		if err := binary.Read(r, binary.LittleEndian, &out.Value); err != nil {
+			return nil, err
+		}
+		if out.Script, err = readVarBytes(r); err != nil {
+			return nil, err
+		}
+		tx.Outputs = append(tx.Outputs, out)
+	}
+	if segwit {
+		for _, in := range tx.Inputs {
+			items, err := readCompactSize(r)
+			if err != nil {
+				return nil, err
+			}
+			if items > uint64(r.Len()) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			for j := uint64(0); j < items; j++ {
+				item, err := readVarBytes(r)
+				if err != nil {
+					return nil, err
+				}
+				in.Witness = append(in.Witness, item)
+			}
+		}
+	}
+	if err := binary.Read(r, binary.LittleEndian, &tx.LockTime); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Serialize encodes the transaction without witnesses, as PSBTs and txids use it
+func (tx *BTCTx) Serialize() []byte {
+	w := &bytes.Buffer{}
+	binary.Write(w, binary.LittleEndian, tx.Version)
+	writeCompactSize(w, uint64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		in.writeOutPoint(w)
+		writeVarBytes(w, in.Script)
+		binary.Write(w, binary.LittleEndian, in.Sequence)
+	}
+	writeCompactSize(w, uint64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		out.write(w)
+	}
+	binary.Write(w, binary.LittleEndian, tx.LockTime)
+	return w.Bytes()
+}
+
+// TxHash is the txid in internal byte order, as BTCTxIn.Hash refers to it
+func (tx *BTCTx) TxHash() [32]byte {
+	return doubleSHA256(tx.Serialize())
+}
+
+func (in *BTCTxIn) writeOutPoint(w io.Writer) {
+	w.Write(in.Hash[:])
+	binary.Write(w, binary.LittleEndian, in.Index)
+}
+
+func (out *BTCTxOut) write(w io.Writer) {
+	binary.Write(w, binary.LittleEndian, out.Value)
+	writeVarBytes(w, out.Script)
+}
+
+// LegacySigHash is the digest signed by inputs of pre-segwit scripts. scriptCode is the script
+// of the spent output, or the redeem script of P2SH, without OP_CODESEPARATOR.
+func LegacySigHash(tx *BTCTx, index int, scriptCode []byte, hashType uint32) ([]byte, error) {
+	base := hashType & 0x1f
+	// consensus accepts a signature of the number 1 there, which anyone can reuse to spend the input
+	if base == SigHashSingle && index >= len(tx.Outputs) {
+		return nil, fmt.Errorf("SIGHASH_SINGLE input %d has no matching output", index)
+	}
+	signed := &BTCTx{Version: tx.Version, LockTime: tx.LockTime}
+	for i, in := range tx.Inputs {
+		copied := &BTCTxIn{Hash: in.Hash, Index: in.Index, Sequence: in.Sequence}
+		if i == index {
+			copied.Script = scriptCode
+		} else if base == SigHashNone || base == SigHashSingle {
+			copied.Sequence = 0
+		}
+		signed.Inputs = append(signed.Inputs, copied)
+	}
+	switch base {
+	case SigHashNone:
+	case SigHashSingle:
+		for i := 0; i < index; i++ {
+			signed.Outputs = append(signed.Outputs, &BTCTxOut{Value: -1})
+		}
+		signed.Outputs = append(signed.Outputs, tx.Outputs[index])
+	default:
+		signed.Outputs = tx.Outputs
+	}
+	if hashType&SigHashAnyoneCanPay != 0 {
+		signed.Inputs = signed.Inputs[index : index+1]
+	}
+	preimage := bytes.NewBuffer(signed.Serialize())
+	binary.Write(preimage, binary.LittleEndian, hashType)
+	digest := doubleSHA256(preimage.Bytes())
+	return digest[:], nil
+}
+
+// SegwitV0SigHash is the BIP-143 digest signed by inputs of witness v0 scripts, amount is the value of the spent output
+func SegwitV0SigHash(tx *BTCTx, index int, scriptCode []byte, amount int64, hashType uint32) ([]byte, error) {
+	base := hashType & 0x1f
+	anyoneCanPay := hashType&SigHashAnyoneCanPay != 0
+	// BIP-143 would sign a zero hashOutputs, committing to no output at all
+	if base == SigHashSingle && index >= len(tx.Outputs) {
+		return nil, fmt.Errorf("SIGHASH_SINGLE input %d has no matching output", index)
+	}
+	var hashPrevouts, hashSequence, hashOutputs [32]byte
+	if !anyoneCanPay {
+		w := &bytes.Buffer{}
+		for _, in := range tx.Inputs {
+			in.writeOutPoint(w)
+		}
+		hashPrevouts = doubleSHA256(w.Bytes())
+	}
+	if !anyoneCanPay && base != SigHashSingle && base != SigHashNone {
+		w := &bytes.Buffer{}
+		for _, in := range tx.Inputs {
+			binary.Write(w, binary.LittleEndian, in.Sequence)
+		}
+		hashSequence = doubleSHA256(w.Bytes())
+	}
+	if base != SigHashSingle && base != SigHashNone {
+		w := &bytes.Buffer{}
+		for _, out := range tx.Outputs {
+			out.write(w)
+		}
+		hashOutputs = doubleSHA256(w.Bytes())
+	} else if base == SigHashSingle {
+		w := &bytes.Buffer{}
+		tx.Outputs[index].write(w)
+		hashOutputs = doubleSHA256(w.Bytes())
+	}
+	in := tx.Inputs[index]
+	preimage := &bytes.Buffer{}
+	binary.Write(preimage, binary.LittleEndian, tx.Version)
+	preimage.Write(hashPrevouts[:])
+	preimage.Write(hashSequence[:])
+	in.writeOutPoint(preimage)
+	writeVarBytes(preimage, scriptCode)
+	binary.Write(preimage, binary.LittleEndian, amount)
+	binary.Write(preimage, binary.LittleEndian, in.Sequence)
+	preimage.Write(hashOutputs[:])
+	binary.Write(preimage, binary.LittleEndian, tx.LockTime)
+	binary.Write(preimage, binary.LittleEndian, hashType)
+	digest := doubleSHA256(preimage.Bytes())
+	return digest[:], nil
+}
+
+// TaprootSigHash is the BIP-341 digest signed by a key path spend without annex,
+// prevouts are the outputs spent by all the inputs of the transaction
+func TaprootSigHash(tx *BTCTx, index int, prevouts []*BTCTxOut, hashType uint32) ([]byte, error) {
+	switch hashType {
+	case SigHashDefault, SigHashAll, SigHashNone, SigHashSingle,
+		SigHashAll | SigHashAnyoneCanPay, SigHashNone | SigHashAnyoneCanPay, SigHashSingle | SigHashAnyoneCanPay:
+	default:
+		return nil, fmt.Errorf("invalid taproot sighash type 0x%02x", hashType)
+	}
+	if len(prevouts) != len(tx.Inputs) {
+		return nil, fmt.Errorf("taproot signatures need the outputs spent by all the inputs")
+	}
+	base := hashType & 0x03
+	anyoneCanPay := hashType&SigHashAnyoneCanPay != 0
+	if base == SigHashSingle && index >= len(tx.Outputs) {
+		return nil, fmt.Errorf("SIGHASH_SINGLE input %d has no matching output", index)
+	}
+	msg := &bytes.Buffer{}
+	// sighash epoch
+	msg.WriteByte(0)
+	msg.WriteByte(byte(hashType))
+	binary.Write(msg, binary.LittleEndian, tx.Version)
+	binary.Write(msg, binary.LittleEndian, tx.LockTime)
+	if !anyoneCanPay {
+		outpoints, amounts, scripts, sequences := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+		for i, in := range tx.Inputs {
+			in.writeOutPoint(outpoints)
+			binary.Write(amounts, binary.LittleEndian, prevouts[i].Value)
+			writeVarBytes(scripts, prevouts[i].Script)
+			binary.Write(sequences, binary.LittleEndian, in.Sequence)
+		}
+		for _, data := range []*bytes.Buffer{outpoints, amounts, scripts, sequences} {
+			sum := sha256.Sum256(data.Bytes())
+			msg.Write(sum[:])
+		}
+	}
+	if base != SigHashNone && base != SigHashSingle {
+		outputs := &bytes.Buffer{}
+		for _, out := range tx.Outputs {
+			out.write(outputs)
+		}
+		sum := sha256.Sum256(outputs.Bytes())
+		msg.Write(sum[:])
+	}
+	// spend type: key path, no annex
+	msg.WriteByte(0)
+	if anyoneCanPay {
+		in := tx.Inputs[index]
+		in.writeOutPoint(msg)
+		prevouts[index].write(msg)
+		binary.Write(msg, binary.LittleEndian, in.Sequence)
+	} else {
+		binary.Write(msg, binary.LittleEndian, uint32(index))
+	}
+	if base == SigHashSingle {
+		output := &bytes.Buffer{}
+		tx.Outputs[index].write(output)
+		sum := sha256.Sum256(output.Bytes())
+		msg.Write(sum[:])
+	}
+	return TaggedHash("TapSighash", msg.Bytes()), nil
+}
+
+// TaggedHash is the BIP-340 hash sha256(sha256(tag)||sha256(tag)||data)
+func TaggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func doubleSHA256(data []byte) [32]byte {
+	first := sha256.Sum256(data)
+	return sha256.Sum256(first[:])
+}
+
+func readCompactSize(r io.ByteReader) (uint64, error) {
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	size := 0
+	switch prefix {
+	case 0xfd:
+		size = 2
+	case 0xfe:
+		size = 4
+	case 0xff:
+		size = 8
+	default:
+		return uint64(prefix), nil
+	}
+	var value uint64
+	for i := 0; i < size; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint64(b) << (8 * uint(i))
+	}
+	return value, nil
+}
+
+func writeCompactSize(w io.Writer, value uint64) {
+	switch {
+	case value < 0xfd:
+		w.Write([]byte{byte(value)})
+	case value <= 0xffff:
+		w.Write([]byte{0xfd})
+		binary.Write(w, binary.LittleEndian, uint16(value))
+	case value <= 0xffffffff:
+		w.Write([]byte{0xfe})
+		binary.Write(w, binary.LittleEndian, uint32(value))
+	default:
+		w.Write([]byte{0xff})
+		binary.Write(w, binary.LittleEndian, value)
+	}
+}
+
+func readVarBytes(r *bytes.Reader) ([]byte, error) {
+	size, err := readCompactSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+func writeVarBytes(w io.Writer, data []byte) {
+	writeCompactSize(w, uint64(len(data)))
+	w.Write(data)
+}
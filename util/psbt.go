@@ -0,0 +1,200 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// key types of PSBT entries used by the signer, see BIP-174 and BIP-371
+const (
+	PSBTGlobalUnsignedTx     = 0x00
+	PSBTGlobalVersion        = 0xfb
+	PSBTInNonWitnessUtxo     = 0x00
+	PSBTInWitnessUtxo        = 0x01
+	PSBTInPartialSig         = 0x02
+	PSBTInSighashType        = 0x03
+	PSBTInRedeemScript       = 0x04
+	PSBTInWitnessScript      = 0x05
+	PSBTInFinalScriptSig     = 0x07
+	PSBTInFinalScriptWitness = 0x08
+	PSBTInTapKeySig          = 0x13
+)
+
+var psbtMagic = []byte("psbt\xff")
+
+// PSBTEntry is a key-value pair of a PSBT map, the first byte of the key is its type
+type PSBTEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// PSBTMap keeps the entries of a map in order, so unknown entries are written back as they were read
+type PSBTMap []PSBTEntry
+
+// PSBT is a version 0 partially signed bitcoin transaction
+type PSBT struct {
+	Tx      *BTCTx
+	Global  PSBTMap
+	Inputs  []PSBTMap
+	Outputs []PSBTMap
+}
+
+// ParsePSBT decodes a serialized version 0 PSBT
+func ParsePSBT(data []byte) (*PSBT, error) {
+	if !bytes.HasPrefix(data, psbtMagic) {
+		return nil, fmt.Errorf("invalid PSBT: bad magic")
+	}
+	r := bytes.NewReader(data[len(psbtMagic):])
+	psbt := &PSBT{}
+	var err error
+	if psbt.Global, err = readPSBTMap(r); err != nil {
+		return nil, fmt.Errorf("invalid PSBT global map: %s", err)
+	}
+	if version := psbt.Global.Get(PSBTGlobalVersion); version != nil && (len(version) != 4 || binary.LittleEndian.Uint32(version) != 0) {
+		return nil, fmt.Errorf("only version 0 PSBTs are supported")
+	}
+	unsignedTx := psbt.Global.Get(PSBTGlobalUnsignedTx)
+	if unsignedTx == nil {
+		return nil, fmt.Errorf("invalid PSBT: no unsigned transaction")
+	}
+	if psbt.Tx, err = ParseBTCTx(unsignedTx); err != nil {
+		return nil, err
+	}
+	for _, in := range psbt.Tx.Inputs {
+		if len(in.Script) != 0 || len(in.Witness) != 0 {
+			return nil, fmt.Errorf("invalid PSBT: the unsigned transaction has signatures")
+		}
+	}
+	for range psbt.Tx.Inputs {
+		m, err := readPSBTMap(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PSBT input map: %s", err)
+		}
+		psbt.Inputs = append(psbt.Inputs, m)
+	}
+	for range psbt.Tx.Outputs {
+		m, err := readPSBTMap(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PSBT output map: %s", err)
+		}
+		psbt.Outputs = append(psbt.Outputs, m)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("invalid PSBT: %d trailing bytes", r.Len())
+	}
+	return psbt, nil
+}
+
+func readPSBTMap(r *bytes.Reader) (PSBTMap, error) {
+	m := PSBTMap{}
+	seen := map[string]bool{}
+	for {
+		key, err := readVarBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		// an empty key is the separator ending the map
+		if len(key) == 0 {
+			return m, nil
+		}
+		value, err := readVarBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		if seen[string(key)] {
+			return nil, fmt.Errorf("duplicate key %x", key)
+		}
+		seen[string(key)] = true
+		m = append(m, PSBTEntry{Key: key, Value: value})
+	}
+}
+
+// Serialize encodes the PSBT
+func (p *PSBT) Serialize() []byte {
+	w := bytes.NewBuffer(append([]byte{}, psbtMagic...))
+	for _, m := range append(append([]PSBTMap{p.Global}, p.Inputs...), p.Outputs...) {
+		for _, entry := range m {
+			writeVarBytes(w, entry.Key)
+			writeVarBytes(w, entry.Value)
+		}
+		w.WriteByte(0)
+	}
+	return w.Bytes()
+}
+
+// Get returns the value of the entry whose key is only the type, nil if there is none
+func (m PSBTMap) Get(keyType byte) []byte {
+	for _, entry := range m {
+		if len(entry.Key) == 1 && entry.Key[0] == keyType {
+			return entry.Value
+		}
+	}
+	return nil
+}
+
+// Set replaces the value of the key, or adds the entry
+func (m *PSBTMap) Set(key, value []byte) {
+	for i := range *m {
+		if bytes.Equal((*m)[i].Key, key) {
+			(*m)[i].Value = value
+			return
+		}
+	}
+	*m = append(*m, PSBTEntry{Key: key, Value: value})
+}
+
+// SighashType returns the sighash type requested by an input, ok is false when it has none
+func (p *PSBT) SighashType(index int) (hashType uint32, ok bool, err error) {
+	value := p.Inputs[index].Get(PSBTInSighashType)
+	if value == nil {
+		return 0, false, nil
+	}
+	if len(value) != 4 {
+		return 0, false, fmt.Errorf("invalid sighash type of input %d", index)
+	}
+	return binary.LittleEndian.Uint32(value), true, nil
+}
+
+// Finalized tells if an input already has its final scriptSig or witness
+func (p *PSBT) Finalized(index int) bool {
+	return p.Inputs[index].Get(PSBTInFinalScriptSig) != nil || p.Inputs[index].Get(PSBTInFinalScriptWitness) != nil
+}
+
+// Utxo returns the output spent by an input, from its witness UTXO or from its full previous transaction.
+// witnessOnly is true when the previous transaction is not known, legacy inputs require it.
+func (p *PSBT) Utxo(index int) (utxo *BTCTxOut, witnessOnly bool, err error) {
+	in := p.Tx.Inputs[index]
+	var fromTx *BTCTxOut
+	if prevTx := p.Inputs[index].Get(PSBTInNonWitnessUtxo); prevTx != nil {
+		tx, err := ParseBTCTx(prevTx)
+		if err != nil {
+			return nil, false, err
+		}
+		if tx.TxHash() != in.Hash {
+			return nil, false, fmt.Errorf("previous transaction of input %d does not match its outpoint", index)
+		}
+		if int(in.Index) >= len(tx.Outputs) {
+			return nil, false, fmt.Errorf("previous transaction of input %d has no output %d", index, in.Index)
+		}
+		fromTx = tx.Outputs[in.Index]
+	}
+	if value := p.Inputs[index].Get(PSBTInWitnessUtxo); value != nil {
+		r := bytes.NewReader(value)
+		out := &BTCTxOut{}
+		if err := binary.Read(r, binary.LittleEndian, &out.Value); err != nil {
+			return nil, false, fmt.Errorf("invalid witness UTXO of input %d", index)
+		}
+		if out.Script, err = readVarBytes(r); err != nil || r.Len() != 0 {
+			return nil, false, fmt.Errorf("invalid witness UTXO of input %d", index)
+		}
+		if fromTx != nil && (fromTx.Value != out.Value || !bytes.Equal(fromTx.Script, out.Script)) {
+			return nil, false, fmt.Errorf("witness UTXO of input %d does not match its previous transaction", index)
+		}
+		return out, fromTx == nil, nil
+	}
+	if fromTx == nil {
+		return nil, false, fmt.Errorf("input %d has no UTXO", index)
+	}
+	return fromTx, false, nil
+}
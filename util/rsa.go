@@ -0,0 +1,91 @@
+package util
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+
+	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
+	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+)
+
+// RSA signature schemes
+const (
+	// RSAPaddingPKCS1v15 is RSASSA-PKCS1-v1_5, signed with CKM_RSA_PKCS over the DigestInfo
+	RSAPaddingPKCS1v15 = "pkcs1v15"
+	// RSAPaddingPSS is RSASSA-PSS with MGF1 of the same hash, signed with CKM_RSA_PKCS_PSS over the digest
+	RSAPaddingPSS = "pss"
+)
+
+// rsaHashes are the hashes RSA signatures can be made with
+var rsaHashes = map[crypto.Hash]struct {
+	name string
+	mech ep11.Mechanism
+	mgf  pb.RSAPSSParm_Mask
+	// DER encoded DigestInfo without the digest, see RFC 8017 section 9.2
+	prefix []byte
+}{
+	crypto.SHA224: {"sha224", ep11.CKM_SHA224, pb.RSAPSSParm_CkgMgf1Sha224, []byte{0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c}},
+	crypto.SHA256: {"sha256", ep11.CKM_SHA256, pb.RSAPSSParm_CkgMgf1Sha256, []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}},
+	crypto.SHA384: {"sha384", ep11.CKM_SHA384, pb.RSAPSSParm_CkgMgf1Sha384, []byte{0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30}},
+	crypto.SHA512: {"sha512", ep11.CKM_SHA512, pb.RSAPSSParm_CkgMgf1Sha512, []byte{0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40}},
+}
+
+// ParseRSAHash maps a hash name of a request (sha256, SHA-256, ...) to the hash, empty is SHA-256
+func ParseRSAHash(name string) (crypto.Hash, error) {
+	if name == "" {
+		return crypto.SHA256, nil
+	}
+	name = strings.ToLower(strings.Replace(name, "-", "", 1))
+	for hash, h := range rsaHashes {
+		if h.name == name {
+			return hash, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash %q, use sha224, sha256, sha384 or sha512", name)
+}
+
+// RSAHashFromMechanism returns the hash of a CKM_SHA* mechanism, 0 if it is not supported
+func RSAHashFromMechanism(mech ep11.Mechanism) crypto.Hash {
+	for hash, h := range rsaHashes {
+		if h.mech == mech {
+			return hash
+		}
+	}
+	return 0
+}
+
+// RSAMGF returns the MGF1 mask generation function of a hash
+func RSAMGF(hash crypto.Hash) pb.RSAPSSParm_Mask {
+	return rsaHashes[hash].mgf
+}
+
+// RSASignMechanism returns the mechanism signing a digest with the padding, and the data to pass to it.
+// A PSS salt length of 0 or less means the hash size.
+func RSASignMechanism(hash crypto.Hash, digest []byte, padding string, saltLength int) (*pb.Mechanism, []byte, error) {
+	h, ok := rsaHashes[hash]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported hash %s", hash)
+	}
+	if len(digest) != hash.Size() {
+		return nil, nil, fmt.Errorf("%s digest must be %d bytes, got [%d]", h.name, hash.Size(), len(digest))
+	}
+	switch padding {
+	case "", RSAPaddingPKCS1v15:
+		return &pb.Mechanism{Mechanism: ep11.CKM_RSA_PKCS}, append(append([]byte{}, h.prefix...), digest...), nil
+	case RSAPaddingPSS:
+		if saltLength <= 0 {
+			saltLength = hash.Size()
+		}
+		mech := &pb.Mechanism{
+			Mechanism: ep11.CKM_RSA_PKCS_PSS,
+			Parameter: &pb.Mechanism_RSAPSSParameter{RSAPSSParameter: &pb.RSAPSSParm{
+				HashMech:      h.mech,
+				Mgf:           h.mgf,
+				SaltByteCount: uint64(saltLength),
+			}},
+		}
+		return mech, digest, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported padding %q, use %s or %s", padding, RSAPaddingPKCS1v15, RSAPaddingPSS)
+}
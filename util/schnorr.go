@@ -0,0 +1,39 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+const (
+	// SchnorrMessageLength is the length of the messages BIP-340 signs, they are already hashed
+	SchnorrMessageLength = 32
+	// SchnorrSignatureLength is the length of BIP-340 signatures, R.x||s
+	SchnorrSignatureLength = 64
+)
+
+// XOnlyPublicKey is the 32 bytes x coordinate BIP-340 and taproot identify a public key with
+func XOnlyPublicKey(pub *ecdsa.PublicKey) []byte {
+	return pub.X.FillBytes(make([]byte, 32))
+}
+
+// VerifySchnorr checks sig is the BIP-340 signature of the 32 bytes message by the key
+func VerifySchnorr(pub *ecdsa.PublicKey, message, sig []byte) error {
+	if len(message) != SchnorrMessageLength {
+		return fmt.Errorf("BIP-340 messages must be %d bytes, got [%d]", SchnorrMessageLength, len(message))
+	}
+	xOnly, err := schnorr.ParsePubKey(XOnlyPublicKey(pub))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %s", err)
+	}
+	signature, err := schnorr.ParseSignature(sig)
+	if err != nil {
+		return fmt.Errorf("invalid BIP-340 signature: %s", err)
+	}
+	if !signature.Verify(message, xOnly) {
+		return fmt.Errorf("signature is not a valid BIP-340 signature")
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package util
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// SignatureFormat is the encoding of an ECDSA signature returned to clients
+type SignatureFormat string
+
+const (
+	// SigFormatRaw is r||s as returned by EP11, each half padded to the curve size
+	SigFormatRaw SignatureFormat = "raw"
+	// SigFormatDER is the ASN.1 DER SEQUENCE{r, s} used by X.509, TLS and openssl
+	SigFormatDER SignatureFormat = "der"
+	// SigFormatEthereum is r||s||v, v is 27/28 or 35+2*chainId+recid (EIP-155) when a chain id is given
+	SigFormatEthereum SignatureFormat = "ethereum"
+	// SigFormatCompact is the bitcoin compact recoverable format header||r||s, header is 27+recid (+4 if compressed)
+	SigFormatCompact SignatureFormat = "compact"
+)
+
+// ParseSignatureFormat maps a sig_format request value to a SignatureFormat, empty is raw.
+// "ans1" and "asn1" are kept as aliases of der for existing clients.
+func ParseSignatureFormat(format string) (SignatureFormat, error) {
+	switch format {
+	case "", string(SigFormatRaw):
+		return SigFormatRaw, nil
+	case string(SigFormatDER), "ans1", "asn1":
+		return SigFormatDER, nil
+	case string(SigFormatEthereum):
+		return SigFormatEthereum, nil
+	case string(SigFormatCompact), "compact-recoverable":
+		return SigFormatCompact, nil
+	}
+	return "", fmt.Errorf("unknown signature format %q", format)
+}
+
+// Recoverable tells if the format carries a recovery id, which needs the signed digest and public key
+func (f SignatureFormat) Recoverable() bool {
+	return f == SigFormatEthereum || f == SigFormatCompact
+}
+
+// DefaultLowS is the low-S setting of a format when the client does not choose one:
+// recoverable formats follow the ethereum/bitcoin rules and normalize s, raw and der keep EP11's output
+func (f SignatureFormat) DefaultLowS() bool {
+	return f.Recoverable()
+}
+
+// SignatureOptions controls how FormatSignature encodes a raw EP11 signature
+type SignatureOptions struct {
+	Format SignatureFormat
+	// LowS replaces s with N-s when s > N/2
+	LowS bool
+	// ChainID selects the EIP-155 v of the ethereum format, nil means v is 27/28
+	ChainID *big.Int
+	// Compressed sets the compressed flag in the header of the compact format
+	Compressed bool
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// SplitSignature splits a raw r||s signature into its two halves
+func SplitSignature(sig []byte) (r, s *big.Int, err error) {
+	var sigLen = len(sig)
+	if sigLen == 0 || sigLen%2 != 0 {
+		return nil, nil, fmt.Errorf("Signature length is not even: [%d]", sigLen)
+	}
+	return new(big.Int).SetBytes(sig[:sigLen/2]), new(big.Int).SetBytes(sig[sigLen/2:]), nil
+}
+
+// NormalizeLowS returns a copy of the raw r||s signature with s in the lower half of the curve order
+func NormalizeLowS(sig []byte, pub *ecdsa.PublicKey) ([]byte, error) {
+	r, s, err := SplitSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	n := pub.Curve.Params().N
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s.Sub(n, s)
+	}
+	result := make([]byte, len(sig))
+	r.FillBytes(result[:len(sig)/2])
+	s.FillBytes(result[len(sig)/2:])
+	return result, nil
+}
+
+// RecoverableSignature returns the 65 bytes r||s||recid of a raw secp256k1 signature over a 32 bytes digest,
+// recid (0 or 1) is the one that recovers pub from the digest
+func RecoverableSignature(sig, digest []byte, pub *ecdsa.PublicKey) ([]byte, error) {
+	if len(sig) != 64 {
+		return nil, fmt.Errorf("unexpected secp256k1 signature length: [%d]", len(sig))
+	}
+	if len(digest) != 32 {
+		return nil, fmt.Errorf("recoverable signatures require a 32 bytes digest, got [%d]", len(digest))
+	}
+	expected := crypto.FromECDSAPub(pub)
+	result := make([]byte, 65)
+	copy(result, sig)
+	for recid := byte(0); recid < 2; recid++ {
+		result[64] = recid
+		recovered, err := crypto.Ecrecover(digest, result)
+		if err == nil && bytes.Equal(recovered, expected) {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("signature does not recover to the public key")
+}
+
+// FormatSignature encodes a raw r||s signature from EP11.
+// digest and pub are the signed data and the signer's public key, recoverable formats need both.
+func FormatSignature(sig, digest []byte, pub *ecdsa.PublicKey, opts SignatureOptions) ([]byte, error) {
+	var err error
+	if opts.LowS {
+		if sig, err = NormalizeLowS(sig, pub); err != nil {
+			return nil, err
+		}
+	}
+
+	switch opts.Format {
+	case "", SigFormatRaw:
+		return sig, nil
+	case SigFormatDER:
+		r, s, err := SplitSignature(sig)
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(ecdsaSignature{r, s})
+	case SigFormatEthereum:
+		result, err := RecoverableSignature(sig, digest, pub)
+		if err != nil {
+			return nil, err
+		}
+		if opts.ChainID == nil {
+			result[64] += 27
+			return result, nil
+		}
+		v := new(big.Int).Add(new(big.Int).Lsh(opts.ChainID, 1), big.NewInt(35+int64(result[64])))
+		return append(result[:64], v.Bytes()...), nil
+	case SigFormatCompact:
+		recoverable, err := RecoverableSignature(sig, digest, pub)
+		if err != nil {
+			return nil, err
+		}
+		header := 27 + recoverable[64]
+		if opts.Compressed {
+			header += 4
+		}
+		return append([]byte{header}, recoverable[:64]...), nil
+	}
+	return nil, fmt.Errorf("unknown signature format %q", opts.Format)
+}
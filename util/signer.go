@@ -9,30 +9,33 @@ package util
 import (
 	"context"
 	"crypto"
+	"crypto/rsa"
 	"encoding/asn1"
 	"fmt"
 	"io"
-	"math/big"
 
 	"github.com/IBM-Cloud/hpcs-grep11-go/ep11"
 	pb "github.com/IBM-Cloud/hpcs-grep11-go/grpc"
+	"google.golang.org/grpc"
 )
 
+// SingleSigner is the part of pb.CryptoClient an EP11PrivateKey signs with
+type SingleSigner interface {
+	SignSingle(ctx context.Context, in *pb.SignSingleRequest, opts ...grpc.CallOption) (*pb.SignSingleResponse, error)
+}
+
 // EP11PrivateKey MUST implement crypto.Signer interface so that the crypt/tls package can use
 // an EP11PrivateKey in tls.Certificate: https://golang.org/pkg/crypto/tls/#Certificate
 type EP11PrivateKey struct {
 	algorithmOID asn1.ObjectIdentifier
 	keyBlob      []byte
-	pubKey       crypto.PublicKey // &ecdsa.PublicKey{} (rsa PublicKey not support yet)
-	cryptoClient pb.CryptoClient
+	pubKey       crypto.PublicKey // &ecdsa.PublicKey{} or *rsa.PublicKey
+	cryptoClient SingleSigner
 }
 
-// Sign returns a signature in ASN1 format
+// Sign returns a signature in ASN1 format for EC keys, and a PKCS #1 v1.5 or PSS (with *rsa.PSSOptions) signature for RSA keys
 // Reference code crypto/ecdsa.go, func (priv *PrivateKey) Sign() ([]byte, error)
 func (priv *EP11PrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	type ecdsaSignature struct {
-		R, S *big.Int
-	}
 	if priv.algorithmOID.Equal(OIDECPublicKey) {
 		SignSingleRequest := &pb.SignSingleRequest{
 			Mech:    &pb.Mechanism{Mechanism: ep11.CKM_ECDSA},
@@ -44,30 +47,37 @@ func (priv *EP11PrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.Sign
 			return nil, fmt.Errorf("SignSingle Error: %s", err)
 		}
 		// ep11 returns a raw signature byte array that must be encoded to ASN1 for tls package usage.
-		var sigLen = len(SignSingleResponse.Signature)
-		if sigLen%2 != 0 {
-			return nil, fmt.Errorf("Signature length is not even: [%d]", sigLen)
-		}
-		r := new(big.Int)
-		s := new(big.Int)
-
-		r.SetBytes(SignSingleResponse.Signature[0 : sigLen/2])
-		s.SetBytes(SignSingleResponse.Signature[sigLen/2:])
-		return asn1.Marshal(ecdsaSignature{r, s})
+		return FormatSignature(SignSingleResponse.Signature, digest, nil, SignatureOptions{Format: SigFormatDER})
 	} else if priv.algorithmOID.Equal(OIDRSAPublicKey) {
-		return nil, fmt.Errorf("RSA public key is currently not supported")
+		padding, saltLength := RSAPaddingPKCS1v15, 0
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			padding, saltLength = RSAPaddingPSS, pssOpts.SaltLength
+		}
+		mech, data, err := RSASignMechanism(opts.HashFunc(), digest, padding, saltLength)
+		if err != nil {
+			return nil, err
+		}
+		SignSingleResponse, err := priv.cryptoClient.SignSingle(context.Background(), &pb.SignSingleRequest{
+			Mech:    mech,
+			PrivKey: priv.keyBlob,
+			Data:    data,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("SignSingle Error: %s", err)
+		}
+		return SignSingleResponse.Signature, nil
 	} else {
 		return nil, fmt.Errorf("Unsupported Public key type: %v", priv.algorithmOID)
 	}
 }
 
-//Public is part of the crypto.Signer interface implementation
+// Public is part of the crypto.Signer interface implementation
 func (priv *EP11PrivateKey) Public() crypto.PublicKey {
 	return priv.pubKey
 }
 
 // NewEP11Signer is used in the creation of a TLS certificate
-func NewEP11Signer(cryptoClient pb.CryptoClient, privKeyBlob []byte, spki []byte) (*EP11PrivateKey, error) {
+func NewEP11Signer(cryptoClient SingleSigner, privKeyBlob []byte, spki []byte) (*EP11PrivateKey, error) {
 	pubKey, oidAlg, err := GetPubKey(spki)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get public key: %s", err)
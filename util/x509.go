@@ -0,0 +1,130 @@
+package util
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+var (
+	OIDExtensionKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 15}
+	OIDExtensionExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// keyUsageNames are the names of the X.509 key usages in requests
+var keyUsageNames = []struct {
+	name  string
+	usage x509.KeyUsage
+}{
+	{"digital_signature", x509.KeyUsageDigitalSignature},
+	{"content_commitment", x509.KeyUsageContentCommitment},
+	{"key_encipherment", x509.KeyUsageKeyEncipherment},
+	{"data_encipherment", x509.KeyUsageDataEncipherment},
+	{"key_agreement", x509.KeyUsageKeyAgreement},
+	{"cert_sign", x509.KeyUsageCertSign},
+	{"crl_sign", x509.KeyUsageCRLSign},
+	{"encipher_only", x509.KeyUsageEncipherOnly},
+	{"decipher_only", x509.KeyUsageDecipherOnly},
+}
+
+// extKeyUsageNames are the names of the X.509 extended key usages in requests, with their OIDs
+var extKeyUsageNames = []struct {
+	name  string
+	usage x509.ExtKeyUsage
+	oid   asn1.ObjectIdentifier
+}{
+	{"any", x509.ExtKeyUsageAny, asn1.ObjectIdentifier{2, 5, 29, 37, 0}},
+	{"server_auth", x509.ExtKeyUsageServerAuth, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}},
+	{"client_auth", x509.ExtKeyUsageClientAuth, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}},
+	{"code_signing", x509.ExtKeyUsageCodeSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}},
+	{"email_protection", x509.ExtKeyUsageEmailProtection, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4}},
+	{"time_stamping", x509.ExtKeyUsageTimeStamping, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}},
+	{"ocsp_signing", x509.ExtKeyUsageOCSPSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 9}},
+}
+
+// ParseKeyUsages combines key usages named like digital_signature or cert_sign
+func ParseKeyUsages(names []string) (x509.KeyUsage, error) {
+	var usage x509.KeyUsage
+next:
+	for _, name := range names {
+		for _, u := range keyUsageNames {
+			if strings.EqualFold(name, u.name) {
+				usage |= u.usage
+				continue next
+			}
+		}
+		return 0, fmt.Errorf("unknown key usage %q", name)
+	}
+	return usage, nil
+}
+
+// KeyUsageNames names the key usages set in usage
+func KeyUsageNames(usage x509.KeyUsage) []string {
+	names := []string{}
+	for _, u := range keyUsageNames {
+		if usage&u.usage != 0 {
+			names = append(names, u.name)
+		}
+	}
+	return names
+}
+
+// ParseExtKeyUsages maps extended key usages named like server_auth or client_auth
+func ParseExtKeyUsages(names []string) ([]x509.ExtKeyUsage, error) {
+	usages := []x509.ExtKeyUsage{}
+next:
+	for _, name := range names {
+		for _, u := range extKeyUsageNames {
+			if strings.EqualFold(name, u.name) {
+				usages = append(usages, u.usage)
+				continue next
+			}
+		}
+		return nil, fmt.Errorf("unknown extended key usage %q", name)
+	}
+	return usages, nil
+}
+
+// KeyUsageExtension is the critical key usage extension, x509.CertificateRequest has no field for it
+func KeyUsageExtension(usage x509.KeyUsage) (pkix.Extension, error) {
+	// bit 0 of the key usage is the most significant bit of the first byte
+	bits := asn1.BitString{}
+	for i := 0; i < 9; i++ {
+		if usage&(1<<uint(i)) != 0 {
+			bits.BitLength = i + 1
+		}
+	}
+	bits.Bytes = make([]byte, (bits.BitLength+7)/8)
+	for i := 0; i < bits.BitLength; i++ {
+		if usage&(1<<uint(i)) != 0 {
+			bits.Bytes[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	value, err := asn1.Marshal(bits)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: OIDExtensionKeyUsage, Critical: true, Value: value}, nil
+}
+
+// ExtKeyUsageExtension is the extended key usage extension of usages
+func ExtKeyUsageExtension(usages []x509.ExtKeyUsage) (pkix.Extension, error) {
+	oids := []asn1.ObjectIdentifier{}
+next:
+	for _, usage := range usages {
+		for _, u := range extKeyUsageNames {
+			if u.usage == usage {
+				oids = append(oids, u.oid)
+				continue next
+			}
+		}
+		return pkix.Extension{}, fmt.Errorf("unsupported extended key usage %d", usage)
+	}
+	value, err := asn1.Marshal(oids)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: OIDExtensionExtKeyUsage, Value: value}, nil
+}